@@ -1,18 +1,27 @@
 module github.com/macronut/phantomsocks
 
-go 1.18
+go 1.21
 
 require (
 	github.com/chai2010/winsvc v0.0.0-20200705094454-db7ec320025c
 	github.com/google/gopacket v1.1.19
 	github.com/macronut/go-tproxy v0.0.0-20190726054950-ef7efd7f24ed
 	github.com/macronut/godivert v0.0.0-20220121081532-78e5dd672daf
-	golang.org/x/sys v0.5.0
+	github.com/quic-go/quic-go v0.41.0
+	golang.org/x/sys v0.8.0
 )
 
 require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/williamfhe/godivert v0.0.0-20181229124620-a48c5b872c73 // indirect
-	golang.org/x/net v0.7.0 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	golang.org/x/crypto v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
 )
 
 replace (
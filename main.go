@@ -1,99 +1,88 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	ptcp "github.com/macronut/phantomsocks/phantomtcp"
 	proxy "github.com/macronut/phantomsocks/proxy"
+	"github.com/quic-go/quic-go"
 )
 
 var ConfigFile string = "config.json"
 var LogLevel int = 0
 var MaxProcs int = 1
 var PassiveMode bool = false
-var allowlist map[string]bool = nil
+var ReloadInterval int = 5
+var allowlist atomic.Value
 
-func ListenAndServe(addr string, key string, serve func(net.Conn)) {
-	var l net.Listener = nil
+var logService = ptcp.NewLogScope("service")
+
+func Listen(addr string, key string) (net.Listener, error) {
 	keys := strings.Split(key, ",")
 	if len(keys) == 2 {
 		cer, err := tls.LoadX509KeyPair(keys[0], keys[1])
 		if err != nil {
-			fmt.Println("TLS", err)
-			return
+			return nil, err
 		}
 		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		l, err = tls.Listen("tcp", addr, config)
+		return tls.Listen("tcp", addr, config)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func Serve(l net.Listener, serve func(net.Conn)) {
+	for {
+		client, err := l.Accept()
 		if err != nil {
-			fmt.Println("TLS:", err)
-			return
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Panic(err)
 		}
-	} else {
-		var err error
-		l, err = net.Listen("tcp", addr)
+		err = proxy.SetKeepAlive(client)
 		if err != nil {
-			fmt.Println("Serve:", err)
+			log.Panic(err)
 		}
-	}
-
-	if allowlist != nil {
-		for {
-			client, err := l.Accept()
-			if err != nil {
-				log.Panic(err)
-			}
-			err = proxy.SetKeepAlive(client)
-			if err != nil {
-				log.Panic(err)
-			}
 
+		list, _ := allowlist.Load().(map[string]bool)
+		if list != nil {
 			remoteAddr := client.RemoteAddr()
 			remoteTCPAddr, _ := net.ResolveTCPAddr(remoteAddr.Network(), remoteAddr.String())
-			_, ok := allowlist[remoteTCPAddr.IP.String()]
-			if ok {
-				go serve(client)
-			} else {
+			if !list[remoteTCPAddr.IP.String()] {
 				client.Close()
+				continue
 			}
 		}
-	} else {
-		for {
-			client, err := l.Accept()
-			if err != nil {
-				log.Panic(err)
-			}
-			err = proxy.SetKeepAlive(client)
-			if err != nil {
-				log.Panic(err)
-			}
 
-			go serve(client)
-		}
+		go serve(client)
 	}
 }
 
-func PACServer(listenAddr string, profile string, proxyAddr string) {
-	l, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Panic(err)
-	}
-	pac := ptcp.GetPAC(proxyAddr, profile)
-	response := []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length:%d\r\n\r\n%s", len(pac), pac))
-	fmt.Println("PACServer:", listenAddr)
+func PACServer(l net.Listener, profile string, proxyAddr string) {
 	for {
 		client, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Panic(err)
 		}
 
@@ -104,7 +93,8 @@ func PACServer(listenAddr string, profile string, proxyAddr string) {
 			if err != nil {
 				return
 			}
-			_, err = client.Write(response)
+			pac := ptcp.GetPAC(proxyAddr, profile)
+			_, err = fmt.Fprintf(client, "HTTP/1.1 200 OK\r\nContent-Length:%d\r\n\r\n%s", len(pac), pac)
 			if err != nil {
 				return
 			}
@@ -112,24 +102,16 @@ func PACServer(listenAddr string, profile string, proxyAddr string) {
 	}
 }
 
-func DNSServer(listenAddr string) error {
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		return err
-	}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
-	}
+func DNSServer(conn *net.UDPConn) {
 	defer conn.Close()
 
-	fmt.Println("DNS:", listenAddr)
-	go ListenAndServe(listenAddr, "", ptcp.DNSTCPServer)
-
 	data := make([]byte, 512)
 	for {
 		n, clientAddr, err := conn.ReadFromUDP(data)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 
@@ -142,165 +124,629 @@ func DNSServer(listenAddr string) error {
 	}
 }
 
-func StartService() {
-	conf, err := os.Open(ConfigFile)
+func DoQServer(l *quic.Listener) {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		list, _ := allowlist.Load().(map[string]bool)
+		if list != nil {
+			addr, _ := conn.RemoteAddr().(*net.UDPAddr)
+			if addr == nil || !list[addr.IP.String()] {
+				conn.CloseWithError(ptcp.DOQ_NO_ERROR, "")
+				continue
+			}
+		}
+
+		go ptcp.DoQServer(conn)
+	}
+}
+
+type Config struct {
+	VirtualAddrPrefix int    `json:"vaddrprefix,omitempty"`
+	SystemProxy       string `json:"proxy,omitempty"`
+	HostsFile         string `json:"hosts,omitempty"`
+
+	Log         *ptcp.LogConfig         `json:"log,omitempty"`
+	DNSCache    *ptcp.DNSCacheConfig    `json:"dnscache,omitempty"`
+	VirtualAddr *ptcp.VirtualAddrConfig `json:"vaddr,omitempty"`
+	Clients     []string                `json:"clients,omitempty"`
+	Profiles    []string                `json:"profiles,omitempty"`
+	Services    []ptcp.ServiceConfig    `json:"services,omitempty"`
+	Interfaces  []ptcp.InterfaceConfig  `json:"interfaces,omitempty"`
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
 
-	bytes, err := ioutil.ReadAll(conf)
+	config := new(Config)
+	err = json.Unmarshal(bytes, config)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	conf.Close()
+	return config, nil
+}
 
-	var ServiceConfig struct {
-		VirtualAddrPrefix int    `json:"vaddrprefix,omitempty"`
-		SystemProxy       string `json:"proxy,omitempty"`
-		HostsFile         string `json:"hosts,omitempty"`
+// Files returns every file the config is built from, so a change to any of
+// them can trigger a reload.
+func (config *Config) Files() []string {
+	files := []string{ConfigFile}
+	files = append(files, config.Profiles...)
+	if config.HostsFile != "" {
+		files = append(files, config.HostsFile)
+	}
+	for _, service := range config.Services {
+		for _, user := range service.Users {
+			if user.Profile != "" {
+				files = append(files, user.Profile)
+			}
+		}
+	}
+	return files
+}
 
-		Clients    []string               `json:"clients,omitempty"`
-		Profiles   []string               `json:"profiles,omitempty"`
-		Services   []ptcp.ServiceConfig   `json:"services,omitempty"`
-		Interfaces []ptcp.InterfaceConfig `json:"interfaces,omitempty"`
+func (config *Config) DNSCacheFile() string {
+	if config.DNSCache == nil {
+		return ""
 	}
+	return config.DNSCache.File
+}
 
-	err = json.Unmarshal(bytes, &ServiceConfig)
-	if err != nil {
-		log.Panic(err)
+func (config *Config) VirtualAddrFile() string {
+	if config.VirtualAddr == nil {
+		return ""
 	}
+	return config.VirtualAddr.File
+}
 
-	if MaxProcs > 0 {
-		runtime.GOMAXPROCS(MaxProcs)
+func (config *Config) VirtualAddrIPv4() string {
+	if config.VirtualAddr == nil {
+		return ""
 	}
+	return config.VirtualAddr.IPv4
+}
 
-	ptcp.LogLevel = LogLevel
-	ptcp.PassiveMode = PassiveMode
-	devices := ptcp.CreateInterfaces(ServiceConfig.Interfaces)
+func (config *Config) VirtualAddrIPv6() string {
+	if config.VirtualAddr == nil {
+		return ""
+	}
+	return config.VirtualAddr.IPv6
+}
 
-	for _, filename := range ServiceConfig.Profiles {
-		err := ptcp.LoadProfile(filename)
+func FileStamp(files []string) string {
+	stamp := ""
+	for _, filename := range files {
+		info, err := os.Stat(filename)
 		if err != nil {
-			if ptcp.LogLevel > 0 {
-				log.Println(err)
-			}
-			return
+			stamp += filename + ":-;"
+			continue
 		}
+		stamp += fmt.Sprintf("%s:%d:%d;", filename, info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp
+}
+
+type Service struct {
+	Config ptcp.ServiceConfig
+	Proxy  string
+
+	users   atomic.Value
+	closers []io.Closer
+}
+
+var services = make(map[string]*Service)
+var currentConfig *Config
+var currentDevices []string
+
+func (service *Service) Close() {
+	for _, c := range service.closers {
+		c.Close()
 	}
-	if ServiceConfig.HostsFile != "" {
-		err := ptcp.LoadHosts(ServiceConfig.HostsFile)
+}
+
+func (service *Service) Users() map[string]*ptcp.ProxyUser {
+	users, _ := service.users.Load().(map[string]*ptcp.ProxyUser)
+	return users
+}
+
+func (service *Service) Listen(addr string, key string, serve func(net.Conn)) error {
+	l, err := Listen(addr, key)
+	if err != nil {
+		return err
+	}
+	service.closers = append(service.closers, l)
+	go Serve(l, serve)
+	return nil
+}
+
+// ServeHTTP serves handler to the allowed clients, with basic auth when the
+// service has users.
+func (service *Service) ServeHTTP(addr string, key string, handler http.Handler) error {
+	l, err := Listen(addr, key)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, _ := allowlist.Load().(map[string]bool)
+		if list != nil {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if !list[host] {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		if users := service.Users(); users != nil {
+			name, password, ok := r.BasicAuth()
+			if !ok || ptcp.CheckUser(users, name, password) == nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="phantomsocks"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})}
+	service.closers = append(service.closers, server)
+	go server.Serve(l)
+	return nil
+}
+
+func (service *Service) Start() error {
+	config := service.Config
+	logService.Notice("start", "protocol", config.Protocol, "addr", config.Address, "name", config.Name)
+	switch config.Protocol {
+	case "dns":
+		addr, err := net.ResolveUDPAddr("udp", config.Address)
 		if err != nil {
-			if ptcp.LogLevel > 0 {
-				log.Println(err)
+			return err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, conn)
+		go DNSServer(conn)
+		return service.Listen(config.Address, "", ptcp.DNSTCPServer)
+	case "doh":
+		// without a certificate and a key it serves plain HTTP, for a
+		// reverse proxy in front
+		certs := strings.Split(config.PrivateKey, ",")
+		if config.PrivateKey != "" && len(certs) != 2 {
+			return errors.New("doh requires a certificate and a key")
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/dns-query", ptcp.DoHServer)
+		server := &http.Server{Addr: config.Address, Handler: mux}
+		service.closers = append(service.closers, server)
+		go func() {
+			var err error
+			if config.PrivateKey != "" {
+				err = server.ListenAndServeTLS(certs[0], certs[1])
+			} else {
+				err = server.ListenAndServe()
 			}
-			return
+			if err != nil && err != http.ErrServerClosed {
+				logService.Error("doh", "addr", config.Address, "error", err)
+			}
+		}()
+	case "doq":
+		certs := strings.Split(config.PrivateKey, ",")
+		if len(certs) != 2 {
+			return errors.New("doq requires a certificate and a key")
+		}
+		cer, err := tls.LoadX509KeyPair(certs[0], certs[1])
+		if err != nil {
+			return err
+		}
+		l, err := quic.ListenAddr(config.Address,
+			&tls.Config{Certificates: []tls.Certificate{cer}, NextProtos: []string{"doq"}},
+			&quic.Config{MaxIdleTimeout: ptcp.DoQIdleTimeout},
+		)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, l)
+		go DoQServer(l)
+	case "dot":
+		if len(strings.Split(config.PrivateKey, ",")) != 2 {
+			return errors.New("dot requires a certificate and a key")
+		}
+		return service.Listen(config.Address, config.PrivateKey, ptcp.DoTServer)
+	case "http":
+		return service.Listen(config.Address, config.PrivateKey, func(client net.Conn) {
+			ptcp.HTTPProxyWithUsers(client, service.Users())
+		})
+	case "socks":
+		err := service.Listen(config.Address, config.PrivateKey, func(client net.Conn) {
+			ptcp.SocksProxyWithUsers(client, service.Users())
+		})
+		if err != nil || len(config.Users) > 0 {
+			return err
+		}
+		laddr, err := net.ResolveUDPAddr("udp", config.Address)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, conn)
+		go ptcp.SocksUDPProxy(conn)
+	case "redirect":
+		return service.Listen(config.Address, config.PrivateKey, ptcp.RedirectProxy)
+	case "tproxy":
+		conn, err := ptcp.ListenTProxyUDP(config.Address)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, conn)
+		go ptcp.TProxyUDP(conn)
+	case "tcp":
+		if len(config.Peers) == 0 {
+			return errors.New("tcp requires a peer")
+		}
+		var l net.Listener
+		var err error
+		keys := strings.Split(config.PrivateKey, ",")
+		if len(keys) == 2 {
+			l, err = Listen(config.Address, config.PrivateKey)
+		} else if config.Address[0] == '[' {
+			l, err = net.Listen("tcp6", config.Address)
+		} else {
+			l, err = net.Listen("tcp", config.Address)
+		}
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, l)
+		go ptcp.TCPMapping(l, config.Peers[0].Endpoint)
+	case "udp":
+		if len(config.Peers) == 0 {
+			return errors.New("udp requires a peer")
+		}
+		conn, err := ptcp.ListenUDPMapping(config.Address)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, conn)
+		go ptcp.ServeUDPMapping(conn, config.Address, config.Peers[0].Endpoint)
+	case "pac":
+		if service.Proxy == "" {
+			return nil
+		}
+		l, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, l)
+		go PACServer(l, config.Profile, service.Proxy)
+	case "api":
+		return service.ServeHTTP(config.Address, config.PrivateKey, ptcp.APIHandler())
+	case "metrics":
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", ptcp.MetricsHandler)
+		return service.ServeHTTP(config.Address, config.PrivateKey, mux)
+	case "reverse":
+		err := service.Listen(config.Address, config.PrivateKey, ptcp.SNIProxy)
+		if err != nil {
+			return err
+		}
+		conn, err := ptcp.ListenUDP(config.Address)
+		if err != nil {
+			return err
+		}
+		service.closers = append(service.closers, conn)
+		go ptcp.QUICProxy(conn)
+	}
+	return nil
+}
+
+// ApplyConfig builds the interfaces and profiles of config off to the side
+// and swaps them in. Services are started, restarted or stopped to match
+// config; connections that are already relayed are left alone.
+func ApplyConfig(config *Config) error {
+	err := ptcp.ConfigureLog(config.Log)
+	if err != nil {
+		return err
+	}
+	err = ptcp.ConfigureNose(config.VirtualAddr)
+	if err != nil {
+		return err
+	}
+
+	interfaces, devices := ptcp.CreateInterfaces(config.Interfaces)
+	profile := ptcp.NewProfile(interfaces)
+	for _, filename := range config.Profiles {
+		err := profile.LoadProfile(filename)
+		if err != nil {
+			return err
+		}
+	}
+	if config.HostsFile != "" {
+		err := profile.LoadHosts(config.HostsFile)
+		if err != nil {
+			return err
 		}
 	}
 
-	if len(ServiceConfig.Clients) > 0 {
-		allowlist = make(map[string]bool)
-		list := ServiceConfig.Clients
-		for _, c := range list {
-			allowlist[c] = true
+	ptcp.ConfigureDNSCache(config.DNSCache)
+	ptcp.MonitorDevices(devices)
+	ptcp.SetProfile(profile)
+
+	if len(config.Clients) > 0 {
+		list := make(map[string]bool)
+		for _, c := range config.Clients {
+			list[c] = true
 		}
+		allowlist.Store(list)
+	} else {
+		allowlist.Store(map[string]bool(nil))
 	}
 
+	running := make(map[string]*Service)
 	default_proxy := ""
-	for _, service := range ServiceConfig.Services {
-		switch service.Protocol {
-		case "dns":
-			go func(addr string) {
-				err := DNSServer(addr)
-				if err != nil {
-					fmt.Println("DNS:", err)
-				}
-			}(service.Address)
-		case "doh":
-			go func(addr string, certs []string) {
-				fmt.Println("DoH:", addr)
-				http.HandleFunc("/dns-query", ptcp.DoHServer)
-				err := http.ListenAndServeTLS(addr, certs[0], certs[1], nil)
+	for i, config := range config.Services {
+		key := config.Name
+		if key == "" {
+			key = fmt.Sprintf("%s#%d", config.Protocol, i)
+		}
+
+		service, ok := services[key]
+		users, err := ptcp.CreateUsers(config.Users)
+		if err != nil {
+			// a broken reload keeps the running service and its users
+			logService.Error("users", "name", key, "error", err)
+			if !ok {
+				continue
+			}
+			config = service.Config
+		} else {
+			if ok && (!reflect.DeepEqual(service.Config, config) || (config.Protocol == "pac" && service.Proxy != default_proxy)) {
+				logService.Notice("stop", "name", key)
+				service.Close()
+				ok = false
+			}
+			if ok {
+				service.users.Store(users)
+			} else {
+				// users are in place before the first client is accepted
+				service = &Service{Config: config, Proxy: default_proxy}
+				service.users.Store(users)
+				err = service.Start()
 				if err != nil {
-					fmt.Println("DoH:", err)
+					logService.Error("start", "name", key, "error", err)
+					service.Close()
+					continue
 				}
-			}(service.Address, strings.Split(service.PrivateKey, ","))
+			}
+		}
+		running[key] = service
+
+		switch config.Protocol {
 		case "http":
-			fmt.Println("HTTP:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.HTTPProxy)
-			default_proxy = "HTTPS " + service.Address
+			default_proxy = "HTTPS " + config.Address
 		case "socks":
-			fmt.Println("Socks:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.SocksProxy)
-			go ptcp.SocksUDPProxy(service.Address)
-			default_proxy = "SOCKS " + service.Address
-		case "redirect":
-			fmt.Println("Redirect:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.RedirectProxy)
-		case "tproxy":
-			fmt.Println("TProxy:", service.Address)
-			go ptcp.TProxyUDP(service.Address)
-		case "tcp":
-			fmt.Println("TCP:", service.Address, service.Peers[0].Endpoint)
-			var l net.Listener
-			keys := strings.Split(service.PrivateKey, ",")
-			if len(keys) == 2 {
-				cer, err := tls.LoadX509KeyPair(keys[0], keys[1])
-				if err == nil {
-					config := &tls.Config{Certificates: []tls.Certificate{cer}}
-					l, err = tls.Listen("tcp", service.Address, config)
+			default_proxy = "SOCKS " + config.Address
+		}
+	}
+
+	for key, service := range services {
+		if _, ok := running[key]; !ok {
+			logService.Notice("stop", "name", key)
+			service.Close()
+		}
+	}
+	services = running
+
+	if currentConfig != nil && (currentConfig.SystemProxy != config.SystemProxy || !reflect.DeepEqual(currentDevices, devices)) {
+		SetSystemProxy(currentConfig.SystemProxy, currentDevices, false)
+		SetSystemProxy(config.SystemProxy, devices, true)
+	} else if currentConfig == nil {
+		SetSystemProxy(config.SystemProxy, devices, true)
+	}
+
+	if currentConfig != nil && (currentConfig.VirtualAddrPrefix != config.VirtualAddrPrefix ||
+		currentConfig.VirtualAddrIPv4() != config.VirtualAddrIPv4() ||
+		currentConfig.VirtualAddrIPv6() != config.VirtualAddrIPv6()) {
+		logService.Notice("virtual address range changes take effect after a restart")
+	}
+
+	currentConfig = config
+	currentDevices = devices
+	return nil
+}
+
+func SetSystemProxy(systemProxy string, devices []string, enable bool) {
+	if systemProxy == "" {
+		return
+	}
+	for _, dev := range devices {
+		err := proxy.SetProxy(dev, systemProxy, enable)
+		if err != nil {
+			logService.Error("system proxy", "device", dev, "error", err)
+		}
+	}
+}
+
+func ReloadService() {
+	config, err := LoadConfig(ConfigFile)
+	if err == nil {
+		err = ApplyConfig(config)
+	}
+	if err != nil {
+		logService.Error("reload", "file", ConfigFile, "error", err)
+		return
+	}
+	logService.Notice("reload", "file", ConfigFile)
+}
+
+func StartService() {
+	config, err := LoadConfig(ConfigFile)
+	if err != nil {
+		logService.Notice("load config", "file", ConfigFile, "error", err)
+		return
+	}
+
+	if MaxProcs > 0 {
+		runtime.GOMAXPROCS(MaxProcs)
+	}
+
+	ptcp.LogLevel = LogLevel
+	ptcp.PassiveMode = PassiveMode
+	if config.VirtualAddrPrefix != 0 {
+		ptcp.VirtualAddrPrefix = byte(config.VirtualAddrPrefix)
+	}
+
+	if file := config.VirtualAddrFile(); file != "" {
+		err = ptcp.ConfigureNose(config.VirtualAddr)
+		if err == nil {
+			err = ptcp.LoadNose(file)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logService.Error("load virtual addresses", "file", file, "error", err)
+		}
+	}
+
+	err = ApplyConfig(config)
+	if err != nil {
+		logService.Notice("apply config", "file", ConfigFile, "error", err)
+		return
+	}
+	if file := config.DNSCacheFile(); file != "" {
+		err = ptcp.LoadDNSCacheFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logService.Error("load dns cache", "file", file, "error", err)
+		}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGHUP)
+
+	var watch <-chan time.Time
+	if ReloadInterval > 0 {
+		ticker := time.NewTicker(time.Duration(ReloadInterval) * time.Second)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+	stamp := FileStamp(currentConfig.Files())
+
+	for {
+		select {
+		case s := <-c:
+			if s != syscall.SIGHUP {
+				logService.Notice("signal", "signal", s.String())
+				SetSystemProxy(currentConfig.SystemProxy, currentDevices, false)
+				if file := currentConfig.DNSCacheFile(); file != "" {
+					err := ptcp.SaveDNSCache(file)
+					if err != nil {
+						logService.Error("save dns cache", "file", file, "error", err)
+					}
 				}
-			} else {
-				if service.Address[0] == '[' {
-					l, err = net.Listen("tcp6", service.Address)
-				} else {
-					l, err = net.Listen("tcp", service.Address)
+				if file := currentConfig.VirtualAddrFile(); file != "" {
+					err := ptcp.SaveNose(file)
+					if err != nil {
+						logService.Error("save virtual addresses", "file", file, "error", err)
+					}
 				}
+				return
 			}
-			if err != nil {
-				log.Println(err)
+			ReloadService()
+		case <-watch:
+			if FileStamp(currentConfig.Files()) == stamp {
 				continue
 			}
-
-			go ptcp.TCPMapping(l, service.Peers[0].Endpoint)
-		case "udp":
-			go ptcp.UDPMapping(service.Address, service.Peers[0].Endpoint)
-		case "pac":
-			if default_proxy != "" {
-				go PACServer(service.Address, service.Profile, default_proxy)
-			}
-		case "reverse":
-			fmt.Println("Reverse:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.SNIProxy)
-			go ptcp.QUICProxy(service.Address)
+			ReloadService()
 		}
+		stamp = FileStamp(currentConfig.Files())
 	}
+}
 
-	if ServiceConfig.SystemProxy != "" {
-		for _, dev := range devices {
-			err := proxy.SetProxy(dev, ServiceConfig.SystemProxy, true)
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
+// Probe tries the candidates on each domain and writes the winners as a
+// profile to output, or to stdout if output is empty.
+func Probe(domains []string, candidates string, output string, timeout int, harness string) {
+	config, err := LoadConfig(ConfigFile)
+	if err != nil {
+		logService.Notice("load config", "file", ConfigFile, "error", err)
+		return
 	}
 
-	if ServiceConfig.VirtualAddrPrefix != 0 {
-		ptcp.VirtualAddrPrefix = byte(ServiceConfig.VirtualAddrPrefix)
+	ptcp.LogLevel = LogLevel
+	ptcp.PassiveMode = PassiveMode
+	err = ptcp.ConfigureLog(config.Log)
+	if err != nil {
+		logService.Notice("log", "error", err)
+		return
 	}
+	interfaces, devices := ptcp.CreateInterfaces(config.Interfaces)
+	ptcp.SetProfile(ptcp.NewProfile(interfaces))
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	s := <-c
-	fmt.Println(s)
+	list, err := ptcp.ProbeCandidates(candidates, interfaces)
+	if err != nil {
+		logService.Notice("probe", "error", err)
+		return
+	}
 
-	if ServiceConfig.SystemProxy != "" {
-		for _, dev := range devices {
-			err := proxy.SetProxy(dev, ServiceConfig.SystemProxy, false)
-			if err != nil {
-				fmt.Println(err)
+	targets := domains
+	if harness != "" {
+		var hosts []string
+		for _, domain := range domains {
+			if host, _, err := net.SplitHostPort(domain); err == nil {
+				domain = host
 			}
+			hosts = append(hosts, domain)
+		}
+		h, err := ptcp.StartProbeHarness(hosts, harness)
+		if err != nil {
+			logService.Notice("probe harness", "error", err)
+			return
 		}
+		defer h.Close()
+		for i := range list {
+			h.Attach(&list[i].Interface)
+		}
+		targets = nil
+		for _, host := range hosts {
+			targets = append(targets, net.JoinHostPort(host, fmt.Sprint(h.Port)))
+		}
+	} else {
+		ptcp.MonitorDevices(devices)
+	}
+
+	winners := make(map[string]ptcp.ProbeCandidate)
+	for i, target := range targets {
+		results := ptcp.ProbeDomain(target, list, time.Duration(timeout)*time.Second)
+		for _, result := range results {
+			logService.Notice("probe", "domain", result.Domain, "interface", result.Candidate, "result", result.Result, "latency", result.Latency)
+		}
+		winner, ok := ptcp.ProbeWinner(results)
+		if !ok {
+			continue
+		}
+		for _, candidate := range list {
+			if candidate.Name == winner.Candidate {
+				winners[domains[i]] = candidate
+			}
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			logService.Notice("probe", "file", output, "error", err)
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+	err = ptcp.WriteProbeProfile(w, domains, winners)
+	if err != nil {
+		logService.Notice("probe", "file", output, "error", err)
 	}
 }
 
@@ -311,16 +757,31 @@ func main() {
 	var flagServiceRemove bool
 	var flagServiceStart bool
 	var flagServiceStop bool
+	var flagProbe string
+	var flagProbeWith string
+	var flagProbeOut string
+	var flagProbeTimeout int
+	var flagProbeHarness string
 
 	if len(os.Args) > 1 {
 		flag.StringVar(&ConfigFile, "c", "config.json", "Config file")
-		flag.IntVar(&LogLevel, "log", 0, "Log level")
+		flag.Func("log", "Log level: 0-5 or off, info, debug, trace, verbose, dump", func(s string) error {
+			level, err := ptcp.ParseLogLevel(s)
+			LogLevel = level
+			return err
+		})
 		flag.IntVar(&MaxProcs, "maxprocs", 0, "Max processes")
 		flag.BoolVar(&PassiveMode, "passive", false, "Passive mode")
+		flag.IntVar(&ReloadInterval, "reload", 5, "Seconds between config change checks, 0 to disable")
 		flag.BoolVar(&flagServiceInstall, "install", false, "Install service")
 		flag.BoolVar(&flagServiceRemove, "remove", false, "Remove service")
 		flag.BoolVar(&flagServiceStart, "start", false, "Start service")
 		flag.BoolVar(&flagServiceStop, "stop", false, "Stop service")
+		flag.StringVar(&flagProbe, "probe", "", "Probe domains, separated by commas, and write a profile")
+		flag.StringVar(&flagProbeWith, "probe-with", "", "Interfaces or hint sets to probe with, separated by semicolons")
+		flag.StringVar(&flagProbeOut, "probe-out", "", "Profile written by -probe, stdout by default")
+		flag.IntVar(&flagProbeTimeout, "probe-timeout", 5, "Seconds per probe")
+		flag.StringVar(&flagProbeHarness, "probe-harness", "", "Probe a local server behind a simulated middlebox: reset, drop, alert or none")
 		flag.Parse()
 
 		if flagServiceInstall {
@@ -342,6 +803,11 @@ func main() {
 			proxy.StopService()
 			return
 		}
+
+		if flagProbe != "" {
+			Probe(strings.Split(flagProbe, ","), flagProbeWith, flagProbeOut, flagProbeTimeout, flagProbeHarness)
+			return
+		}
 	} else {
 		if proxy.RunAsService(StartService) {
 			return
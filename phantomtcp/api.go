@@ -0,0 +1,422 @@
+package phantomtcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TrackedConn struct {
+	net.Conn
+	ID        uint64
+	Source    string
+	Target    string
+	Interface string
+	Start     time.Time
+
+	upload   int64
+	download int64
+
+	uploadBytes   *metricValue
+	downloadBytes *metricValue
+}
+
+var Connections sync.Map
+var connectionID uint64
+
+func TrackConn(conn net.Conn, source string, target string, pface *PhantomInterface) *TrackedConn {
+	tracked := &TrackedConn{
+		Conn:      conn,
+		ID:        atomic.AddUint64(&connectionID, 1),
+		Source:    source,
+		Target:    target,
+		Interface: interfaceName(pface),
+		Start:     time.Now(),
+	}
+	tracked.uploadBytes = relayBytes.get(tracked.Interface, "upload")
+	tracked.downloadBytes = relayBytes.get(tracked.Interface, "download")
+	Connections.Store(tracked.ID, tracked)
+	return tracked
+}
+
+func (conn *TrackedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.upload, int64(n))
+	atomic.AddInt64(&conn.uploadBytes.value, int64(n))
+	return n, err
+}
+
+func (conn *TrackedConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.download, int64(n))
+	atomic.AddInt64(&conn.downloadBytes.value, int64(n))
+	return n, err
+}
+
+func (conn *TrackedConn) Untrack() {
+	Connections.Delete(conn.ID)
+}
+
+type apiConnection struct {
+	ID        uint64 `json:"id"`
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Interface string `json:"interface"`
+	Start     int64  `json:"start"`
+	Upload    int64  `json:"upload"`
+	Download  int64  `json:"download"`
+}
+
+type apiInterface struct {
+	Name      string   `json:"name"`
+	Device    string   `json:"device,omitempty"`
+	DNS       string   `json:"dns,omitempty"`
+	DNSPolicy string   `json:"dnspolicy,omitempty"`
+	Hint      []string `json:"hint,omitempty"`
+	MTU       uint16   `json:"mtu,omitempty"`
+	TTL       byte     `json:"ttl,omitempty"`
+	MAXTTL    byte     `json:"maxttl,omitempty"`
+	AutoTTL   byte     `json:"autottl,omitempty"`
+	Timeout   uint16   `json:"timeout,omitempty"`
+	Protocol  byte     `json:"protocol,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	Fallback  []string `json:"fallback,omitempty"`
+}
+
+type apiRecords struct {
+	Name  string   `json:"name"`
+	Index uint32   `json:"index,omitempty"`
+	IPv4  []string `json:"ipv4,omitempty"`
+	IPv6  []string `json:"ipv6,omitempty"`
+}
+
+type apiNose struct {
+	NoseEntry
+	IPv4 string `json:"ipv4"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+type apiRule struct {
+	Domain    string   `json:"domain"`
+	Interface string   `json:"interface"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+func newAPIInterface(pface *PhantomInterface) *apiInterface {
+	if pface == nil {
+		return nil
+	}
+	var hints []string
+	for name, hint := range HintMap {
+		if hint != 0 && pface.Hint&hint == hint {
+			hints = append(hints, name)
+		}
+	}
+	sort.Strings(hints)
+	var fallback []string
+	for p := pface.Fallback; p != nil; p = p.Fallback {
+		fallback = append(fallback, p.Name)
+	}
+	return &apiInterface{
+		Name:      pface.Name,
+		Device:    pface.Device,
+		DNS:       pface.DNS,
+		DNSPolicy: dnsPolicyName(pface.DNSPolicy),
+		Hint:      hints,
+		MTU:       pface.MTU,
+		TTL:       pface.TTL,
+		MAXTTL:    pface.MAXTTL,
+		AutoTTL:   pface.AutoTTL,
+		Timeout:   pface.Timeout,
+		Protocol:  pface.Protocol,
+		Address:   pface.Address,
+		Fallback:  fallback,
+	}
+}
+
+func newAPIRecords(name string, records *DNSRecords) apiRecords {
+	records.lock.Lock()
+	defer records.lock.Unlock()
+	r := apiRecords{Name: name, Index: records.Index}
+	if records.IPv4Hint != nil {
+		for _, ip := range records.IPv4Hint.Addresses {
+			r.IPv4 = append(r.IPv4, ip.String())
+		}
+	}
+	if records.IPv6Hint != nil {
+		for _, ip := range records.IPv6Hint.Addresses {
+			r.IPv6 = append(r.IPv6, ip.String())
+		}
+	}
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// AddRule adds a profile line for domain under the interface iface,
+// addresses make it a static record.
+func AddRule(domain string, iface string, addresses []string) error {
+	if domain == "" || strings.ContainsAny(domain, "=#[]\r\n") {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	line := domain
+	if len(addresses) > 0 {
+		for _, addr := range addresses {
+			if net.ParseIP(addr) == nil {
+				return fmt.Errorf("invalid address %q", addr)
+			}
+		}
+		line += "=" + strings.Join(addresses, ",")
+	}
+
+	return UpdateProfile(func(profile *PhantomProfile) error {
+		if _, ok := profile.InterfaceMap[iface]; !ok {
+			return fmt.Errorf("unknown interface %q", iface)
+		}
+		return profile.Load(strings.NewReader("[" + iface + "]\n" + line + "\n"))
+	})
+}
+
+func RemoveRule(domain string) error {
+	return UpdateProfile(func(profile *PhantomProfile) error {
+		if _, ok := profile.DomainMap[domain]; !ok {
+			return fmt.Errorf("no rule for %q", domain)
+		}
+		delete(profile.DomainMap, domain)
+		delete(profile.records, domain)
+		return nil
+	})
+}
+
+// FlushDNSCache drops cached answers, for one name or for all of them.
+// Static records of the current profile are kept.
+func FlushDNSCache(name string) {
+	if name == "" {
+		DNSCache.Range(func(name string, records *DNSRecords, pinned bool) bool {
+			DNSCache.Delete(name)
+			return true
+		})
+	} else {
+		DNSCache.Delete(name)
+	}
+	profile := DefaultProfile()
+	if profile != nil {
+		profile.applyRecords(nil)
+	}
+}
+
+// apiGuard refuses the state changes a web page could make through the
+// browser of the operator: they need a JSON content type, which a page can
+// only send after a CORS preflight, and an Origin, if any, of the API itself.
+func apiGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediatype != "application/json" {
+				writeAPIError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+			if origin := r.Header.Get("Origin"); origin != "" {
+				u, err := url.Parse(origin)
+				if err != nil || u.Host != r.Host {
+					logCore.Notice("api: cross origin request", "origin", origin, "path", r.URL.Path)
+					writeAPIError(w, http.StatusForbidden, errors.New("cross origin request"))
+					return
+				}
+			}
+			if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+				writeAPIError(w, http.StatusForbidden, errors.New("cross site request"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func APIHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/interfaces", func(w http.ResponseWriter, r *http.Request) {
+		interfaces := []*apiInterface{}
+		for _, pface := range DefaultProfile().InterfaceMap {
+			pface := pface
+			interfaces = append(interfaces, newAPIInterface(&pface))
+		}
+		sort.Slice(interfaces, func(i, j int) bool { return interfaces[i].Name < interfaces[j].Name })
+		writeJSON(w, http.StatusOK, interfaces)
+	})
+
+	mux.HandleFunc("/route", func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("domain")
+		if domain == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("missing domain"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"domain":    domain,
+			"interface": newAPIInterface(DefaultProfile().GetInterface(domain)),
+		})
+	})
+
+	mux.HandleFunc("/dns", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			name := r.URL.Query().Get("name")
+			list := []apiRecords{}
+			DNSCache.Range(func(key string, records *DNSRecords, pinned bool) bool {
+				if name == "" || key == name {
+					list = append(list, newAPIRecords(key, records))
+				}
+				return true
+			})
+			sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodDelete:
+			FlushDNSCache(r.URL.Query().Get("name"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/nose", func(w http.ResponseWriter, r *http.Request) {
+		nose := []apiNose{}
+		for _, entry := range Nose.Entries() {
+			n := apiNose{NoseEntry: entry, IPv4: NoseIP(entry.Index, false).String()}
+			if ip := NoseIP(entry.Index, true); ip != nil {
+				n.IPv6 = ip.String()
+			}
+			nose = append(nose, n)
+		}
+		writeJSON(w, http.StatusOK, nose)
+	})
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		list := []apiConnection{}
+		Connections.Range(func(key, value interface{}) bool {
+			conn := value.(*TrackedConn)
+			list = append(list, apiConnection{
+				ID:        conn.ID,
+				Source:    conn.Source,
+				Target:    conn.Target,
+				Interface: conn.Interface,
+				Start:     conn.Start.Unix(),
+				Upload:    atomic.LoadInt64(&conn.upload),
+				Download:  atomic.LoadInt64(&conn.download),
+			})
+			return true
+		})
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		writeJSON(w, http.StatusOK, list)
+	})
+
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			profile := DefaultProfile()
+			rules := []apiRule{}
+			for domain, pface := range profile.DomainMap {
+				rule := apiRule{Domain: domain, Interface: "default"}
+				if pface != nil {
+					rule.Interface = pface.Name
+				}
+				if records, ok := profile.records[domain]; ok {
+					r := newAPIRecords(domain, records)
+					rule.Addresses = append(r.IPv4, r.IPv6...)
+				}
+				rules = append(rules, rule)
+			}
+			sort.Slice(rules, func(i, j int) bool { return rules[i].Domain < rules[j].Domain })
+			writeJSON(w, http.StatusOK, rules)
+		case http.MethodPost:
+			var rule apiRule
+			err := json.NewDecoder(r.Body).Decode(&rule)
+			if err == nil {
+				err = AddRule(rule.Domain, rule.Interface, rule.Addresses)
+			}
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			logCore.Info("api: add rule", "domain", rule.Domain, "interface", rule.Interface, "addresses", rule.Addresses)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			domain := r.URL.Query().Get("domain")
+			err := RemoveRule(domain)
+			if err != nil {
+				writeAPIError(w, http.StatusNotFound, err)
+				return
+			}
+			logCore.Info("api: remove rule", "domain", domain)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		domain := q.Get("domain")
+		if domain == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("missing domain"))
+			return
+		}
+		timeout := 5
+		if t := q.Get("timeout"); t != "" {
+			n, err := strconv.Atoi(t)
+			if err != nil || n <= 0 {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", t))
+				return
+			}
+			timeout = n
+		}
+		candidates, err := ProbeCandidates(q.Get("with"), DefaultProfile().InterfaceMap)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		results := ProbeDomain(domain, candidates, time.Duration(timeout)*time.Second)
+		response := map[string]interface{}{"results": results}
+		if winner, ok := ProbeWinner(results); ok {
+			response["winner"] = winner.Candidate
+			// only interfaces of the config can take a rule
+			if q.Get("apply") != "" {
+				if _, ok := DefaultProfile().InterfaceMap[winner.Candidate]; ok {
+					err = AddRule(winner.Domain, winner.Candidate, nil)
+					if err != nil {
+						writeAPIError(w, http.StatusInternalServerError, err)
+						return
+					}
+					logCore.Info("api: add rule", "domain", winner.Domain, "interface", winner.Candidate)
+					response["applied"] = true
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+
+	return apiGuard(mux)
+}
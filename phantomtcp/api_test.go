@@ -0,0 +1,52 @@
+package phantomtcp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIGuard(t *testing.T) {
+	SetProfile(NewProfile(map[string]PhantomInterface{"https": {Name: "https", DNS: "udp://127.0.0.1:53"}}))
+	handler := APIHandler()
+	rule := `{"domain": "api.example.com", "interface": "https"}`
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		ctype  string
+		header map[string]string
+		status int
+	}{
+		{"get", "GET", "/rules", "", nil, http.StatusOK},
+		{"cross origin get", "GET", "/rules", "", map[string]string{"Origin": "http://evil.example"}, http.StatusOK},
+		{"form post", "POST", "/rules", "application/x-www-form-urlencoded", nil, http.StatusUnsupportedMediaType},
+		{"text post", "POST", "/rules", "text/plain", nil, http.StatusUnsupportedMediaType},
+		{"no content type", "DELETE", "/dns", "", nil, http.StatusUnsupportedMediaType},
+		{"probe form", "POST", "/probe?domain=example.com", "multipart/form-data; boundary=x", nil, http.StatusUnsupportedMediaType},
+		{"cross origin", "POST", "/rules", "application/json", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"null origin", "POST", "/rules", "application/json", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"cross site", "POST", "/rules", "application/json", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same origin", "POST", "/rules", "application/json; charset=utf-8", map[string]string{"Origin": "http://127.0.0.1:9090"}, http.StatusNoContent},
+		{"json", "POST", "/rules", "application/json", nil, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://127.0.0.1:9090"+tt.path, strings.NewReader(rule))
+		if tt.ctype != "" {
+			r.Header.Set("Content-Type", tt.ctype)
+		}
+		for key, value := range tt.header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+	}
+	if DefaultProfile().GetInterface("api.example.com") == nil {
+		t.Error("rule not added")
+	}
+}
@@ -1,17 +1,11 @@
 package phantomtcp
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/binary"
 	"errors"
-	"fmt"
-	"log"
 	"math/rand"
 	"net"
-	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,44 +16,51 @@ type RecordAddresses struct {
 	Addresses []net.IP
 }
 
+// DNSRecords are shared through DNSCache, lock guards their fields once
+// they are stored there.
 type DNSRecords struct {
 	Index    uint32
 	ALPN     uint32
 	IPv4Hint *RecordAddresses
 	IPv6Hint *RecordAddresses
 	Ech      []byte
+
+	lock sync.Mutex
+}
+
+// copyFrom sets the fields of records to those of top.
+func (records *DNSRecords) copyFrom(top *DNSRecords) {
+	top.lock.Lock()
+	defer top.lock.Unlock()
+	records.Index = top.Index
+	records.ALPN = top.ALPN
+	records.IPv4Hint = top.IPv4Hint
+	records.IPv6Hint = top.IPv6Hint
+	records.Ech = top.Ech
 }
 
 var DNSMinTTL uint32 = 0
-var VirtualAddrPrefix byte = 255
-var DNSCache sync.Map
-var Nose []string = []string{"phantom.socks"}
-var NoseLock sync.Mutex
 
-func TCPlookup(request []byte, address string, server *PhantomInterface) ([]byte, error) {
-	data := make([]byte, 1024)
+// tcpMessage prefixes request with its length for DNS over TCP, in a buffer
+// that fits the usual responses as well.
+func tcpMessage(request []byte) []byte {
+	data := make([]byte, max(len(request)+2, 1024))
 	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
 	copy(data[2:], request)
+	return data
+}
 
-	var conn net.Conn
-	var err error = nil
-	if server != nil {
-		host, port := splitHostPort(address)
-		conn, _, err = server.Dial(host, port, data[:len(request)+2])
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		conn, err = net.DialTimeout("tcp", address, time.Second*5)
-		if err != nil {
-			return nil, err
-		}
+func TCPlookup(request []byte, address string, server *PhantomInterface) ([]byte, error) {
+	if server == nil {
+		return pipeLookup("tcp", request, address)
+	}
 
-		_, err = conn.Write(data[:len(request)+2])
-		if err != nil {
-			conn.Close()
-			return nil, err
-		}
+	data := tcpMessage(request)
+
+	host, port := splitHostPort(address)
+	conn, _, err := server.Dial(host, port, data[:len(request)+2])
+	if err != nil {
+		return nil, err
 	}
 	defer conn.Close()
 
@@ -67,7 +68,10 @@ func TCPlookup(request []byte, address string, server *PhantomInterface) ([]byte
 	if err != nil || n < 2 {
 		return nil, err
 	}
-	length := int(binary.BigEndian.Uint16(data[:2]) + 2)
+	length := int(binary.BigEndian.Uint16(data[:2])) + 2
+	if length > len(data) {
+		data = append(data, make([]byte, length-len(data))...)
+	}
 	recvlen := n
 	for recvlen < length && n > 0 {
 		n, err = conn.Read(data[recvlen:])
@@ -80,7 +84,6 @@ func TCPlookup(request []byte, address string, server *PhantomInterface) ([]byte
 }
 
 func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) ([]byte, error) {
-	response6 := make([]byte, 1024)
 	offset6 := offset
 	offset4 := offset
 
@@ -89,15 +92,21 @@ func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) (
 	if err != nil {
 		return nil, err
 	}
+	if len(response) < offset {
+		logDNS.Debug("truncated response", "server", address, "offset", offset)
+		return nil, nil
+	}
 
+	count := int(binary.BigEndian.Uint16(response[6:8]))
+	// each A record grows by 12 bytes
+	response6 := make([]byte, len(response)+count*12)
 	copy(response6, response[:offset])
 	binary.BigEndian.PutUint16(response6[offset-4:offset-2], 28)
 
-	count := int(binary.BigEndian.Uint16(response[6:8]))
 	for i := 0; i < count; i++ {
 		for {
 			if offset >= len(response) {
-				log.Println(offset)
+				logDNS.Debug("truncated response", "server", address, "offset", offset)
 				return nil, nil
 			}
 			length := response[offset]
@@ -105,19 +114,18 @@ func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) (
 			if length == 0 {
 				break
 			}
-			if length < 63 {
-				offset += int(length)
-				if offset+2 > len(response) {
-					log.Println(offset)
-					return nil, nil
-				}
-			} else {
+			if length&0xC0 == 0xC0 {
 				offset++
 				break
 			}
+			offset += int(length)
+			if length > 63 || offset+2 > len(response) {
+				logDNS.Debug("truncated response", "server", address, "offset", offset)
+				return nil, nil
+			}
 		}
 		if offset+2 > len(response) {
-			log.Println(offset)
+			logDNS.Debug("truncated response", "server", address, "offset", offset)
 			return nil, nil
 		}
 
@@ -128,18 +136,18 @@ func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) (
 		AType := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 8
 		if offset+2 > len(response) {
-			log.Println(offset)
+			logDNS.Debug("truncated response", "server", address, "offset", offset)
 			return nil, nil
 		}
 		DataLength := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 2
 
 		offset += int(DataLength)
+		if offset > len(response) {
+			logDNS.Debug("truncated response", "server", address, "offset", offset)
+			return nil, nil
+		}
 		if AType == 1 {
-			if offset > len(response) {
-				log.Println(offset)
-				return nil, nil
-			}
 			binary.BigEndian.PutUint16(response6[offset6:], 28)
 			offset6 += 2
 			offset4 += 2
@@ -176,7 +184,7 @@ func UDPlookup(request []byte, address string) ([]byte, error) {
 		return nil, err
 	}
 	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-	response := make([]byte, 1024)
+	response := make([]byte, EDNSSize)
 
 	if request[11] == 0 {
 		n, err := conn.Read(response[:])
@@ -198,37 +206,7 @@ func UDPlookup(request []byte, address string) ([]byte, error) {
 }
 
 func TLSlookup(request []byte, address string) ([]byte, error) {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	conn, err := tls.Dial("tcp", address, conf)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	data := make([]byte, 1024)
-	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
-	copy(data[2:], request)
-
-	_, err = conn.Write(data[:len(request)+2])
-	if err != nil {
-		return nil, err
-	}
-
-	n, err := conn.Read(data)
-	if err != nil || n < 2 {
-		return nil, err
-	}
-	length := int(binary.BigEndian.Uint16(data[:2]) + 2)
-	recvlen := n
-	for recvlen < length && n > 0 {
-		n, err = conn.Read(data[recvlen:])
-		if err != nil {
-			return nil, err
-		}
-		recvlen += n
-	}
-	return data[2:recvlen], nil
+	return pipeLookup("tls", request, address)
 }
 
 func HTTPSlookup(request []byte, u *url.URL, domain string) ([]byte, error) {
@@ -243,74 +221,15 @@ func HTTPSlookup(request []byte, u *url.URL, domain string) ([]byte, error) {
 	if domain == "" {
 		domain = host
 	}
-	path := u.Path
 	if port != "443" {
 		host = address
 	}
 
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         domain,
-	}
-	conn, err := tls.Dial("tcp", address, conf)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-
-	httpRequest := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nAccept: application/dns-message\r\nContent-Type: application/dns-message\r\nConnection: close\r\nContent-Length: %d\r\n\r\n", path, host, len(request))
-	logPrintln(5, httpRequest)
-	_, err = conn.Write([]byte(httpRequest))
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write(request)
-	if err != nil {
-		return nil, err
-	}
-
-	data := make([]byte, 2048)
-	recvlen := 0
-	headerLen := 0
-	contentLength := 0
-	for {
-		n, err := conn.Read(data[recvlen:])
-		recvlen += n
-
-		if recvlen > 0 {
-			if contentLength == 0 {
-				offset := bytes.Index(data[:recvlen], []byte("\r\n\r\n"))
-				if offset != -1 {
-					headerLen = offset + 4
-					header := string(data[:headerLen])
-					logPrintln(5, header)
-					for _, line := range strings.Split(header, "\r\n") {
-						field := strings.SplitN(line, ": ", 2)
-						if len(field) > 1 {
-							if field[0] == "Content-Length" {
-								contentLength, err = strconv.Atoi(field[1])
-								continue
-							}
-						}
-					}
-				}
-			}
-
-			if (recvlen - headerLen) >= contentLength {
-				return data[headerLen : headerLen+contentLength], nil
-			}
-		}
-
-		if err != nil || n == 0 {
-			return nil, err
-		}
-	}
+	return dohLookup(request, address, host, u.Path, domain)
 }
 
 func TFOlookup(request []byte, address string) ([]byte, error) {
-	data := make([]byte, 1024)
-	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
-	copy(data[2:], request)
+	data := tcpMessage(request)
 
 	var conn net.Conn
 	var err error = nil
@@ -335,7 +254,10 @@ func TFOlookup(request []byte, address string) ([]byte, error) {
 	if err != nil || n < 2 {
 		return nil, err
 	}
-	length := int(binary.BigEndian.Uint16(data[:2]) + 2)
+	length := int(binary.BigEndian.Uint16(data[:2])) + 2
+	if length > len(data) {
+		data = append(data, make([]byte, length-len(data))...)
+	}
 	recvlen := n
 	for recvlen < length && n > 0 {
 		n, err = conn.Read(data[recvlen:])
@@ -349,32 +271,29 @@ func TFOlookup(request []byte, address string) ([]byte, error) {
 
 func GetQName(buf []byte) (string, int, int) {
 	bufflen := len(buf)
-	if bufflen < 13 {
-		return "", 0, 0
-	}
-	length := buf[12]
-	off := 13
-	end := off + int(length)
-	qname := string(buf[off:end])
-	off = end
-
+	qname := ""
+	off := 12
 	for {
 		if off >= bufflen {
 			return "", 0, 0
 		}
-		length := buf[off]
+		length := int(buf[off])
 		off++
 		if length == 0x00 {
 			break
 		}
-		end := off + int(length)
-		if end > bufflen {
+		end := off + length
+		// 253 characters are 255 bytes on the wire
+		if length > 63 || end > bufflen || len(qname)+1+length > 253 {
 			return "", 0, 0
 		}
-		qname += "." + string(buf[off:end])
+		if qname != "" {
+			qname += "."
+		}
+		qname += string(buf[off:end])
 		off = end
 	}
-	end = off + 4
+	end := off + 4
 	if end > bufflen {
 		return "", 0, 0
 	}
@@ -384,31 +303,50 @@ func GetQName(buf []byte) (string, int, int) {
 	return qname, qtype, end
 }
 
+// GetName reads the possibly compressed name at offset, it returns the
+// offset after the name or 0 if the name is malformed. Each pointer has to
+// go before everything read so far, so they cannot loop.
 func GetName(buf []byte, offset int) (string, int) {
 	name := ""
+	end := 0
+	start := offset
 	for {
+		if offset >= len(buf) {
+			return "", 0
+		}
 		length := int(buf[offset])
 		offset++
 		if length == 0 {
 			break
 		}
+		if length&0xC0 == 0xC0 {
+			if offset >= len(buf) {
+				return "", 0
+			}
+			pointer := (length&0x3F)<<8 | int(buf[offset])
+			if end == 0 {
+				end = offset + 1
+			}
+			if pointer >= start {
+				return "", 0
+			}
+			start = pointer
+			offset = pointer
+			continue
+		}
+		if length > 63 || offset+length > len(buf) || len(name)+1+length > 253 {
+			return "", 0
+		}
 		if name != "" {
 			name += "."
 		}
-		if length < 63 {
-			name += string(buf[offset : offset+length])
-			offset += int(length)
-			if offset+2 > len(buf) {
-				return "", offset
-			}
-		} else {
-			_offset := int(buf[offset])
-			_name, _ := GetName(buf, _offset)
-			name += _name
-			return name, offset + 1
-		}
+		name += string(buf[offset : offset+length])
+		offset += length
+	}
+	if end == 0 {
+		end = offset
 	}
-	return name, offset
+	return name, end
 }
 
 func GetNameOffset(response []byte, offset int) int {
@@ -423,15 +361,17 @@ func GetNameOffset(response []byte, offset int) int {
 		if length == 0 {
 			break
 		}
-		if length < 63 {
-			offset += int(length)
-			if offset+2 > responseLen {
+		if length&0xC0 == 0xC0 {
+			offset++
+			if offset > responseLen {
 				return 0
 			}
-		} else {
-			offset++
 			break
 		}
+		if length > 63 {
+			return 0
+		}
+		offset += int(length)
 	}
 
 	return offset
@@ -441,7 +381,7 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 	nsfilter := func(address net.IP) net.IP {
 		if options.BadSubnet != nil {
 			if options.BadSubnet.Contains(address) {
-				logPrintln(4, address, "bad address")
+				logDNS.Verbose("bad address", "addr", address)
 				return nil
 			}
 		}
@@ -499,15 +439,20 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 		if offset+2 > responseLen {
 			return
 		}
-		DataLength := binary.BigEndian.Uint16(response[offset : offset+2])
+		DataLength := int(binary.BigEndian.Uint16(response[offset : offset+2]))
 		offset += 2
+		if offset+DataLength > responseLen {
+			return
+		}
+		dataOffset := offset
+		data := response[offset : offset+DataLength]
+		offset += DataLength
 
 		switch AType {
 		case 1:
-			if offset+4 > responseLen {
-				return
+			if len(data) != 4 {
+				continue
 			}
-			data := response[offset : offset+4]
 			ip := net.IPv4(data[0], data[1], data[2], data[3])
 			ip = nsfilter(ip).To4()
 			if ip == nil {
@@ -519,12 +464,11 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 				records.IPv4Hint.Addresses = append(records.IPv4Hint.Addresses, ip)
 			}
 		case 28:
-			var data [16]byte
-			if offset+16 > responseLen {
-				return
+			if len(data) != 16 {
+				continue
 			}
-			copy(data[:], response[offset:offset+16])
-			ip := net.IP(response[offset : offset+16])
+			ip := make(net.IP, 16)
+			copy(ip, data)
 			ip = nsfilter(ip)
 			if ip == nil {
 				continue
@@ -535,27 +479,33 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 				records.IPv6Hint.Addresses = append(records.IPv6Hint.Addresses, ip)
 			}
 		case 65:
-			offset += 3
-			for offset+4 < responseLen {
-				SvcParamKey := binary.BigEndian.Uint16(response[offset : offset+2])
-				offset += 2
-				SvcParamLen := int(binary.BigEndian.Uint16(response[offset : offset+2]))
-				offset += 2
-				SvcParamEnd := offset + SvcParamLen
-				if SvcParamEnd > responseLen {
+			// SvcPriority, then the TargetName, which is never compressed
+			if len(data) < 3 {
+				continue
+			}
+			off := GetNameOffset(data, 2)
+			if off == 0 {
+				continue
+			}
+			for off+4 <= len(data) {
+				SvcParamKey := binary.BigEndian.Uint16(data[off : off+2])
+				SvcParamLen := int(binary.BigEndian.Uint16(data[off+2 : off+4]))
+				off += 4
+				SvcParamEnd := off + SvcParamLen
+				if SvcParamEnd > len(data) {
 					break
 				}
 				records.ALPN |= HINT_ALPN
 				switch SvcParamKey {
 				case 1:
-					for offset+1 < SvcParamEnd {
-						ALPNLen := int(response[offset])
-						offset++
-						if offset+ALPNLen > SvcParamEnd {
+					for off < SvcParamEnd {
+						ALPNLen := int(data[off])
+						off++
+						if off+ALPNLen > SvcParamEnd {
 							break
 						}
-						ALPN := string(response[offset : offset+ALPNLen])
-						offset += ALPNLen
+						ALPN := string(data[off : off+ALPNLen])
+						off += ALPNLen
 						switch ALPN {
 						case "http/1.1":
 							records.ALPN |= HINT_HTTP
@@ -567,40 +517,103 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 					}
 				case 4:
 					var IPv4Hint []net.IP
-					for offset < SvcParamEnd {
-						data := response[offset : offset+4]
-						IPv4Hint = append(IPv4Hint, net.IPv4(data[0], data[1], data[2], data[3]))
-						offset += 4
+					for ; off+4 <= SvcParamEnd; off += 4 {
+						IPv4Hint = append(IPv4Hint, net.IPv4(data[off], data[off+1], data[off+2], data[off+3]))
+					}
+					if IPv4Hint != nil {
+						records.IPv4Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), IPv4Hint}
 					}
-					records.IPv4Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), IPv4Hint}
 				case 5:
 					records.Ech = make([]byte, SvcParamLen)
-					copy(records.Ech, response[offset:SvcParamEnd])
+					copy(records.Ech, data[off:SvcParamEnd])
 				case 6:
 					var IPv6Hint []net.IP
-					for offset < SvcParamEnd {
-						ip := net.IP(response[offset : offset+16])
+					for ; off+16 <= SvcParamEnd; off += 16 {
+						ip := make(net.IP, 16)
+						copy(ip, data[off:off+16])
 						IPv6Hint = append(IPv6Hint, ip)
-						offset += 16
 					}
-					records.IPv6Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), IPv6Hint}
+					if IPv6Hint != nil {
+						records.IPv6Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), IPv6Hint}
+					}
 				}
-				offset = SvcParamEnd
+				off = SvcParamEnd
 			}
 		case 5:
-			cname, _ = GetName(response, offset)
-			logPrintln(4, "CNAME:", cname)
+			cname, _ = GetName(response, dataOffset)
+			logDNS.Verbose("cname", "cname", cname)
 		}
+	}
+}
 
-		offset += int(DataLength)
+// DNSNegativeTTL is how long, in seconds, a name without addresses is
+// cached when the response carries no SOA record.
+var DNSNegativeTTL uint32 = 30
+
+// NegativeTTL is the TTL of a response without answers, the lesser of the
+// TTL and the MINIMUM field of its SOA record (RFC 2308).
+func NegativeTTL(response []byte) uint32 {
+	if len(response) < 12 {
+		return DNSNegativeTTL
+	}
+	QDCount := int(binary.BigEndian.Uint16(response[4:6]))
+	RRCount := int(binary.BigEndian.Uint16(response[6:8])) + int(binary.BigEndian.Uint16(response[8:10]))
+
+	offset := 12
+	for i := 0; i < QDCount; i++ {
+		offset = GetNameOffset(response, offset)
+		if offset == 0 {
+			return DNSNegativeTTL
+		}
+		offset += 4
+	}
+
+	for i := 0; i < RRCount; i++ {
+		offset = GetNameOffset(response, offset)
+		if offset == 0 || offset+10 > len(response) {
+			return DNSNegativeTTL
+		}
+		AType := binary.BigEndian.Uint16(response[offset : offset+2])
+		TTL := binary.BigEndian.Uint32(response[offset+4 : offset+8])
+		DataLength := int(binary.BigEndian.Uint16(response[offset+8 : offset+10]))
+		offset += 10
+		end := offset + DataLength
+		if end > len(response) {
+			return DNSNegativeTTL
+		}
+		if AType == 6 {
+			// MNAME, RNAME, then SERIAL, REFRESH, RETRY, EXPIRE and MINIMUM
+			off := GetNameOffset(response[:end], offset)
+			if off != 0 {
+				off = GetNameOffset(response[:end], off)
+			}
+			if off == 0 || off+20 != end {
+				return DNSNegativeTTL
+			}
+			if minimum := binary.BigEndian.Uint32(response[off+16 : end]); minimum < TTL {
+				TTL = minimum
+			}
+			if TTL < DNSMinTTL {
+				TTL = DNSMinTTL
+			}
+			return TTL
+		}
+		offset = end
 	}
+
+	return DNSNegativeTTL
+}
+
+// negativeAnswer caches the absence of addresses for the TTL of response.
+func negativeAnswer(response []byte) *RecordAddresses {
+	return &RecordAddresses{int64(NegativeTTL(response)) + time.Now().Unix(), []net.IP{}}
 }
 
 func (records *DNSRecords) PackAnswers(qtype int, minttl uint32) (int, []byte) {
 	packA := func(rec *RecordAddresses) (int, []byte) {
 		var ttl uint32 = 0
-		if rec.TTL > 0 {
-			ttl = uint32(rec.TTL - time.Now().Unix())
+		if now := time.Now().Unix(); rec.TTL > now {
+			ttl = uint32(rec.TTL - now)
 		}
 		if ttl < minttl {
 			ttl = minttl
@@ -729,7 +742,7 @@ func (records *DNSRecords) PackAnswers(qtype int, minttl uint32) (int, []byte) {
 			for _, ip := range records.IPv4Hint.Addresses {
 				ip4 := ip.To4()
 				if ip4 == nil {
-					logPrintln(1, ip, "not IPv4")
+					logDNS.Error("not IPv4", "addr", ip)
 					return 0, nil
 				}
 				copy(answers[length:], ip4)
@@ -763,11 +776,16 @@ func (records *DNSRecords) PackAnswers(qtype int, minttl uint32) (int, []byte) {
 	return 0, nil
 }
 
-func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32) []byte {
+// BuildResponse answers request from records, nil if request has no
+// header.
+func (records *DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32) []byte {
 	length := len(request)
+	if length < 12 {
+		return nil
+	}
 
 	if records.Index > 0 {
-		response := make([]byte, 512)
+		response := make([]byte, length+64)
 		copy(response, request)
 		response[2] = 0x81
 		response[3] = 0x80
@@ -775,26 +793,24 @@ func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32
 		switch qtype {
 		case 1:
 			answer := []byte{0xC0, 0x0C, 0x00, 1,
-				0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x04,
-				VirtualAddrPrefix, 0}
+				0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x04}
 			copy(response[length:], answer)
-			length += 14
-			binary.BigEndian.PutUint16(response[length:], uint16(records.Index))
-			length += 2
+			length += 12
+			copy(response[length:], NoseIP(records.Index, false))
+			length += 4
 			binary.BigEndian.PutUint16(response[6:], 1)
 		case 28:
-			return response[:length]
-			/*
-				answer := []byte{0xC0, 0x0C, 0x00, 28,
-					0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x10,
-					0x00, 0x64, 0xff, VirtualAddrPrefix, 0x00, 0x00, 0x00, 0x00,
-					0x00, 0x00, 0x00, 0x00}
-				copy(response[length:], answer)
-				length += 24
-				binary.BigEndian.PutUint32(response[length:], uint32(records.Index))
-				length += 4
-				binary.BigEndian.PutUint16(response[6:], 1)
-			*/
+			ip := NoseIP(records.Index, true)
+			if ip == nil {
+				return response[:length]
+			}
+			answer := []byte{0xC0, 0x0C, 0x00, 28,
+				0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x10}
+			copy(response[length:], answer)
+			length += 12
+			copy(response[length:], ip)
+			length += 16
+			binary.BigEndian.PutUint16(response[6:], 1)
 		case 65:
 			copy(response[length:], []byte{0xC0, 0x0C, 0x00, 65, 0, 1, 0, 0, 0, 16, 0, 0, 0, 1, 0})
 			dataLenOffset := length + 10
@@ -815,10 +831,16 @@ func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32
 				}
 				binary.BigEndian.PutUint16(response[svcLenOffset:], uint16(length-svcLenOffset-2))
 			}
-			copy(response[length:], []byte{0, 4, 0, 4, VirtualAddrPrefix, 0})
-			length += 6
-			binary.BigEndian.PutUint16(response[length:], uint16(records.Index))
-			length += 2
+			copy(response[length:], []byte{0, 4, 0, 4})
+			length += 4
+			copy(response[length:], NoseIP(records.Index, false))
+			length += 4
+			if ip := NoseIP(records.Index, true); ip != nil {
+				copy(response[length:], []byte{0, 6, 0, 16})
+				length += 4
+				copy(response[length:], ip)
+				length += 16
+			}
 			binary.BigEndian.PutUint16(response[6:], 1)
 			binary.BigEndian.PutUint16(response[dataLenOffset:], uint16(length-dataLenOffset-2))
 		}
@@ -842,7 +864,7 @@ func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32
 }
 
 func PackQName(name string) []byte {
-	length := strings.Count(name, "")
+	length := len(name) + 1
 	QName := make([]byte, length+1)
 	copy(QName[1:], []byte(name))
 	o, l := 0, 0
@@ -896,20 +918,16 @@ func ParseOptions(options string) ServerOptions {
 }
 
 func PackRequest(name string, qtype uint16, id uint16, ecs string) []byte {
-	Request := make([]byte, 512)
+	qname := PackQName(name)
+	Request := make([]byte, 12+len(qname)+4)
 
 	binary.BigEndian.PutUint16(Request[:], id)      //ID
 	binary.BigEndian.PutUint16(Request[2:], 0x0100) //Flag
 	binary.BigEndian.PutUint16(Request[4:], 1)      //QDCount
 	binary.BigEndian.PutUint16(Request[6:], 0)      //ANCount
 	binary.BigEndian.PutUint16(Request[8:], 0)      //NSCount
-	if ecs != "" {
-		binary.BigEndian.PutUint16(Request[10:], 1) //ARCount
-	} else {
-		binary.BigEndian.PutUint16(Request[10:], 0) //ARCount
-	}
+	binary.BigEndian.PutUint16(Request[10:], 0)     //ARCount
 
-	qname := PackQName(name)
 	length := len(qname)
 	copy(Request[12:], qname)
 	length += 12
@@ -918,74 +936,23 @@ func PackRequest(name string, qtype uint16, id uint16, ecs string) []byte {
 	binary.BigEndian.PutUint16(Request[length:], 0x01) //QClass
 	length += 2
 
-	if ecs != "" {
-		Request[length] = 0 //Name
-		length++
-		binary.BigEndian.PutUint16(Request[length:], 41) // Type
-		length += 2
-		binary.BigEndian.PutUint16(Request[length:], 4096) // UDP Payload
-		length += 2
-		Request[length] = 0 // Highter bits in extended RCCODE
-		length++
-		Request[length] = 0 // EDNS0 Version
-		length++
-		binary.BigEndian.PutUint16(Request[length:], 0x800) // Z
-		length += 2
-
-		ecsip := net.ParseIP(ecs)
-		ecsip4 := ecsip.To4()
-		if ecsip4 != nil {
-			binary.BigEndian.PutUint16(Request[length:], 11) // Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 8) // Option Code
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 7) // Option Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 1) // Family
-			length += 2
-			Request[length] = 24 // Source Netmask
-			length++
-			Request[length] = 0 // Scope Netmask
-			length++
-			copy(Request[length:], ecsip4[:3])
-			length += 3
-		} else {
-			binary.BigEndian.PutUint16(Request[length:], 15) // Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 8) // Option Code
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 11) // Option Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 2) // Family
-			length += 2
-			Request[length] = 56 // Source Netmask
-			length++
-			Request[length] = 0 // Scope Netmask
-			length++
-			copy(Request[length:], ecsip[:7])
-			length += 7
-		}
+	if edns := upstreamEDNS(nil, ecs); edns != nil {
+		return edns.AppendTo(Request[:length])
 	}
 
 	return Request[:length]
 }
 
 func LoadDNSCache(qname string) *DNSRecords {
-	var ok bool
-	var result interface{}
-	result, ok = DNSCache.Load(qname)
-	if ok {
-		return result.(*DNSRecords)
-	}
-
-	return nil
+	records, _ := DNSCache.Load(qname)
+	return records
 }
 
 func StoreDNSCache(qname string, record *DNSRecords) {
 	DNSCache.Store(qname, record)
 }
 
-func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
+func NSLookup(name string, hint uint32, server string, policy byte) (uint32, []net.IP) {
 	var qtype uint16 = 1
 	if hint&HINT_IPV6 != 0 {
 		qtype = 28
@@ -994,7 +961,6 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 	records := LoadDNSCache(name)
 	if records == nil {
 		records = new(DNSRecords)
-		StoreDNSCache(name, records)
 
 		offset := 0
 		for i := 0; i < SubdomainDepth; i++ {
@@ -1005,95 +971,109 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 			offset += off
 			top := LoadDNSCache(name[offset:])
 			if top != nil {
-				*records = *top
+				records.copyFrom(top)
 				break
 			}
 
 			offset++
 		}
+		records = DNSCache.LoadOrStore(name, records)
 	}
+	now := time.Now().Unix()
+	var stale *RecordAddresses
+	records.lock.Lock()
 	switch qtype {
 	case 1:
 		if records.IPv4Hint != nil {
-			logPrintln(3, "cached:", name, qtype, records.IPv4Hint.Addresses)
-			return records.Index, records.IPv4Hint.Addresses
+			if records.IPv4Hint.fresh(now) {
+				logDNS.Trace("cached", "domain", name, "qtype", qtype, "ips", records.IPv4Hint.Addresses)
+				dnsCacheTotal.Add(1, "hit")
+				defer records.lock.Unlock()
+				return records.Index, records.IPv4Hint.Addresses
+			}
+			stale = records.IPv4Hint
 		}
 	case 28:
 		if records.IPv6Hint != nil {
-			logPrintln(3, "cached:", name, qtype, records.IPv6Hint.Addresses)
-			return records.Index, records.IPv6Hint.Addresses
+			if records.IPv6Hint.fresh(now) {
+				logDNS.Trace("cached", "domain", name, "qtype", qtype, "ips", records.IPv6Hint.Addresses)
+				dnsCacheTotal.Add(1, "hit")
+				defer records.lock.Unlock()
+				return records.Index, records.IPv6Hint.Addresses
+			}
+			stale = records.IPv6Hint
 		}
 	default:
+		records.lock.Unlock()
 		return 0, nil
 	}
+	// the lock is not held across the lookup, the A and AAAA lookups of
+	// ResolveTCPAddrs share records
+	records.lock.Unlock()
+	dnsCacheTotal.Add(1, "miss")
 
-	var request []byte
 	var response []byte
-	var err error
 
-	var options ServerOptions
-	u, err := url.Parse(server)
+	list, err := Upstreams(server)
 	if err != nil {
-		logPrintln(1, err)
+		logDNS.Error("bad server", "server", server, "error", err)
 		return 0, nil
 	}
-	if u.RawQuery != "" {
-		options = ParseOptions(u.RawQuery)
-	}
-
-	if u.Host != "" {
-		switch u.Scheme {
-		case "udp":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = UDPlookup(request, u.Host)
-		case "tcp":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = TCPlookup(request, u.Host, nil)
-		case "tls":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = TLSlookup(request, u.Host)
-		case "https":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = HTTPSlookup(request, u, options.Domain)
-		case "tfo":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = TFOlookup(request, u.Host)
-		default:
-			NoseLock.Lock()
-			records.Index = uint32(len(Nose))
+	options := list[0].Options
+
+	if list[0].URL.Host != "" {
+		var upstream *Upstream
+		response, upstream, err = exchange(server, policy, func(upstream *Upstream) []byte {
+			return PackRequest(name, qtype, uint16(0), upstream.Options.ECS)
+		})
+		if err == errUnknownScheme {
+			records.lock.Lock()
+			defer records.lock.Unlock()
+			records.Index = Nose.Alloc(name, false)
 			records.ALPN = hint
-			Nose = append(Nose, name)
-			NoseLock.Unlock()
 			return records.Index, nil
 		}
+		if upstream != nil {
+			options = upstream.Options
+		}
 	}
+
+	records.lock.Lock()
+	defer records.lock.Unlock()
 	if err != nil {
-		logPrintln(1, err)
+		logDNS.Error("lookup", "domain", name, "server", server, "error", err)
+		if stale.stale(now) {
+			logDNS.Debug("serve stale", "domain", name, "qtype", qtype, "ips", stale.Addresses)
+			dnsCacheTotal.Add(1, "stale")
+			return records.Index, stale.Addresses
+		}
 		return 0, nil
 	}
 
 	if records.Index == 0 && hint != 0 {
-		NoseLock.Lock()
-		records.Index = uint32(len(Nose))
+		records.Index = Nose.Alloc(name, false)
 		records.ALPN = hint & HINT_DNS
-		Nose = append(Nose, name)
-		NoseLock.Unlock()
 	}
 
+	if qtype == 1 {
+		records.IPv4Hint = nil
+	} else {
+		records.IPv6Hint = nil
+	}
 	records.GetAnswers(response, options)
 
 	switch qtype {
 	case 1:
 		if records.IPv4Hint == nil && options.Fallback != nil {
 			if options.Fallback.To4() != nil {
-				logPrintln(4, "request:", name, "fallback", options.Fallback)
+				logDNS.Verbose("fallback", "domain", name, "addr", options.Fallback)
 				records.IPv4Hint = &RecordAddresses{0, []net.IP{options.Fallback}}
 			}
 		}
 		if records.IPv4Hint == nil {
-			records.IPv4Hint = &RecordAddresses{0, []net.IP{}}
+			records.IPv4Hint = negativeAnswer(response)
 		}
-		logPrintln(3, "nslookup", name, qtype, records.IPv4Hint.Addresses)
+		logDNS.Trace("nslookup", "domain", name, "qtype", qtype, "ips", records.IPv4Hint.Addresses)
 		return records.Index, records.IPv4Hint.Addresses
 	case 28:
 		if records.IPv6Hint == nil && options.Fallback != nil {
@@ -1102,30 +1082,39 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 			}
 		}
 		if records.IPv6Hint == nil {
-			records.IPv6Hint = &RecordAddresses{0, []net.IP{}}
+			records.IPv6Hint = negativeAnswer(response)
 		}
-		logPrintln(3, "nslookup", name, qtype, records.IPv6Hint.Addresses)
+		logDNS.Trace("nslookup", "domain", name, "qtype", qtype, "ips", records.IPv6Hint.Addresses)
 		return records.Index, records.IPv6Hint.Addresses
 	}
 
 	return records.Index, nil
 }
 
+// NSRequest answers a DNS request. The OPT record of the client is
+// forwarded upstream, and the response gets one of its own.
 func NSRequest(request []byte, cache bool) (uint32, []byte) {
 	name, qtype, end := GetQName(request)
-	binary.BigEndian.PutUint16(request[10:12], 0)
-	request = request[:end]
 	if name == "" {
-		logPrintln(2, "DNS Segmentation fault")
+		logDNS.Debug("bad request")
 		return 0, nil
 	}
+	edns := GetEDNS(request, end)
+	binary.BigEndian.PutUint16(request[10:12], 0)
+
+	index, response := nsRequest(request[:end], name, qtype, cache, edns)
+	if edns != nil && response != nil {
+		response = replyEDNS(edns, len(response)).AppendTo(response)
+	}
+	return index, response
+}
 
+func nsRequest(request []byte, name string, qtype int, cache bool, edns *EDNS) (uint32, []byte) {
 	var records *DNSRecords
 	if cache {
 		records = LoadDNSCache(name)
 		if records == nil {
 			records = new(DNSRecords)
-			StoreDNSCache(name, records)
 
 			offset := 0
 			for i := 0; i < SubdomainDepth; i++ {
@@ -1136,33 +1125,46 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 				offset += off
 				top := LoadDNSCache(name[offset:])
 				if top != nil {
-					*records = *top
+					records.copyFrom(top)
 					break
 				}
 				offset++
 			}
+			records = DNSCache.LoadOrStore(name, records)
 		}
 	} else {
 		records = new(DNSRecords)
 	}
 
+	// the lock is dropped for the upstream exchange only
+	records.lock.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			records.lock.Unlock()
+		}
+	}()
+
 	CurrentTime := time.Now().Unix()
 	IsUnknownType := false
+	var stale *RecordAddresses
 
 	switch qtype {
 	case 1:
 		if records.IPv4Hint != nil {
-			if records.IPv4Hint.TTL == 0 || records.IPv4Hint.TTL > CurrentTime {
+			if records.IPv4Hint.fresh(CurrentTime) {
+				dnsCacheTotal.Add(1, "hit")
 				return records.Index, records.BuildResponse(request, qtype, 60)
 			}
-			records.IPv4Hint = nil
+			stale = records.IPv4Hint
 		}
 	case 28:
 		if records.IPv6Hint != nil {
-			if records.IPv6Hint.TTL == 0 || records.IPv6Hint.TTL > CurrentTime {
+			if records.IPv6Hint.fresh(CurrentTime) {
+				dnsCacheTotal.Add(1, "hit")
 				return records.Index, records.BuildResponse(request, qtype, 60)
 			}
-			records.IPv6Hint = nil
+			stale = records.IPv6Hint
 		}
 	case 65:
 		if records.ALPN&(HINT_ALPN|HINT_HTTP|HINT_HTTPS|HINT_HTTP3) != 0 {
@@ -1175,15 +1177,15 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 	var response []byte
 	var err error
 
-	pface := DefaultProfile.GetInterface(name)
+	pface := DefaultProfile().GetInterface(name)
 	var options ServerOptions
 	DNS := ""
 	if pface != nil {
 		records.ALPN = pface.Hint & HINT_DNS
-		logPrintln(2, "request:", name, pface.DNS, pface.Protocol)
+		logDNS.Debug("request", "domain", name, "qtype", qtype, "server", pface.DNS, "interface", pface)
 		DNS = pface.DNS
 	} else {
-		logPrintln(4, "request:", name, "no answer")
+		logDNS.Verbose("no interface", "domain", name, "qtype", qtype)
 		return 0, records.BuildResponse(request, qtype, 3600)
 	}
 
@@ -1191,10 +1193,7 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 	if UseVaddr {
 		if DNS == "" {
 			if records.Index == 0 {
-				NoseLock.Lock()
-				records.Index = uint32(len(Nose))
-				Nose = append(Nose, name)
-				NoseLock.Unlock()
+				records.Index = Nose.Alloc(name, false)
 			}
 			return records.Index, records.BuildResponse(request, qtype, 3600)
 		} else if IsUnknownType {
@@ -1202,104 +1201,148 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 		}
 	}
 
-	u, err := url.Parse(DNS)
+	list, err := Upstreams(DNS)
 	if err != nil {
-		logPrintln(1, err)
+		logDNS.Error("bad server", "server", DNS, "interface", pface, "error", err)
 		return 0, nil
 	}
 
-	_request := request
 	_qtype := uint16(qtype)
-	if u.RawQuery != "" {
+	if list[0].URL.RawQuery != "" {
 		if records.ALPN&HINT_IPV6 != 0 {
 			_qtype = 28
 		}
 
-		options = ParseOptions(u.RawQuery)
+		options = list[0].Options
 
 		if options.Type == "A" && qtype == 28 {
 			return records.Index, records.BuildResponse(request, qtype, 0)
 		} else if options.Type == "AAAA" && qtype == 1 {
 			return records.Index, records.BuildResponse(request, qtype, 0)
 		}
+	}
 
-		if options.ECS != "" || _qtype != uint16(qtype) {
+	locked = false
+	records.lock.Unlock()
+	if qtype == 1 || qtype == 28 {
+		dnsCacheTotal.Add(1, "miss")
+	}
+	response, upstream, err := exchange(DNS, pface.DNSPolicy, func(upstream *Upstream) []byte {
+		_request := request
+		if _qtype != uint16(qtype) {
 			id := binary.BigEndian.Uint16(request[:2])
-			_request = PackRequest(name, _qtype, id, options.ECS)
+			_request = PackRequest(name, _qtype, id, "")
 		}
-	}
-
-	switch u.Scheme {
-	case "udp":
-		response, err = UDPlookup(_request, u.Host)
-	case "tcp":
-		response, err = TCPlookup(_request, u.Host, nil)
-	case "tls":
-		response, err = TLSlookup(_request, u.Host)
-	case "https":
-		response, err = HTTPSlookup(_request, u, options.Domain)
-	case "tfo":
-		response, err = TFOlookup(_request, u.Host)
-	default:
-		logPrintln(1, "unknown protocol", u.Scheme)
+		if opt := upstreamEDNS(edns, upstream.Options.ECS); opt != nil {
+			_request = opt.AppendTo(_request)
+		}
+		return _request
+	})
+	records.lock.Lock()
+	locked = true
+	if err == errUnknownScheme {
+		logDNS.Error("unknown protocol", "server", DNS, "interface", pface)
 		return 0, nil
 	}
+	if upstream != nil {
+		options = upstream.Options
+	}
 
 	if err != nil {
-		logPrintln(1, err)
+		logDNS.Error("request", "domain", name, "server", DNS, "interface", pface, "error", err)
+		if stale.stale(CurrentTime) {
+			// RFC 8767 suggests 30 seconds for stale answers
+			logDNS.Debug("serve stale", "domain", name, "qtype", qtype, "ips", stale.Addresses)
+			dnsCacheTotal.Add(1, "stale")
+			answer := &DNSRecords{Index: records.Index, ALPN: records.ALPN, IPv4Hint: records.IPv4Hint, IPv6Hint: records.IPv6Hint, Ech: records.Ech}
+			if qtype == 1 {
+				answer.IPv4Hint = stale
+			} else {
+				answer.IPv6Hint = stale
+			}
+			return records.Index, answer.BuildResponse(request, qtype, 30)
+		}
 		return 0, nil
 	}
 
 	switch _qtype {
 	case 1:
+		records.IPv4Hint = nil
 		records.GetAnswers(response, options)
 		if records.IPv4Hint == nil && options.Fallback != nil {
 			if options.Fallback.To4() != nil {
-				logPrintln(4, "request:", name, "fallback", options.Fallback)
+				logDNS.Verbose("fallback", "domain", name, "addr", options.Fallback)
 				records.IPv4Hint = &RecordAddresses{0, []net.IP{options.Fallback}}
 			}
 		}
 		if records.IPv4Hint == nil {
-			logPrintln(4, "request:", name, qtype, "no answer")
-			records.IPv4Hint = &RecordAddresses{0, []net.IP{}}
+			logDNS.Verbose("no answer", "domain", name, "qtype", qtype)
+			records.IPv4Hint = negativeAnswer(response)
 			return 0, records.BuildResponse(request, qtype, 0)
 		}
-		logPrintln(3, "response:", name, qtype, records.IPv4Hint.Addresses)
+		logDNS.Trace("response", "domain", name, "qtype", qtype, "ips", records.IPv4Hint.Addresses)
 	case 28:
+		records.IPv6Hint = nil
 		records.GetAnswers(response, options)
 		if records.IPv6Hint == nil && options.Fallback != nil {
 			if options.Fallback.To4() == nil {
-				logPrintln(4, "request:", name, "fallback", options.Fallback)
+				logDNS.Verbose("fallback", "domain", name, "addr", options.Fallback)
 				records.IPv6Hint = &RecordAddresses{0, []net.IP{options.Fallback}}
 			}
 		}
 		if records.IPv6Hint == nil {
-			logPrintln(4, "request:", name, qtype, "no answer")
-			records.IPv6Hint = &RecordAddresses{0, []net.IP{}}
+			logDNS.Verbose("no answer", "domain", name, "qtype", qtype)
+			records.IPv6Hint = negativeAnswer(response)
 			return 0, records.BuildResponse(request, qtype, 0)
 		}
-		logPrintln(3, "response:", name, qtype, records.IPv6Hint.Addresses)
+		logDNS.Trace("response", "domain", name, "qtype", qtype, "ips", records.IPv6Hint.Addresses)
 	default:
-		return 0, response
+		return 0, StripEDNS(response)
 	}
 
 	if UseVaddr && (records.Index == 0) {
-		NoseLock.Lock()
-		records.Index = uint32(len(Nose))
-		Nose = append(Nose, name)
-		NoseLock.Unlock()
+		records.Index = Nose.Alloc(name, false)
 	}
 
 	return records.Index, records.BuildResponse(request, qtype, 0)
 }
 
+// lookup resolves name with the static records of a user profile first.
+func (server *PhantomInterface) lookup(name string, hint uint32) []net.IP {
+	if server.records != nil {
+		records, ok := server.records[name]
+		offset := 0
+		for i := 0; !ok && i < SubdomainDepth; i++ {
+			off := strings.Index(name[offset:], ".")
+			if off == -1 {
+				break
+			}
+			offset += off
+			records, ok = server.records[name[offset:]]
+			offset++
+		}
+		if ok {
+			if hint&HINT_IPV6 != 0 {
+				if records.IPv6Hint != nil {
+					return records.IPv6Hint.Addresses
+				}
+			} else if records.IPv4Hint != nil {
+				return records.IPv4Hint.Addresses
+			}
+		}
+	}
+
+	_, addrs := NSLookup(name, hint, server.DNS, server.DNSPolicy)
+	return addrs
+}
+
 func (server *PhantomInterface) ResolveTCPAddr(host string, port int) (*net.TCPAddr, error) {
 	ip := net.ParseIP(host)
 	if ip != nil {
 		return &net.TCPAddr{IP: ip, Port: port}, nil
 	}
 
-	_, addrs := NSLookup(host, server.Hint, server.DNS)
+	addrs := server.lookup(host, server.Hint)
 	if len(addrs) == 0 {
 		return nil, errors.New("no such host")
 	}
@@ -1315,7 +1358,21 @@ func (server *PhantomInterface) ResolveTCPAddrs(host string, port int) ([]*net.T
 		return tcpAddrs, nil
 	}
 
-	_, addrs := NSLookup(host, server.Hint, server.DNS)
+	var addrs []net.IP
+	if server.Hint&(HINT_IPV4|HINT_IPV6) == HINT_IPV4|HINT_IPV6 {
+		// both families are looked up and raced by Dial, IPv6 first
+		var addrs4 []net.IP
+		done := make(chan struct{})
+		go func() {
+			addrs4 = server.lookup(host, server.Hint&^HINT_IPV6)
+			close(done)
+		}()
+		addrs = server.lookup(host, server.Hint)
+		<-done
+		addrs = append(addrs[:len(addrs):len(addrs)], addrs4...)
+	} else {
+		addrs = server.lookup(host, server.Hint)
+	}
 	if len(addrs) == 0 {
 		return nil, errors.New("no such host")
 	}
@@ -1344,20 +1401,11 @@ func DNSTCPServer(client net.Conn) {
 
 	_, response := NSRequest(request, true)
 	responseLen := len(response)
-	binary.BigEndian.PutUint16(data[:2], uint16(responseLen))
-	copy(data[2:], response)
-	client.Write(data[:responseLen+2])
-}
-
-func DoHServer(w http.ResponseWriter, req *http.Request) {
-	var data [2048]byte
-	n, err := req.Body.Read(data[:])
-	if err != nil {
+	if responseLen > 0xFFFF {
 		return
 	}
-	request := data[:n]
-	_, response := NSRequest(request, true)
-
-	w.Header().Set("Content-Type", "application/dns-message")
-	w.Write(response)
+	reply := make([]byte, responseLen+2)
+	binary.BigEndian.PutUint16(reply[:2], uint16(responseLen))
+	copy(reply[2:], response)
+	client.Write(reply)
 }
@@ -0,0 +1,702 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testUpstream is a UDP server that answers with respond, which gets the
+// question of each query with the QR bit set.
+func testUpstream(t testing.TB, respond func(response []byte, qtype int) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, qtype, end := GetQName(b[:n])
+			if end == 0 {
+				continue
+			}
+			response := append([]byte{}, b[:end]...)
+			response[2] |= 0x80
+			conn.WriteTo(respond(response, qtype), addr)
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String()
+}
+
+// fakeUpstream answers A and AAAA queries for any name with 1.2.3.4 and
+// 2001:db8::1.
+func fakeUpstream(t testing.TB) string {
+	return testUpstream(t, func(response []byte, qtype int) []byte {
+		response[7] = 1 // ANCount
+		if qtype == 1 {
+			return append(response, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 1, 2, 3, 4)
+		}
+		response = append(response, 0xc0, 12, 0, 28, 0, 1, 0, 0, 0, 60, 0, 16)
+		return append(response, net.ParseIP("2001:db8::1")...)
+	})
+}
+
+// The A and AAAA lookups of ResolveTCPAddrs and the DNS service share the
+// cached records of a name, run with -race.
+func TestResolveTCPAddrsConcurrent(t *testing.T) {
+	SetProfile(NewProfile(map[string]PhantomInterface{}))
+	pface := &PhantomInterface{DNS: fakeUpstream(t), Hint: HINT_IPV4 | HINT_IPV6}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			addrs, err := pface.ResolveTCPAddrs("race.example.com", 443)
+			if err != nil || len(addrs) != 2 {
+				t.Errorf("ResolveTCPAddrs = %v, %v", addrs, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			NSRequest(PackRequest("race.example.com", 1, 1, ""), true)
+		}()
+	}
+	wg.Wait()
+}
+
+// dnsHeader is the header of a message with qd questions and an answers.
+func dnsHeader(qd, an byte) []byte {
+	return []byte{0x12, 0x34, 0x81, 0x80, 0, qd, 0, an, 0, 0, 0, 0}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var exampleQName = []byte("\x07example\x03com\x00")
+
+// longName is three labels of 63 bytes and one of last.
+func longName(last int) []byte {
+	label := append([]byte{63}, strings.Repeat("a", 63)...)
+	return join(label, label, label, []byte{byte(last)}, bytes.Repeat([]byte{'a'}, last), []byte{0})
+}
+
+func TestGetQName(t *testing.T) {
+	tests := []struct {
+		name  string
+		buf   []byte
+		qname string
+		qtype int
+	}{
+		{"a", join(dnsHeader(1, 0), exampleQName, []byte{0, 1, 0, 1}), "example.com", 1},
+		{"root", join(dnsHeader(1, 0), []byte{0, 0, 28, 0, 1}), "", 28},
+		{"no header", []byte{0x12, 0x34}, "", 0},
+		{"truncated label", join(dnsHeader(1, 0), []byte("\x07exam")), "", 0},
+		{"no terminator", join(dnsHeader(1, 0), []byte("\x07example")), "", 0},
+		{"no qtype", join(dnsHeader(1, 0), exampleQName, []byte{0}), "", 0},
+		{"label over 63", join(dnsHeader(1, 0), []byte{64}, bytes.Repeat([]byte{'a'}, 64), []byte{0, 0, 1, 0, 1}), "", 0},
+		{"pointer", join(dnsHeader(1, 0), []byte{0xc0, 12, 0, 1, 0, 1}), "", 0},
+		{"name of 253", join(dnsHeader(1, 0), longName(61), []byte{0, 1, 0, 1}), strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("a", 61), 1},
+		{"name over 253", join(dnsHeader(1, 0), longName(62), []byte{0, 1, 0, 1}), "", 0},
+	}
+	for _, tt := range tests {
+		qname, qtype, end := GetQName(tt.buf)
+		if qname != tt.qname || qtype != tt.qtype {
+			t.Errorf("%s: got %q %d", tt.name, qname, qtype)
+		}
+		if tt.qtype == 0 && end != 0 {
+			t.Errorf("%s: end %d for a malformed question", tt.name, end)
+		}
+		if end > len(tt.buf) {
+			t.Errorf("%s: end %d past %d", tt.name, end, len(tt.buf))
+		}
+	}
+}
+
+func TestGetName(t *testing.T) {
+	// example.com at 12, www pointing to it at 25
+	buf := join(dnsHeader(0, 0), exampleQName, []byte("\x03www\xc0\x0c"))
+	tests := []struct {
+		name   string
+		buf    []byte
+		offset int
+		want   string
+		end    int
+	}{
+		{"plain", buf, 12, "example.com", 25},
+		{"compressed", buf, 25, "www.example.com", 31},
+		{"offset past end", buf, len(buf), "", 0},
+		{"truncated label", buf[:18], 12, "", 0},
+		{"truncated pointer", buf[:30], 25, "", 0},
+		{"label over 63", join(dnsHeader(0, 0), []byte{64}, bytes.Repeat([]byte{'a'}, 64), []byte{0}), 12, "", 0},
+		{"pointer to itself", join(dnsHeader(0, 0), []byte{0xc0, 12}), 12, "", 0},
+		{"forward pointer", join(dnsHeader(0, 0), []byte{0xc0, 14}, exampleQName), 12, "", 0},
+		{"pointer loop", join(dnsHeader(0, 0), []byte("\x01a\xc0\x0e\x01b\xc0\x0c")), 14, "", 0},
+		{"name over 253", join(dnsHeader(0, 0), longName(62)), 12, "", 0},
+	}
+	for _, tt := range tests {
+		name, end := GetName(tt.buf, tt.offset)
+		if name != tt.want || end != tt.end {
+			t.Errorf("%s: got %q %d, want %q %d", tt.name, name, end, tt.want, tt.end)
+		}
+	}
+}
+
+// answer is a resource record for the name at 12.
+func answer(atype byte, data []byte) []byte {
+	return join([]byte{0xc0, 12, 0, atype, 0, 1, 0, 0, 1, 0, byte(len(data) >> 8), byte(len(data))}, data)
+}
+
+// svcb is the data of an HTTPS record for "." with params.
+func svcb(params ...[]byte) []byte {
+	return join([]byte{0, 1, 0}, join(params...))
+}
+
+func svcParam(key byte, value []byte) []byte {
+	return join([]byte{0, key, byte(len(value) >> 8), byte(len(value))}, value)
+}
+
+func TestGetAnswers(t *testing.T) {
+	question := join(exampleQName, []byte{0, 1, 0, 1})
+	v6 := net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name string
+		buf  []byte
+		ipv4 []net.IP
+		ipv6 []net.IP
+		alpn uint32
+	}{
+		{"a", join(dnsHeader(1, 1), question, answer(1, []byte{1, 2, 3, 4})), []net.IP{{1, 2, 3, 4}}, nil, 0},
+		{"aaaa", join(dnsHeader(1, 1), question, answer(28, v6)), nil, []net.IP{v6}, 0},
+		{"short a", join(dnsHeader(1, 1), question, answer(1, []byte{1, 2, 3})), nil, nil, 0},
+		{"truncated rdata", join(dnsHeader(1, 1), question, answer(1, []byte{1, 2, 3, 4}))[:len(question)+12+12+2], nil, nil, 0},
+		{"more answers than sent", join(dnsHeader(1, 3), question, answer(1, []byte{1, 2, 3, 4})), []net.IP{{1, 2, 3, 4}}, nil, 0},
+		{"truncated question", join(dnsHeader(1, 1), exampleQName[:5]), nil, nil, 0},
+		{"cname at end", join(dnsHeader(1, 2), question, answer(1, []byte{1, 2, 3, 4}), answer(5, []byte{0xc0, 12})), []net.IP{{1, 2, 3, 4}}, nil, 0},
+		{"empty cname at end", join(dnsHeader(1, 1), question, answer(5, nil)), nil, nil, 0},
+		{"truncated cname", join(dnsHeader(1, 1), question, answer(5, []byte("\x03ww"))), nil, nil, 0},
+		{"svcb hints", join(dnsHeader(1, 1), question, answer(65, svcb(
+			svcParam(1, []byte("\x02h2")), svcParam(4, []byte{1, 2, 3, 4}), svcParam(6, v6)))),
+			[]net.IP{net.IPv4(1, 2, 3, 4)}, []net.IP{v6}, HINT_ALPN | HINT_HTTPS},
+		{"short svcb ipv4hint", join(dnsHeader(1, 2), question, answer(1, []byte{5, 6, 7, 8}), answer(65, svcb(
+			svcParam(4, []byte{1, 2, 3})))), []net.IP{{5, 6, 7, 8}}, nil, HINT_ALPN},
+		{"short svcb ipv6hint", join(dnsHeader(1, 2), question, answer(28, v6), answer(65, svcb(
+			svcParam(6, v6[:15])))), nil, []net.IP{v6}, HINT_ALPN},
+		{"svcb ipv4hint with a tail", join(dnsHeader(1, 1), question, answer(65, svcb(
+			svcParam(4, []byte{1, 2, 3, 4, 5, 6})))), []net.IP{net.IPv4(1, 2, 3, 4)}, nil, HINT_ALPN},
+		{"svcb param past rdata", join(dnsHeader(1, 1), question, answer(65, svcb(
+			[]byte{0, 4, 0, 8, 1, 2, 3, 4}))), nil, nil, 0},
+		{"svcb truncated alpn", join(dnsHeader(1, 1), question, answer(65, svcb(
+			svcParam(1, []byte("\x05h2"))))), nil, nil, HINT_ALPN},
+		{"svcb no target", join(dnsHeader(1, 1), question, answer(65, []byte{0, 1})), nil, nil, 0},
+	}
+	for _, tt := range tests {
+		var records DNSRecords
+		records.GetAnswers(tt.buf, ServerOptions{})
+		var ipv4, ipv6 []net.IP
+		if records.IPv4Hint != nil {
+			ipv4 = records.IPv4Hint.Addresses
+		}
+		if records.IPv6Hint != nil {
+			ipv6 = records.IPv6Hint.Addresses
+		}
+		if !equalIPs(ipv4, tt.ipv4) || !equalIPs(ipv6, tt.ipv6) || records.ALPN != tt.alpn {
+			t.Errorf("%s: got %v %v %x, want %v %v %x", tt.name, ipv4, ipv6, records.ALPN, tt.ipv4, tt.ipv6, tt.alpn)
+		}
+	}
+}
+
+func equalIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuildResponse(t *testing.T) {
+	request := join(dnsHeader(1, 0), exampleQName, []byte{0, 1, 0, 1})
+	records := &DNSRecords{IPv4Hint: &RecordAddresses{0, []net.IP{net.IPv4(1, 2, 3, 4).To4()}}}
+	response := records.BuildResponse(request, 1, 60)
+
+	var got DNSRecords
+	got.GetAnswers(response, ServerOptions{})
+	if !bytes.Equal(response[:2], request[:2]) || got.IPv4Hint == nil || !equalIPs(got.IPv4Hint.Addresses, records.IPv4Hint.Addresses) {
+		t.Fatalf("got %x", response)
+	}
+	if n := len(records.BuildResponse(request, 28, 60)); n != len(request) {
+		t.Errorf("aaaa without addresses has %d bytes", n)
+	}
+	for n := 0; n < 12; n++ {
+		if response := records.BuildResponse(request[:n], 28, 60); response != nil {
+			t.Errorf("%d byte request answered with %x", n, response)
+		}
+	}
+}
+
+// soa is an SOA record for the name at 12.
+func soa(ttl, minimum uint32) []byte {
+	data := join([]byte("\x02ns\xc0\x0c\x04root\xc0\x0c"), make([]byte, 16), binary.BigEndian.AppendUint32(nil, minimum))
+	record := answer(6, data)
+	binary.BigEndian.PutUint32(record[6:10], ttl)
+	return record
+}
+
+// withNS sets the NSCount of a message.
+func withNS(message []byte, ns byte) []byte {
+	message[9] = ns
+	return message
+}
+
+func TestNegativeTTL(t *testing.T) {
+	question := join(exampleQName, []byte{0, 1, 0, 1})
+	tests := []struct {
+		name string
+		buf  []byte
+		ttl  uint32
+	}{
+		{"soa minimum", join(withNS(dnsHeader(1, 0), 1), question, soa(3600, 60)), 60},
+		{"soa ttl", join(withNS(dnsHeader(1, 0), 1), question, soa(120, 900)), 120},
+		{"soa zero", join(withNS(dnsHeader(1, 0), 1), question, soa(0, 900)), 0},
+		{"soa after a cname", join(withNS(dnsHeader(1, 1), 1), question, answer(5, []byte{0xc0, 12}), soa(3600, 60)), 60},
+		{"no soa", join(dnsHeader(1, 0), question), DNSNegativeTTL},
+		{"truncated soa", join(withNS(dnsHeader(1, 0), 1), question, soa(3600, 60))[:len(question)+12+30], DNSNegativeTTL},
+		{"short soa", join(withNS(dnsHeader(1, 0), 1), question, answer(6, []byte{0, 0, 0, 0})), DNSNegativeTTL},
+		{"no header", []byte{0x12, 0x34}, DNSNegativeTTL},
+	}
+	for _, tt := range tests {
+		if ttl := NegativeTTL(tt.buf); ttl != tt.ttl {
+			t.Errorf("%s: got %d, want %d", tt.name, ttl, tt.ttl)
+		}
+	}
+}
+
+// A name without addresses is cached for the SOA minimum, not for good.
+func TestNegativeCache(t *testing.T) {
+	SetProfile(NewProfile(map[string]PhantomInterface{}))
+	server := testUpstream(t, func(response []byte, qtype int) []byte {
+		response[9] = 1 // NSCount
+		return append(response, soa(3600, 60)...)
+	})
+
+	now := time.Now().Unix()
+	_, ips := NSLookup("nodata.example.com", HINT_IPV4, server, DNS_FAILOVER)
+	if len(ips) != 0 {
+		t.Fatalf("got %v", ips)
+	}
+	records := LoadDNSCache("nodata.example.com")
+	records.lock.Lock()
+	defer records.lock.Unlock()
+	hint := records.IPv4Hint
+	if hint == nil || hint.TTL < now+60 || hint.TTL > time.Now().Unix()+60 {
+		t.Fatalf("negative answer cached with %+v", hint)
+	}
+	if hint.fresh(now + 61) {
+		t.Errorf("negative answer still fresh after its TTL")
+	}
+}
+
+func TestGetNameOffset(t *testing.T) {
+	// example.com at 12, www pointing to it at 25
+	buf := join(dnsHeader(0, 0), exampleQName, []byte("\x03www\xc0\x0c"))
+	tests := []struct {
+		name   string
+		buf    []byte
+		offset int
+		end    int
+	}{
+		{"name", buf, 12, 25},
+		{"pointer after a label", buf, 25, 31},
+		{"pointer", buf, 29, 31},
+		{"root", []byte{0, 0, 1}, 0, 1},
+		{"name at the end", exampleQName, 0, len(exampleQName)},
+		{"truncated label", exampleQName[:5], 0, 0},
+		{"no terminator", exampleQName[:12], 0, 0},
+		{"truncated pointer", []byte{0xc0}, 0, 0},
+		{"label over 63", join([]byte{64}, bytes.Repeat([]byte{'a'}, 64), []byte{0}), 0, 0},
+		{"offset at the end", buf, len(buf), 0},
+		{"offset past the end", buf, len(buf) + 1, 0},
+	}
+	for _, tt := range tests {
+		if end := GetNameOffset(tt.buf, tt.offset); end != tt.end {
+			t.Errorf("%s: got %d, want %d", tt.name, end, tt.end)
+		}
+	}
+}
+
+func TestPackAnswers(t *testing.T) {
+	now := time.Now().Unix()
+	v4 := []net.IP{net.IPv4(1, 2, 3, 4).To4(), net.IPv4(5, 6, 7, 8).To4()}
+	v6 := []net.IP{net.ParseIP("2001:db8::1")}
+	tests := []struct {
+		name    string
+		records *DNSRecords
+		qtype   int
+		minttl  uint32
+		count   int
+		ttl     uint32
+		ipv4    []net.IP
+		ipv6    []net.IP
+		alpn    uint32
+	}{
+		{"a", &DNSRecords{IPv4Hint: &RecordAddresses{now + 300, v4}}, 1, 0, 2, 300, v4, nil, 0},
+		{"a minttl", &DNSRecords{IPv4Hint: &RecordAddresses{now + 300, v4}}, 1, 600, 2, 600, v4, nil, 0},
+		{"a expired", &DNSRecords{IPv4Hint: &RecordAddresses{now - 10, v4}}, 1, 0, 2, 0, v4, nil, 0},
+		{"aaaa", &DNSRecords{IPv6Hint: &RecordAddresses{0, v6}}, 28, 60, 1, 60, nil, v6, 0},
+		{"no addresses", &DNSRecords{IPv4Hint: &RecordAddresses{0, []net.IP{}}}, 1, 60, 0, 0, nil, nil, 0},
+		{"no hint", &DNSRecords{}, 28, 60, 0, 0, nil, nil, 0},
+		{"https", &DNSRecords{ALPN: HINT_HTTPS | HINT_HTTP3, IPv4Hint: &RecordAddresses{0, v4}, IPv6Hint: &RecordAddresses{0, v6}, Ech: []byte{1, 2, 3}},
+			65, 60, 1, 60, v4, v6, HINT_ALPN | HINT_HTTPS | HINT_HTTP3},
+		{"https without hints", &DNSRecords{}, 65, 60, 0, 0, nil, nil, 0},
+		{"https ipv6 in ipv4hint", &DNSRecords{IPv4Hint: &RecordAddresses{0, v6}}, 65, 60, 0, 0, nil, nil, 0},
+		{"unknown type", &DNSRecords{IPv4Hint: &RecordAddresses{0, v4}}, 16, 60, 0, 0, nil, nil, 0},
+	}
+	question := join(exampleQName, []byte{0, 1, 0, 1})
+	for _, tt := range tests {
+		count, answers := tt.records.PackAnswers(tt.qtype, tt.minttl)
+		if count != tt.count {
+			t.Errorf("%s: %d answers, want %d", tt.name, count, tt.count)
+			continue
+		}
+		if count == 0 {
+			continue
+		}
+		if ttl := binary.BigEndian.Uint32(answers[6:10]); ttl != tt.ttl {
+			t.Errorf("%s: ttl %d, want %d", tt.name, ttl, tt.ttl)
+		}
+		var got DNSRecords
+		got.GetAnswers(join(dnsHeader(1, byte(count)), question, answers), ServerOptions{})
+		var ipv4, ipv6 []net.IP
+		if got.IPv4Hint != nil {
+			ipv4 = got.IPv4Hint.Addresses
+		}
+		if got.IPv6Hint != nil {
+			ipv6 = got.IPv6Hint.Addresses
+		}
+		if !equalIPs(ipv4, tt.ipv4) || !equalIPs(ipv6, tt.ipv6) || got.ALPN != tt.alpn {
+			t.Errorf("%s: got %v %v %x, want %v %v %x", tt.name, ipv4, ipv6, got.ALPN, tt.ipv4, tt.ipv6, tt.alpn)
+		}
+	}
+}
+
+func TestPackRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		ecs   string
+		opt   bool
+	}{
+		{"a", "example.com", 1, "", false},
+		{"aaaa", "www.example.com", 28, "", false},
+		{"single label", "localhost", 1, "", false},
+		{"ecs", "example.com", 1, "192.0.2.1", true},
+		{"ecs ipv6", "example.com", 65, "2001:db8::/32", true},
+		{"bad ecs", "example.com", 1, "not an address", false},
+	}
+	for _, tt := range tests {
+		request := PackRequest(tt.qname, tt.qtype, 0x1234, tt.ecs)
+		qname, qtype, end := GetQName(request)
+		if qname != tt.qname || qtype != int(tt.qtype) || binary.BigEndian.Uint16(request) != 0x1234 {
+			t.Errorf("%s: got %q %d", tt.name, qname, qtype)
+			continue
+		}
+		edns := GetEDNS(request, end)
+		if (edns != nil) != tt.opt {
+			t.Errorf("%s: OPT record %v", tt.name, edns)
+			continue
+		}
+		if edns == nil {
+			if end != len(request) {
+				t.Errorf("%s: %d bytes after the question", tt.name, len(request)-end)
+			}
+			continue
+		}
+		if _, ok := edns.Option(EDNS_ECS); !ok || edns.UDPSize != EDNSSize {
+			t.Errorf("%s: got %+v", tt.name, edns)
+		}
+	}
+}
+
+// nsRequestProfile sends every name to an upstream answering 1.2.3.4 and
+// 2001:db8::1.
+func nsRequestProfile(t testing.TB) {
+	SetProfile(NewProfile(map[string]PhantomInterface{
+		"default": {Name: "default", DNS: fakeUpstream(t)},
+	}))
+}
+
+func TestNSRequest(t *testing.T) {
+	nsRequestProfile(t)
+	query := func(qtype byte, edns *EDNS) []byte {
+		request := join(dnsHeader(1, 0), exampleQName, []byte{0, qtype, 0, 1})
+		request[2], request[3] = 1, 0
+		if edns != nil {
+			request = edns.AppendTo(request)
+		}
+		return request
+	}
+	padding := &EDNS{UDPSize: 4096, Options: []EDNSOption{{EDNS_PADDING, make([]byte, 8)}}}
+	large := &EDNS{UDPSize: 4096, Options: []EDNSOption{{65001, make([]byte, 2000)}}}
+	tests := []struct {
+		name    string
+		request []byte
+		ipv4    []net.IP
+		ipv6    []net.IP
+		opt     bool
+	}{
+		{"a", query(1, nil), []net.IP{{1, 2, 3, 4}}, nil, false},
+		{"aaaa", query(28, nil), nil, []net.IP{net.ParseIP("2001:db8::1")}, false},
+		{"edns", query(1, &EDNS{UDPSize: 4096, Flags: EDNS_DO}), []net.IP{{1, 2, 3, 4}}, nil, true},
+		{"edns padding", query(1, padding), []net.IP{{1, 2, 3, 4}}, nil, true},
+		{"edns oversized option", query(1, large), []net.IP{{1, 2, 3, 4}}, nil, true},
+	}
+	for _, tt := range tests {
+		_, response := NSRequest(append([]byte{}, tt.request...), false)
+		if len(response) < 12 || binary.BigEndian.Uint16(response) != 0x1234 {
+			t.Errorf("%s: response %x", tt.name, response)
+			continue
+		}
+		var records DNSRecords
+		records.GetAnswers(response, ServerOptions{})
+		var ipv4, ipv6 []net.IP
+		if records.IPv4Hint != nil {
+			ipv4 = records.IPv4Hint.Addresses
+		}
+		if records.IPv6Hint != nil {
+			ipv6 = records.IPv6Hint.Addresses
+		}
+		if !equalIPs(ipv4, tt.ipv4) || !equalIPs(ipv6, tt.ipv6) {
+			t.Errorf("%s: got %v %v", tt.name, ipv4, ipv6)
+		}
+		_, _, end := GetQName(response)
+		edns := GetEDNS(response, end)
+		if (edns != nil) != tt.opt {
+			t.Errorf("%s: OPT record %v", tt.name, edns)
+		}
+		if edns == nil {
+			continue
+		}
+		if _, ok := edns.Option(EDNS_PADDING); ok && len(response)%468 != 0 {
+			t.Errorf("%s: padded response of %d bytes", tt.name, len(response))
+		}
+	}
+
+	for _, request := range [][]byte{nil, {0x12, 0x34}, dnsHeader(1, 0), join(dnsHeader(1, 0), exampleQName[:5])} {
+		if _, response := NSRequest(request, false); response != nil {
+			t.Errorf("%x answered with %x", request, response)
+		}
+	}
+}
+
+var dnsSeeds = [][]byte{
+	join(dnsHeader(1, 0), exampleQName, []byte{0, 1, 0, 1}),
+	join(dnsHeader(1, 1), exampleQName, []byte{0, 1, 0, 1}, answer(1, []byte{1, 2, 3, 4})),
+	join(dnsHeader(1, 2), exampleQName, []byte{0, 28, 0, 1}, answer(5, []byte("\x03www\xc0\x0c")), answer(28, net.ParseIP("2001:db8::1"))),
+	join(dnsHeader(1, 1), exampleQName, []byte{0, 65, 0, 1}, answer(65, svcb(
+		svcParam(1, []byte("\x02h2\x02h3")), svcParam(4, []byte{1, 2, 3, 4}), svcParam(5, []byte{1, 2}), svcParam(6, net.ParseIP("2001:db8::1"))))),
+	join(dnsHeader(0, 0), []byte("\x01a\xc0\x0e\x01b\xc0\x0c")),
+	join(dnsHeader(1, 0), longName(61), []byte{0, 1, 0, 1}),
+	{},
+}
+
+func FuzzGetName(f *testing.F) {
+	for _, seed := range dnsSeeds {
+		f.Add(seed, 12)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte, offset int) {
+		if offset < 0 {
+			return
+		}
+		name, end := GetName(buf, offset)
+		if end == 0 {
+			return
+		}
+		if end > len(buf) || len(name) > 253 {
+			t.Fatalf("got %q %d for %d bytes", name, end, len(buf))
+		}
+	})
+}
+
+func FuzzGetQName(f *testing.F) {
+	for _, seed := range dnsSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		name, _, end := GetQName(buf)
+		if end > len(buf) || len(name) > 253 {
+			t.Fatalf("got %q %d for %d bytes", name, end, len(buf))
+		}
+	})
+}
+
+func FuzzGetAnswers(f *testing.F) {
+	for _, seed := range dnsSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var records DNSRecords
+		records.GetAnswers(buf, ServerOptions{})
+		if records.IPv4Hint != nil {
+			for _, ip := range records.IPv4Hint.Addresses {
+				if ip.To4() == nil {
+					t.Fatalf("ipv4 hint %v", ip)
+				}
+			}
+		}
+		if records.IPv6Hint != nil {
+			for _, ip := range records.IPv6Hint.Addresses {
+				if len(ip) != net.IPv6len {
+					t.Fatalf("ipv6 hint %v", ip)
+				}
+			}
+		}
+	})
+}
+
+func FuzzBuildResponse(f *testing.F) {
+	for _, seed := range dnsSeeds {
+		f.Add(seed, 1, uint32(0))
+		f.Add(seed, 65, uint32(1))
+	}
+	f.Fuzz(func(t *testing.T, request []byte, qtype int, index uint32) {
+		records := &DNSRecords{
+			Index:    index,
+			ALPN:     HINT_HTTPS | HINT_HTTP3,
+			IPv4Hint: &RecordAddresses{0, []net.IP{net.IPv4(1, 2, 3, 4).To4()}},
+			IPv6Hint: &RecordAddresses{0, []net.IP{net.ParseIP("2001:db8::1")}},
+		}
+		response := records.BuildResponse(request, qtype, 60)
+		if response != nil && !bytes.HasPrefix(response, request[:2]) {
+			t.Fatalf("response %x to %x", response, request)
+		}
+	})
+}
+
+func FuzzGetNameOffset(f *testing.F) {
+	for _, seed := range dnsSeeds {
+		f.Add(seed, 12)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte, offset int) {
+		if offset < 0 {
+			return
+		}
+		end := GetNameOffset(buf, offset)
+		if end != 0 && (end <= offset || end > len(buf)) {
+			t.Fatalf("end %d for offset %d of %d bytes", end, offset, len(buf))
+		}
+	})
+}
+
+func FuzzPackAnswers(f *testing.F) {
+	f.Add([]byte{1, 2, 3, 4}, []byte{}, []byte{}, uint32(HINT_HTTPS), 1)
+	f.Add([]byte{}, []byte(net.ParseIP("2001:db8::1")), []byte{}, uint32(0), 28)
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte(net.ParseIP("2001:db8::1")), []byte{1, 2, 3}, uint32(HINT_HTTPS|HINT_HTTP3), 65)
+	f.Fuzz(func(t *testing.T, v4 []byte, v6 []byte, ech []byte, alpn uint32, qtype int) {
+		if len(v4) > 1024 || len(v6) > 1024 || len(ech) > 1024 {
+			return
+		}
+		records := DNSRecords{ALPN: alpn, Ech: ech}
+		if len(v4) >= 4 {
+			records.IPv4Hint = &RecordAddresses{0, nil}
+			for ; len(v4) >= 4; v4 = v4[4:] {
+				records.IPv4Hint.Addresses = append(records.IPv4Hint.Addresses, net.IP(v4[:4]))
+			}
+		}
+		if len(v6) >= 16 {
+			records.IPv6Hint = &RecordAddresses{0, nil}
+			for ; len(v6) >= 16; v6 = v6[16:] {
+				// no IPv4-mapped addresses, they do not come from AAAA records
+				ip := append(net.IP{0x20}, v6[1:16]...)
+				records.IPv6Hint.Addresses = append(records.IPv6Hint.Addresses, ip)
+			}
+		}
+		count, answers := records.PackAnswers(qtype, 60)
+		if count == 0 {
+			return
+		}
+
+		var got DNSRecords
+		got.GetAnswers(join(dnsHeader(1, byte(count)), exampleQName, []byte{0, 1, 0, 1}, answers), ServerOptions{})
+		switch qtype {
+		case 1:
+			if got.IPv4Hint == nil || !equalIPs(got.IPv4Hint.Addresses, records.IPv4Hint.Addresses) {
+				t.Fatalf("packed %v, parsed %+v", records.IPv4Hint.Addresses, got.IPv4Hint)
+			}
+		case 28:
+			if got.IPv6Hint == nil || !equalIPs(got.IPv6Hint.Addresses, records.IPv6Hint.Addresses) {
+				t.Fatalf("packed %v, parsed %+v", records.IPv6Hint.Addresses, got.IPv6Hint)
+			}
+		case 65:
+			if got.ALPN&HINT_ALPN == 0 {
+				t.Fatalf("svcb %x not parsed", answers)
+			}
+		}
+	})
+}
+
+func FuzzPackRequest(f *testing.F) {
+	f.Add("example.com", uint16(1), "")
+	f.Add("www.example.com", uint16(28), "192.0.2.1/24")
+	f.Add("example.com", uint16(65), "2001:db8::1")
+	f.Add("a..b.", uint16(1), "192.0.2.1/33")
+	f.Fuzz(func(t *testing.T, name string, qtype uint16, ecs string) {
+		request := PackRequest(name, qtype, 0x1234, ecs)
+		qname, _, end := GetQName(request)
+		edns := GetEDNS(request, end)
+		if !validName(name) {
+			return
+		}
+		if qname != name || end == 0 {
+			t.Fatalf("packed %q, parsed %q", name, qname)
+		}
+		if _, ok := ECSOption(ecs); ok != (edns != nil) {
+			t.Fatalf("ecs %q, OPT record %+v", ecs, edns)
+		}
+	})
+}
+
+// validName reports whether name is a domain GetQName accepts.
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzNSRequest(f *testing.F) {
+	for _, seed := range dnsSeeds {
+		f.Add(seed)
+	}
+	request := join(dnsHeader(1, 0), exampleQName, []byte{0, 1, 0, 1})
+	f.Add((&EDNS{UDPSize: 4096, Flags: EDNS_DO}).AppendTo(request))
+	f.Add((&EDNS{UDPSize: 512, Options: []EDNSOption{{EDNS_PADDING, make([]byte, 8)}, {EDNS_COOKIE, make([]byte, 8)}}}).AppendTo(request))
+	f.Add((&EDNS{UDPSize: 4096, Options: []EDNSOption{{65001, make([]byte, 2000)}}}).AppendTo(request))
+	nsRequestProfile(f)
+	f.Fuzz(func(t *testing.T, request []byte) {
+		id := append([]byte{}, request[:min(len(request), 2)]...)
+		_, response := NSRequest(request, false)
+		if response != nil && !bytes.HasPrefix(response, id) {
+			t.Fatalf("response %x to %x", response, request)
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package phantomtcp
+
+import (
+	"container/list"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type DNSCacheConfig struct {
+	Size  int    `json:"size,omitempty"`
+	Stale int    `json:"stale,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+type dnsCacheEntry struct {
+	name    string
+	records *DNSRecords
+	elem    *list.Element
+}
+
+// dnsCache keeps static records pinned, other records are evicted in LRU
+// order once there are more than size of them.
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]*dnsCacheEntry
+	lru     *list.List
+	size    int
+}
+
+const DefaultDNSCacheSize = 4096
+
+var DNSCache = &dnsCache{
+	entries: make(map[string]*dnsCacheEntry),
+	lru:     list.New(),
+	size:    DefaultDNSCacheSize,
+}
+
+// DNSServeStale is how long, in seconds, an expired answer may still be
+// served when the upstream server fails.
+var DNSServeStale int64 = 0
+
+func ConfigureDNSCache(config *DNSCacheConfig) {
+	size := DefaultDNSCacheSize
+	var stale int64
+	if config != nil {
+		if config.Size > 0 {
+			size = config.Size
+		}
+		stale = int64(config.Stale)
+	}
+	DNSServeStale = stale
+
+	DNSCache.lock.Lock()
+	DNSCache.size = size
+	DNSCache.evict()
+	DNSCache.lock.Unlock()
+}
+
+func (cache *dnsCache) Load(name string) (*DNSRecords, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[name]
+	if !ok {
+		return nil, false
+	}
+	if entry.elem != nil {
+		cache.lru.MoveToFront(entry.elem)
+	}
+	return entry.records, true
+}
+
+// Store caches records for name. A pinned entry is only replaced by Pin.
+func (cache *dnsCache) Store(name string, records *DNSRecords) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[name]
+	if ok {
+		if entry.elem == nil {
+			return
+		}
+		entry.records = records
+		cache.lru.MoveToFront(entry.elem)
+		return
+	}
+	entry = &dnsCacheEntry{name: name, records: records}
+	entry.elem = cache.lru.PushFront(entry)
+	cache.entries[name] = entry
+	cache.evict()
+}
+
+// LoadOrStore returns the records cached for name, or stores and returns
+// records if there are none, so concurrent lookups share one entry.
+func (cache *dnsCache) LoadOrStore(name string, records *DNSRecords) *DNSRecords {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[name]
+	if ok {
+		if entry.elem != nil {
+			cache.lru.MoveToFront(entry.elem)
+		}
+		return entry.records
+	}
+	entry = &dnsCacheEntry{name: name, records: records}
+	entry.elem = cache.lru.PushFront(entry)
+	cache.entries[name] = entry
+	cache.evict()
+	return records
+}
+
+// Pin stores records that are never evicted.
+func (cache *dnsCache) Pin(name string, records *DNSRecords) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[name]
+	if ok && entry.elem != nil {
+		cache.lru.Remove(entry.elem)
+	}
+	cache.entries[name] = &dnsCacheEntry{name: name, records: records}
+}
+
+func (cache *dnsCache) Delete(name string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[name]
+	if !ok {
+		return
+	}
+	if entry.elem != nil {
+		cache.lru.Remove(entry.elem)
+	}
+	delete(cache.entries, name)
+}
+
+// Range calls f for a snapshot of the cache, so f may modify it.
+func (cache *dnsCache) Range(f func(name string, records *DNSRecords, pinned bool) bool) {
+	cache.lock.Lock()
+	entries := make([]dnsCacheEntry, 0, len(cache.entries))
+	for _, entry := range cache.entries {
+		entries = append(entries, *entry)
+	}
+	cache.lock.Unlock()
+
+	for _, entry := range entries {
+		if !f(entry.name, entry.records, entry.elem == nil) {
+			return
+		}
+	}
+}
+
+func (cache *dnsCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return len(cache.entries)
+}
+
+func (cache *dnsCache) evict() {
+	for cache.lru.Len() > cache.size {
+		entry := cache.lru.Remove(cache.lru.Back()).(*dnsCacheEntry)
+		delete(cache.entries, entry.name)
+	}
+}
+
+// fresh reports whether addresses may be answered from the cache at now.
+func (addresses *RecordAddresses) fresh(now int64) bool {
+	return addresses.TTL == 0 || addresses.TTL > now
+}
+
+// stale reports whether expired addresses are still within DNSServeStale.
+func (addresses *RecordAddresses) stale(now int64) bool {
+	return addresses != nil && len(addresses.Addresses) > 0 && addresses.TTL > now-DNSServeStale
+}
+
+type dnsCacheItem struct {
+	Name string   `json:"name"`
+	IPv4 []net.IP `json:"ipv4,omitempty"`
+	TTL4 int64    `json:"ttl4,omitempty"`
+	IPv6 []net.IP `json:"ipv6,omitempty"`
+	TTL6 int64    `json:"ttl6,omitempty"`
+}
+
+// SaveDNSCache writes the answers learned from upstream servers to filename,
+// static records are left to the profiles.
+func SaveDNSCache(filename string) error {
+	now := time.Now().Unix()
+	items := []dnsCacheItem{}
+	DNSCache.Range(func(name string, records *DNSRecords, pinned bool) bool {
+		if pinned {
+			return true
+		}
+		item := dnsCacheItem{Name: name}
+		records.lock.Lock()
+		if hint := records.IPv4Hint; hint != nil && hint.TTL != 0 && hint.stale(now) {
+			item.IPv4, item.TTL4 = hint.Addresses, hint.TTL
+		}
+		if hint := records.IPv6Hint; hint != nil && hint.TTL != 0 && hint.stale(now) {
+			item.IPv6, item.TTL6 = hint.Addresses, hint.TTL
+		}
+		records.lock.Unlock()
+		if item.IPv4 != nil || item.IPv6 != nil {
+			items = append(items, item)
+		}
+		return true
+	})
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// LoadDNSCacheFile reads answers saved by SaveDNSCache, names that are
+// already cached are kept as they are.
+func LoadDNSCacheFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var items []dnsCacheItem
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, item := range items {
+		if _, ok := DNSCache.Load(item.Name); ok {
+			continue
+		}
+		records := new(DNSRecords)
+		if len(item.IPv4) > 0 {
+			hint := &RecordAddresses{item.TTL4, item.IPv4}
+			if hint.stale(now) {
+				records.IPv4Hint = hint
+			}
+		}
+		if len(item.IPv6) > 0 {
+			hint := &RecordAddresses{item.TTL6, item.IPv6}
+			if hint.stale(now) {
+				records.IPv6Hint = hint
+			}
+		}
+		if records.IPv4Hint != nil || records.IPv6Hint != nil {
+			DNSCache.Store(item.Name, records)
+		}
+	}
+	logDNS.Info("cache loaded", "file", filename, "count", len(items))
+	return nil
+}
@@ -0,0 +1,255 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DNSTimeout bounds an upstream query, DNSIdleTimeout how long an upstream
+// connection is kept without queries.
+var DNSTimeout = 5 * time.Second
+var DNSIdleTimeout = 30 * time.Second
+
+var dnsSessions = tls.NewLRUClientSessionCache(64)
+
+// dnsConn pipelines queries over one TCP or TLS connection, RFC 7766.
+// Queries get IDs of the connection so that answers can come in any order.
+type dnsConn struct {
+	net.Conn
+	key   string
+	ready chan struct{}
+
+	writeLock sync.Mutex
+	sync.Mutex
+	id      uint16
+	pending map[uint16]chan []byte
+	err     error
+}
+
+var dnsConnLock sync.Mutex
+var dnsConns = make(map[string]*dnsConn)
+
+// loadDNSConn returns the connection to address, dialing one if there is
+// none. Concurrent queries wait for the same dial. reused is false for a
+// new connection.
+func loadDNSConn(network string, address string) (conn *dnsConn, reused bool, err error) {
+	key := network + "://" + address
+	dnsConnLock.Lock()
+	conn, ok := dnsConns[key]
+	if ok {
+		dnsConnLock.Unlock()
+		<-conn.ready
+		if conn.Conn == nil {
+			return nil, false, conn.err
+		}
+		return conn, true, nil
+	}
+	conn = &dnsConn{key: key, ready: make(chan struct{}), pending: make(map[uint16]chan []byte)}
+	dnsConns[key] = conn
+	dnsConnLock.Unlock()
+	defer close(conn.ready)
+
+	dialer := &net.Dialer{Timeout: DNSTimeout}
+	switch network {
+	case "tls":
+		conn.Conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: dnsSessions,
+		})
+	default:
+		conn.Conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		conn.Conn = nil
+		conn.err = err
+		dnsConnLock.Lock()
+		delete(dnsConns, key)
+		dnsConnLock.Unlock()
+		return nil, false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(DNSIdleTimeout))
+	go conn.receive()
+	return conn, false, nil
+}
+
+func (conn *dnsConn) receive() {
+	for {
+		response, err := readMessage(conn.Conn)
+		if err != nil {
+			conn.close(err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(DNSIdleTimeout))
+		if len(response) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(response)
+		conn.Lock()
+		reply, ok := conn.pending[id]
+		delete(conn.pending, id)
+		conn.Unlock()
+		if ok {
+			reply <- response
+		}
+	}
+}
+
+// close fails the pending queries and drops conn from the pool.
+func (conn *dnsConn) close(err error) {
+	conn.Lock()
+	if conn.err == nil {
+		conn.err = err
+	}
+	pending := conn.pending
+	conn.pending = make(map[uint16]chan []byte)
+	conn.Unlock()
+	for _, reply := range pending {
+		reply <- nil
+	}
+	conn.Conn.Close()
+
+	dnsConnLock.Lock()
+	if dnsConns[conn.key] == conn {
+		delete(dnsConns, conn.key)
+	}
+	dnsConnLock.Unlock()
+}
+
+func (conn *dnsConn) exchange(request []byte) ([]byte, error) {
+	reply := make(chan []byte, 1)
+	conn.Lock()
+	if conn.err != nil {
+		conn.Unlock()
+		return nil, conn.err
+	}
+	for {
+		conn.id++
+		if _, ok := conn.pending[conn.id]; !ok {
+			break
+		}
+	}
+	id := conn.id
+	conn.pending[id] = reply
+	conn.Unlock()
+	conn.SetReadDeadline(time.Now().Add(DNSIdleTimeout))
+
+	data := packMessage(request)
+	binary.BigEndian.PutUint16(data[2:], id)
+	conn.writeLock.Lock()
+	conn.SetWriteDeadline(time.Now().Add(DNSTimeout))
+	_, err := conn.Write(data)
+	conn.writeLock.Unlock()
+	if err != nil {
+		conn.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(DNSTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-reply:
+		if response == nil {
+			conn.Lock()
+			err = conn.err
+			conn.Unlock()
+			return nil, err
+		}
+		copy(response, request[:2])
+		return response, nil
+	case <-timer.C:
+		conn.Lock()
+		delete(conn.pending, id)
+		conn.Unlock()
+		return nil, errors.New("dns query timeout")
+	}
+}
+
+// pipeLookup sends request over the pooled connection to address. A query
+// that fails on a reused connection, which the server may have closed, is
+// retried once on a new one.
+func pipeLookup(network string, request []byte, address string) ([]byte, error) {
+	if len(request) < 12 {
+		return nil, errors.New("invalid request")
+	}
+	conn, reused, err := loadDNSConn(network, address)
+	if err != nil {
+		return nil, err
+	}
+	response, err := conn.exchange(request)
+	if err != nil && reused {
+		conn, _, err = loadDNSConn(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return conn.exchange(request)
+	}
+	return response, err
+}
+
+var dohLock sync.Mutex
+var dohClients = make(map[string]*http.Client)
+
+// dohClient keeps the connections to a DoH server alive, with HTTP/2 when
+// the server offers it.
+func dohClient(address string, domain string) *http.Client {
+	key := address + "/" + domain
+	dohLock.Lock()
+	defer dohLock.Unlock()
+	client, ok := dohClients[key]
+	if ok {
+		return client
+	}
+
+	dialer := &net.Dialer{Timeout: DNSTimeout}
+	client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp", address)
+			},
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         domain,
+				ClientSessionCache: dnsSessions,
+			},
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: DNSTimeout,
+			IdleConnTimeout:     DNSIdleTimeout,
+			MaxIdleConnsPerHost: 4,
+		},
+		Timeout: DNSTimeout,
+	}
+	dohClients[key] = client
+	return client
+}
+
+func dohLookup(request []byte, address string, host string, path string, domain string) ([]byte, error) {
+	u := url.URL{Scheme: "https", Host: host, Path: path}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	resp, err := dohClient(address, domain).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	logDNS.Log(LevelDump, "doh response", "server", address, "proto", resp.Proto, "status", resp.Status, "header", resp.Header)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 0xFFFF))
+}
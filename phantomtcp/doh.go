@@ -0,0 +1,233 @@
+package phantomtcp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DNS over HTTPS, RFC 8484, and the JSON API of public resolvers for
+// scripts: GET /dns-query?name=example.com&type=AAAA.
+
+var dnsTypes = map[string]uint16{
+	"A": 1, "NS": 2, "CNAME": 5, "SOA": 6, "PTR": 12, "MX": 15, "TXT": 16,
+	"AAAA": 28, "SRV": 33, "SVCB": 64, "HTTPS": 65, "CAA": 257,
+}
+
+type dohRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+type dohJSON struct {
+	Status    int         `json:"Status"`
+	TC        bool        `json:"TC"`
+	RD        bool        `json:"RD"`
+	RA        bool        `json:"RA"`
+	AD        bool        `json:"AD"`
+	CD        bool        `json:"CD"`
+	Question  []dohRecord `json:"Question"`
+	Answer    []dohRecord `json:"Answer,omitempty"`
+	Authority []dohRecord `json:"Authority,omitempty"`
+}
+
+// walkRecords calls f for the count records of msg from offset, it returns
+// the offset after them or 0 if msg is malformed.
+func walkRecords(msg []byte, offset int, count int, f func(name string, rrtype uint16, ttl uint32, dataOffset int, data []byte)) int {
+	for i := 0; i < count; i++ {
+		name, end := GetName(msg, offset)
+		if end == 0 || end+10 > len(msg) {
+			return 0
+		}
+		rrtype := binary.BigEndian.Uint16(msg[end:])
+		ttl := binary.BigEndian.Uint32(msg[end+4:])
+		dataOffset := end + 10
+		offset = dataOffset + int(binary.BigEndian.Uint16(msg[end+8:]))
+		if offset > len(msg) {
+			return 0
+		}
+		f(name, rrtype, ttl, dataOffset, msg[dataOffset:offset])
+	}
+	return offset
+}
+
+// minTTL is the lowest TTL of the answer and authority records of msg,
+// false if there are none.
+func minTTL(msg []byte) (uint32, bool) {
+	_, _, offset := GetQName(msg)
+	if offset == 0 {
+		return 0, false
+	}
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:]))
+	var min uint32
+	found := false
+	walkRecords(msg, offset, count, func(name string, rrtype uint16, ttl uint32, dataOffset int, data []byte) {
+		if !found || ttl < min {
+			min = ttl
+			found = true
+		}
+	})
+	return min, found
+}
+
+func recordData(msg []byte, rrtype uint16, dataOffset int, data []byte) string {
+	switch rrtype {
+	case 1:
+		if len(data) == 4 {
+			return net.IP(data).String()
+		}
+	case 28:
+		if len(data) == 16 {
+			return net.IP(data).String()
+		}
+	case 2, 5, 12:
+		if name, end := GetName(msg, dataOffset); end != 0 {
+			return name + "."
+		}
+	case 16:
+		var texts []string
+		for len(data) > 0 && int(data[0]) < len(data) {
+			texts = append(texts, strconv.Quote(string(data[1:1+data[0]])))
+			data = data[1+data[0]:]
+		}
+		return strings.Join(texts, " ")
+	}
+	return fmt.Sprintf("\\# %d %s", len(data), hex.EncodeToString(data))
+}
+
+func newDoHJSON(msg []byte) *dohJSON {
+	name, qtype, offset := GetQName(msg)
+	if offset == 0 {
+		return nil
+	}
+	result := &dohJSON{
+		Status:   int(msg[3] & 0x0f),
+		TC:       msg[2]&0x02 != 0,
+		RD:       msg[2]&0x01 != 0,
+		RA:       msg[3]&0x80 != 0,
+		AD:       msg[3]&0x20 != 0,
+		CD:       msg[3]&0x10 != 0,
+		Question: []dohRecord{{Name: name + ".", Type: uint16(qtype)}},
+	}
+	section := func(records *[]dohRecord) func(string, uint16, uint32, int, []byte) {
+		return func(name string, rrtype uint16, ttl uint32, dataOffset int, data []byte) {
+			*records = append(*records, dohRecord{name + ".", rrtype, ttl, recordData(msg, rrtype, dataOffset, data)})
+		}
+	}
+	offset = walkRecords(msg, offset, int(binary.BigEndian.Uint16(msg[6:])), section(&result.Answer))
+	if offset != 0 {
+		walkRecords(msg, offset, int(binary.BigEndian.Uint16(msg[8:])), section(&result.Authority))
+	}
+	return result
+}
+
+// ServerFailure is the SERVFAIL response to request.
+func ServerFailure(request []byte) []byte {
+	_, _, end := GetQName(request)
+	if end == 0 {
+		return nil
+	}
+	response := make([]byte, end)
+	copy(response, request)
+	response[2] = 0x80 | request[2]&0x01
+	response[3] = 0x82
+	binary.BigEndian.PutUint16(response[6:], 0)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	return response
+}
+
+// dohRequest reads the DNS message of req, or packs the one of a JSON API
+// query. It returns the HTTP status on errors.
+func dohRequest(req *http.Request) ([]byte, bool, int) {
+	query := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet:
+		if name := query.Get("name"); name != "" {
+			qtype, ok := dnsTypes[strings.ToUpper(query.Get("type"))]
+			if !ok {
+				n, err := strconv.ParseUint(query.Get("type"), 10, 16)
+				if err != nil && query.Get("type") != "" {
+					return nil, true, http.StatusBadRequest
+				}
+				qtype = uint16(n)
+				if qtype == 0 {
+					qtype = 1
+				}
+			}
+			request := PackRequest(strings.TrimSuffix(name, "."), qtype, 0, "")
+			if query.Get("cd") == "1" || query.Get("cd") == "true" {
+				request[3] |= 0x10
+			}
+			if query.Get("do") == "1" || query.Get("do") == "true" {
+				request = (&EDNS{UDPSize: EDNSSize, Flags: EDNS_DO}).AppendTo(request)
+			}
+			return request, true, http.StatusOK
+		}
+		request, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(query.Get("dns"), "="))
+		if err != nil || len(request) == 0 {
+			return nil, false, http.StatusBadRequest
+		}
+		return request, false, http.StatusOK
+	case http.MethodPost:
+		mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediatype != "application/dns-message" {
+			return nil, false, http.StatusUnsupportedMediaType
+		}
+		request, err := io.ReadAll(io.LimitReader(req.Body, 0x10000))
+		if err != nil {
+			return nil, false, http.StatusBadRequest
+		}
+		if len(request) > 0xFFFF {
+			return nil, false, http.StatusRequestEntityTooLarge
+		}
+		return request, false, http.StatusOK
+	}
+	return nil, false, http.StatusMethodNotAllowed
+}
+
+func DoHServer(w http.ResponseWriter, req *http.Request) {
+	request, isJSON, status := dohRequest(req)
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "GET, POST")
+	}
+	if _, _, end := GetQName(request); status == http.StatusOK && end == 0 {
+		status = http.StatusBadRequest
+	}
+	if status != http.StatusOK {
+		logDNS.Debug("bad doh request", "client", req.RemoteAddr, "method", req.Method, "status", status)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	isJSON = isJSON || strings.Contains(req.Header.Get("Accept"), "application/dns-json")
+
+	_, response := NSRequest(request, true)
+	if len(response) == 0 {
+		response = ServerFailure(request)
+		if response == nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if ttl, ok := minTTL(response); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	if isJSON {
+		w.Header().Set("Content-Type", "application/dns-json")
+		json.NewEncoder(w).Encode(newDoHJSON(response))
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(response)
+}
@@ -0,0 +1,133 @@
+package phantomtcp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DNS over QUIC, RFC 9250. Every query has a stream of its own and a
+// message ID of 0.
+const (
+	DOQ_NO_ERROR       = 0x0
+	DOQ_INTERNAL_ERROR = 0x1
+	DOQ_PROTOCOL_ERROR = 0x2
+)
+
+// DoQTimeout bounds a DoQ exchange, DoQIdleTimeout how long a client
+// connection is kept without queries.
+var DoQTimeout = 5 * time.Second
+var DoQIdleTimeout = 30 * time.Second
+
+// readMessage reads a DNS message with a 2 byte length prefix.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// packMessage prefixes msg with its length.
+func packMessage(msg []byte) []byte {
+	data := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(data, uint16(len(msg)))
+	copy(data[2:], msg)
+	return data
+}
+
+func QUIClookup(request []byte, address string, domain string) ([]byte, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+		address = net.JoinHostPort(address, "853")
+	}
+	if domain == "" {
+		domain = host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DoQTimeout)
+	defer cancel()
+	conf := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         domain,
+		NextProtos:         []string{"doq"},
+	}
+	conn, err := quic.DialAddr(ctx, address, conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.CloseWithError(DOQ_NO_ERROR, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(DoQTimeout))
+
+	data := packMessage(request)
+	binary.BigEndian.PutUint16(data[2:], 0)
+	_, err = stream.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	response, err := readMessage(stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	copy(response, request[:2])
+	return response, nil
+}
+
+// DoQServer answers the queries of a DoQ client connection.
+func DoQServer(conn quic.Connection) {
+	defer conn.CloseWithError(DOQ_NO_ERROR, "")
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func(stream quic.Stream) {
+			stream.SetDeadline(time.Now().Add(DoQTimeout))
+			request, err := readMessage(stream)
+			if err != nil || len(request) < 12 {
+				logDNS.Debug("bad doq request", "client", conn.RemoteAddr(), "error", err)
+				stream.CancelRead(DOQ_PROTOCOL_ERROR)
+				stream.CancelWrite(DOQ_PROTOCOL_ERROR)
+				return
+			}
+			if binary.BigEndian.Uint16(request) != 0 {
+				// RFC 9250 4.2.1, a message ID other than 0 is a protocol
+				// error of the connection
+				logDNS.Debug("bad doq message id", "client", conn.RemoteAddr(), "id", binary.BigEndian.Uint16(request))
+				conn.CloseWithError(DOQ_PROTOCOL_ERROR, "")
+				return
+			}
+
+			_, response := NSRequest(request, true)
+			if len(response) == 0 {
+				stream.CancelRead(DOQ_INTERNAL_ERROR)
+				stream.CancelWrite(DOQ_INTERNAL_ERROR)
+				return
+			}
+			stream.Write(packMessage(response))
+			stream.Close()
+		}(stream)
+	}
+}
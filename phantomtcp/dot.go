@@ -0,0 +1,63 @@
+package phantomtcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DoTIdleTimeout is how long a DoT client connection is kept without
+// queries, DoTPending how many of its queries are answered at once.
+var DoTIdleTimeout = 30 * time.Second
+var DoTPending = 64
+
+// DoTServer answers the length prefixed queries of a DNS over TLS client
+// connection, RFC 7858. Queries are pipelined, so answers go out in the
+// order they are ready, not the order they came in.
+func DoTServer(client net.Conn) {
+	defer client.Close()
+
+	var writeLock sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(chan struct{}, DoTPending)
+	for {
+		client.SetReadDeadline(time.Now().Add(DoTIdleTimeout))
+		request, err := readMessage(client)
+		if err != nil {
+			break
+		}
+		if len(request) < 12 {
+			logDNS.Debug("bad dot request", "client", client.RemoteAddr())
+			break
+		}
+
+		pending <- struct{}{}
+		wg.Add(1)
+		go func(request []byte) {
+			defer func() {
+				<-pending
+				wg.Done()
+			}()
+			_, response := NSRequest(request, true)
+			if len(response) == 0 {
+				response = ServerFailure(request)
+				if response == nil {
+					return
+				}
+			}
+			if len(response) > 0xFFFF {
+				return
+			}
+
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			client.SetWriteDeadline(time.Now().Add(DNSTimeout))
+			_, err := client.Write(packMessage(response))
+			if err != nil {
+				client.Close()
+			}
+		}(request)
+	}
+	// the client may close its side and still wait for the answers
+	wg.Wait()
+}
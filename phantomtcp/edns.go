@@ -0,0 +1,249 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EDNSSize is the UDP payload size advertised to clients and upstream
+// servers, the size recommended by DNS flag day 2020.
+const EDNSSize = 1232
+
+// EDNSMaxOptions bounds the option data of a client forwarded upstream.
+const EDNSMaxOptions = 512
+
+const (
+	EDNS_DO = 0x8000
+
+	EDNS_ECS     = 8
+	EDNS_COOKIE  = 10
+	EDNS_PADDING = 12
+)
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// EDNS is the OPT pseudo-record of a message, RFC 6891.
+type EDNS struct {
+	UDPSize uint16
+	Flags   uint16
+	Options []EDNSOption
+}
+
+// findEDNS returns the start and the end of the OPT record of msg, offset
+// is the end of the question section. The end is 0 if there is none.
+func findEDNS(msg []byte, offset int) (int, int) {
+	if len(msg) < 12 {
+		return 0, 0
+	}
+	count := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < count; i++ {
+		start := offset
+		offset = GetNameOffset(msg, offset)
+		if offset == 0 || offset+10 > len(msg) {
+			return 0, 0
+		}
+		rrtype := binary.BigEndian.Uint16(msg[offset:])
+		end := offset + 10 + int(binary.BigEndian.Uint16(msg[offset+8:]))
+		if end > len(msg) {
+			return 0, 0
+		}
+		if rrtype == 41 {
+			return start, end
+		}
+		offset = end
+	}
+	return 0, 0
+}
+
+// GetEDNS parses the OPT record of msg, nil if there is none.
+func GetEDNS(msg []byte, offset int) *EDNS {
+	start, end := findEDNS(msg, offset)
+	if end == 0 {
+		return nil
+	}
+	rr := msg[GetNameOffset(msg, start):end]
+	edns := &EDNS{
+		UDPSize: binary.BigEndian.Uint16(rr[2:]),
+		Flags:   binary.BigEndian.Uint16(rr[6:]),
+	}
+	data := rr[10:]
+	for len(data) >= 4 {
+		code := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if 4+length > len(data) {
+			break
+		}
+		edns.Options = append(edns.Options, EDNSOption{code, append([]byte{}, data[4:4+length]...)})
+		data = data[4+length:]
+	}
+	return edns
+}
+
+// StripEDNS returns msg without its OPT record.
+func StripEDNS(msg []byte) []byte {
+	_, _, offset := GetQName(msg)
+	if offset == 0 {
+		return msg
+	}
+	start, end := findEDNS(msg, offset)
+	if end == 0 {
+		return msg
+	}
+	stripped := make([]byte, len(msg)-(end-start))
+	copy(stripped, msg[:start])
+	copy(stripped[start:], msg[end:])
+	binary.BigEndian.PutUint16(stripped[10:], binary.BigEndian.Uint16(stripped[10:])-1)
+	return stripped
+}
+
+func (edns *EDNS) Option(code uint16) (EDNSOption, bool) {
+	for _, opt := range edns.Options {
+		if opt.Code == code {
+			return opt, true
+		}
+	}
+	return EDNSOption{}, false
+}
+
+func (edns *EDNS) length() int {
+	length := 11
+	for _, opt := range edns.Options {
+		length += 4 + len(opt.Data)
+	}
+	return length
+}
+
+// Pad adds a padding option so that a message of msgLen bytes with the
+// OPT record is a multiple of block, RFC 7830.
+func (edns *EDNS) Pad(msgLen int, block int) {
+	length := msgLen + edns.length() + 4
+	padding := (block - length%block) % block
+	edns.Options = append(edns.Options, EDNSOption{EDNS_PADDING, make([]byte, padding)})
+}
+
+// AppendTo returns a copy of msg with the OPT record added.
+func (edns *EDNS) AppendTo(msg []byte) []byte {
+	length := edns.length()
+	packed := make([]byte, len(msg)+length)
+	copy(packed, msg)
+	binary.BigEndian.PutUint16(packed[10:], binary.BigEndian.Uint16(packed[10:])+1) //ARCount
+
+	rr := packed[len(msg):]
+	rr[0] = 0                                             // Name
+	binary.BigEndian.PutUint16(rr[1:], 41)                // Type
+	binary.BigEndian.PutUint16(rr[3:], edns.UDPSize)      // UDP Payload
+	rr[5] = 0                                             // Extended RCODE
+	rr[6] = 0                                             // Version
+	binary.BigEndian.PutUint16(rr[7:], edns.Flags)        // Flags
+	binary.BigEndian.PutUint16(rr[9:], uint16(length-11)) // Length
+	offset := 11
+	for _, opt := range edns.Options {
+		binary.BigEndian.PutUint16(rr[offset:], opt.Code)
+		binary.BigEndian.PutUint16(rr[offset+2:], uint16(len(opt.Data)))
+		copy(rr[offset+4:], opt.Data)
+		offset += 4 + len(opt.Data)
+	}
+	return packed
+}
+
+// ECSOption packs the client subnet option, RFC 7871, of ecs, an address
+// with an optional prefix length that is /24 or /56 by default.
+func ECSOption(ecs string) (EDNSOption, bool) {
+	prefix := -1
+	if i := strings.IndexByte(ecs, '/'); i >= 0 {
+		var err error
+		prefix, err = strconv.Atoi(ecs[i+1:])
+		if err != nil || prefix < 0 {
+			return EDNSOption{}, false
+		}
+		ecs = ecs[:i]
+	}
+	ip := net.ParseIP(ecs)
+	if ip == nil {
+		return EDNSOption{}, false
+	}
+
+	family, bits := 2, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		family, bits = 1, 32
+		if prefix < 0 {
+			prefix = 24
+		}
+	} else if prefix < 0 {
+		prefix = 56
+	}
+	if prefix > bits {
+		return EDNSOption{}, false
+	}
+
+	addr := ip.Mask(net.CIDRMask(prefix, bits))[:(prefix+7)/8]
+	data := make([]byte, 4+len(addr))
+	binary.BigEndian.PutUint16(data, uint16(family)) // Family
+	data[2] = byte(prefix)                           // Source Netmask
+	data[3] = 0                                      // Scope Netmask
+	copy(data[4:], addr)
+	return EDNSOption{EDNS_ECS, data}, true
+}
+
+// upstreamEDNS is the OPT record forwarded for a client request with edns,
+// nil if neither has one. The subnet of ecs replaces the one of the client.
+// Cookies and padding are per hop, RFC 7873 and RFC 7830, so those of the
+// client stay here, and options past EDNSMaxOptions bytes are dropped.
+func upstreamEDNS(edns *EDNS, ecs string) *EDNS {
+	subnet, ok := ECSOption(ecs)
+	if edns == nil {
+		if !ok {
+			return nil
+		}
+		return &EDNS{UDPSize: EDNSSize, Options: []EDNSOption{subnet}}
+	}
+
+	upstream := &EDNS{UDPSize: edns.UDPSize, Flags: edns.Flags & EDNS_DO}
+	if upstream.UDPSize > EDNSSize {
+		upstream.UDPSize = EDNSSize
+	} else if upstream.UDPSize < 512 {
+		upstream.UDPSize = 512
+	}
+	length := 0
+	for _, opt := range edns.Options {
+		switch {
+		case opt.Code == EDNS_COOKIE, opt.Code == EDNS_PADDING:
+			continue
+		case ok && opt.Code == EDNS_ECS:
+			continue
+		case length+4+len(opt.Data) > EDNSMaxOptions:
+			continue
+		}
+		length += 4 + len(opt.Data)
+		upstream.Options = append(upstream.Options, opt)
+	}
+	if ok {
+		upstream.Options = append(upstream.Options, subnet)
+	}
+	return upstream
+}
+
+// replyEDNS is the OPT record of the response to a request with edns. The
+// DO bit and the client subnet are echoed, with scope 0 since answers are
+// cached for every subnet, and padded responses go to blocks of 468 bytes
+// as RFC 8467 recommends.
+func replyEDNS(edns *EDNS, msgLen int) *EDNS {
+	reply := &EDNS{UDPSize: EDNSSize, Flags: edns.Flags & EDNS_DO}
+	if subnet, ok := edns.Option(EDNS_ECS); ok && len(subnet.Data) >= 4 {
+		data := append([]byte{}, subnet.Data...)
+		data[3] = 0
+		reply.Options = append(reply.Options, EDNSOption{EDNS_ECS, data})
+	}
+	if _, ok := edns.Option(EDNS_PADDING); ok {
+		reply.Pad(msgLen, 468)
+	}
+	return reply
+}
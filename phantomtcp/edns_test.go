@@ -0,0 +1,99 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUpstreamEDNS(t *testing.T) {
+	subnet, _ := ECSOption("192.0.2.1")
+	cookie := EDNSOption{EDNS_COOKIE, []byte("8 bytes!")}
+	padding := EDNSOption{EDNS_PADDING, make([]byte, 100)}
+	other := EDNSOption{65001, []byte{1}}
+	large := EDNSOption{65002, make([]byte, EDNSMaxOptions)}
+	tests := []struct {
+		name    string
+		edns    *EDNS
+		ecs     string
+		options []uint16
+	}{
+		{"none", nil, "", nil},
+		{"ecs only", nil, "192.0.2.1", []uint16{EDNS_ECS}},
+		{"client subnet", &EDNS{UDPSize: 4096, Options: []EDNSOption{subnet}}, "", []uint16{EDNS_ECS}},
+		{"ecs replaces subnet", &EDNS{UDPSize: 4096, Options: []EDNSOption{subnet, other}}, "198.51.100.1", []uint16{65001, EDNS_ECS}},
+		{"cookie and padding", &EDNS{UDPSize: 4096, Options: []EDNSOption{cookie, other, padding}}, "", []uint16{65001}},
+		{"oversized option", &EDNS{UDPSize: 4096, Options: []EDNSOption{large, other}}, "", []uint16{65001}},
+	}
+	for _, tt := range tests {
+		upstream := upstreamEDNS(tt.edns, tt.ecs)
+		if upstream == nil {
+			if tt.options != nil {
+				t.Errorf("%s: no OPT record", tt.name)
+			}
+			continue
+		}
+		var codes []uint16
+		for _, opt := range upstream.Options {
+			codes = append(codes, opt.Code)
+		}
+		if len(codes) != len(tt.options) {
+			t.Errorf("%s: got options %v, want %v", tt.name, codes, tt.options)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != tt.options[i] {
+				t.Errorf("%s: got options %v, want %v", tt.name, codes, tt.options)
+				break
+			}
+		}
+		if upstream.UDPSize > EDNSSize || upstream.length()-11 > EDNSMaxOptions+4+8 {
+			t.Errorf("%s: size %d, %d bytes of options", tt.name, upstream.UDPSize, upstream.length()-11)
+		}
+	}
+}
+
+// A request with an oversized option stays within the forwarded bounds,
+// and a TCP query of more than 1022 bytes is sent whole.
+func TestTCPlookupLarge(t *testing.T) {
+	request := PackRequest("example.com", 1, 0x1234, "")
+	edns := &EDNS{UDPSize: 4096, Options: []EDNSOption{{65001, make([]byte, 2000)}}}
+	if n := len(upstreamEDNS(edns, "").AppendTo(request)); n > len(request)+11+EDNSMaxOptions {
+		t.Errorf("forwarded request has %d bytes", n)
+	}
+	request = edns.AppendTo(request)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length uint16
+		if binary.Read(conn, binary.BigEndian, &length) != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		query[2] |= 0x80
+		binary.Write(conn, binary.BigEndian, length)
+		conn.Write(query)
+	}()
+
+	response, err := TCPlookup(request, l.Addr().String(), &PhantomInterface{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != len(request) || !bytes.Equal(response[3:], request[3:]) {
+		t.Errorf("got %d bytes, want %d", len(response), len(request))
+	}
+}
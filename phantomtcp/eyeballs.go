@@ -0,0 +1,173 @@
+package phantomtcp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionAttemptDelay is the head start an address gets before the next
+// one is tried, RFC 8305 recommends 250ms.
+var ConnectionAttemptDelay = 250 * time.Millisecond
+
+// An address that failed addrPenaltyFailures times in a row is tried last
+// for addrPenaltyTime.
+const (
+	addrPenaltyFailures = 2
+	addrPenaltyTime     = time.Minute
+	addrFailuresMax     = 4096
+)
+
+type addrFailure struct {
+	count int
+	until time.Time
+}
+
+var addrFailuresLock sync.Mutex
+var addrFailures = make(map[string]*addrFailure)
+
+func addrFailed(ip net.IP) {
+	now := time.Now()
+	addrFailuresLock.Lock()
+	defer addrFailuresLock.Unlock()
+	failure, ok := addrFailures[ip.String()]
+	if !ok {
+		if len(addrFailures) >= addrFailuresMax {
+			for key, f := range addrFailures {
+				if f.until.Before(now) {
+					delete(addrFailures, key)
+				}
+			}
+		}
+		failure = &addrFailure{}
+		addrFailures[ip.String()] = failure
+	}
+	failure.count++
+	failure.until = now.Add(addrPenaltyTime)
+}
+
+func addrSucceeded(ip net.IP) {
+	addrFailuresLock.Lock()
+	delete(addrFailures, ip.String())
+	addrFailuresLock.Unlock()
+}
+
+func addrPenalized(ip net.IP, now time.Time) bool {
+	addrFailuresLock.Lock()
+	defer addrFailuresLock.Unlock()
+	failure, ok := addrFailures[ip.String()]
+	return ok && failure.count >= addrPenaltyFailures && now.Before(failure.until)
+}
+
+// sortAddresses interleaves the address families, starting with the family
+// of the first address, and moves penalized addresses to the end.
+func sortAddresses(raddrs []*net.TCPAddr) []*net.TCPAddr {
+	now := time.Now()
+	var families [2][]*net.TCPAddr
+	var penalized []*net.TCPAddr
+	first := -1
+	for _, raddr := range raddrs {
+		family := 0
+		if raddr.IP.To4() == nil {
+			family = 1
+		}
+		if first == -1 {
+			first = family
+		}
+		if addrPenalized(raddr.IP, now) {
+			penalized = append(penalized, raddr)
+			continue
+		}
+		families[family] = append(families[family], raddr)
+	}
+	for _, addrs := range families {
+		rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	}
+
+	sorted := make([]*net.TCPAddr, 0, len(raddrs))
+	a, b := families[first&1], families[(first+1)&1]
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if i < len(a) {
+			sorted = append(sorted, a[i])
+		}
+		if i < len(b) {
+			sorted = append(sorted, b[i])
+		}
+	}
+	return append(sorted, penalized...)
+}
+
+type dialResult struct {
+	raddr *net.TCPAddr
+	conn  net.Conn
+	info  *ConnectionInfo
+	err   error
+}
+
+// dialRace connects to raddrs as in RFC 8305: attempts are started
+// ConnectionAttemptDelay apart, or as soon as the previous one fails,
+// and the first connection established wins. The others are closed.
+// Without race an attempt starts only when the previous one failed, for
+// dials that carry data in the SYN, a TFO payload must not go to several
+// servers.
+func dialRace(raddrs []*net.TCPAddr, race bool, dial func(raddr *net.TCPAddr) (net.Conn, *ConnectionInfo, error)) (net.Conn, *ConnectionInfo, error) {
+	if len(raddrs) == 0 {
+		return nil, nil, errors.New("no address")
+	}
+	raddrs = sortAddresses(raddrs)
+	results := make(chan dialResult, len(raddrs))
+	next := 0
+	pending := 0
+	var delay <-chan time.Time
+	start := func() {
+		raddr := raddrs[next]
+		next++
+		pending++
+		go func() {
+			conn, info, err := dial(raddr)
+			results <- dialResult{raddr, conn, info, err}
+		}()
+		delay = nil
+		if race && next < len(raddrs) {
+			delay = time.After(ConnectionAttemptDelay)
+		}
+	}
+
+	start()
+	var err error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				addrSucceeded(result.raddr.IP)
+				go dialDiscard(results, pending)
+				return result.conn, result.info, nil
+			}
+			addrFailed(result.raddr.IP)
+			logCore.Debug("dial failed", "server", result.raddr, "error", result.err)
+			err = result.err
+			if next < len(raddrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, nil, err
+}
+
+// dialDiscard closes the connections that lost the race.
+func dialDiscard(results chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-results
+		if result.err != nil {
+			addrFailed(result.raddr.IP)
+			continue
+		}
+		addrSucceeded(result.raddr.IP)
+		result.conn.Close()
+	}
+}
@@ -0,0 +1,43 @@
+package phantomtcp
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Without race, a dial that carries a TFO payload, attempts never overlap.
+func TestDialRaceSerial(t *testing.T) {
+	defer func(delay time.Duration) { ConnectionAttemptDelay = delay }(ConnectionAttemptDelay)
+	ConnectionAttemptDelay = time.Millisecond
+
+	raddrs := []*net.TCPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 443},
+		{IP: net.IPv4(192, 0, 2, 3), Port: 443},
+	}
+	for _, race := range []bool{true, false} {
+		var inflight, most, attempts int32
+		_, _, err := dialRace(raddrs, race, func(raddr *net.TCPAddr) (net.Conn, *ConnectionInfo, error) {
+			n := atomic.AddInt32(&inflight, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			atomic.AddInt32(&attempts, 1)
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&inflight, -1)
+			return nil, nil, errors.New("refused")
+		})
+		if err == nil || attempts != 3 {
+			t.Errorf("race %v: %d attempts, error %v", race, attempts, err)
+		}
+		if race && most < 2 || !race && most != 1 {
+			t.Errorf("race %v: %d attempts at once", race, most)
+		}
+	}
+}
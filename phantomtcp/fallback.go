@@ -0,0 +1,135 @@
+package phantomtcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// The fallback-wait and fallback-time of a profile that does not set them.
+const (
+	fallbackWait = 3 * time.Second
+	fallbackTime = 10 * time.Minute
+)
+
+type fallbackWinner struct {
+	name  string
+	until time.Time
+}
+
+var fallbackLock sync.Mutex
+var fallbackWinners = make(map[string]fallbackWinner)
+
+const fallbackWinnersMax = 4096
+
+func loadFallback(domain string) string {
+	fallbackLock.Lock()
+	defer fallbackLock.Unlock()
+	winner, ok := fallbackWinners[domain]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(winner.until) {
+		delete(fallbackWinners, domain)
+		return ""
+	}
+	return winner.name
+}
+
+func storeFallback(domain string, name string, keep time.Duration) {
+	now := time.Now()
+	fallbackLock.Lock()
+	defer fallbackLock.Unlock()
+	if name == "" {
+		delete(fallbackWinners, domain)
+		return
+	}
+	if len(fallbackWinners) >= fallbackWinnersMax {
+		for key, winner := range fallbackWinners {
+			if now.After(winner.until) {
+				delete(fallbackWinners, key)
+			}
+		}
+	}
+	fallbackWinners[domain] = fallbackWinner{name, now.Add(keep)}
+}
+
+// rememberFallback keeps p for domain, the head of the chain is the default.
+func rememberFallback(domain string, head *PhantomInterface, p *PhantomInterface, keep time.Duration) {
+	if p == head {
+		storeFallback(domain, "", keep)
+	} else {
+		storeFallback(domain, p.Name, keep)
+	}
+}
+
+// Chain returns pface followed by its fallback interfaces.
+func (pface *PhantomInterface) Chain() []*PhantomInterface {
+	var chain []*PhantomInterface
+	for p := pface; p != nil; p = p.Fallback {
+		chain = append(chain, p)
+	}
+	return chain
+}
+
+// prefixConn replays the bytes read while checking a connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *prefixConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(b, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(b)
+}
+
+// dialFallback sends header through the chain of pface until the server
+// answers within the fallback-wait of the profile of user, starting with
+// the interface that worked last time for domain. The last one tried is
+// not waited for. The chain comes from user.GetInterface and holds the
+// allowed interfaces only.
+func dialFallback(pface *PhantomInterface, domain string, port int, header []byte, user *ProxyUser, source string) (net.Conn, *PhantomInterface, error) {
+	profile := user.profile()
+	chain := pface.Chain()
+	order := chain
+	if winner := loadFallback(domain); winner != "" {
+		for i, p := range chain {
+			if p.Name == winner {
+				order = append([]*PhantomInterface{p}, append(chain[:i:i], chain[i+1:]...)...)
+				break
+			}
+		}
+	}
+
+	err := errors.New("no interface")
+	for i, p := range order {
+		logRedirect.Info("redirect", "client", source, "domain", domain, "port", port, "interface", p)
+		var conn net.Conn
+		conn, _, err = p.Dial(domain, port, header)
+		if err != nil {
+			logRedirect.Error("dial", "client", source, "domain", domain, "port", port, "interface", p, "error", err)
+			continue
+		}
+		if i == len(order)-1 {
+			rememberFallback(domain, chain[0], p, profile.FallbackTime)
+			return conn, p, nil
+		}
+
+		b := make([]byte, 1460)
+		conn.SetReadDeadline(time.Now().Add(profile.FallbackWait))
+		n, err := conn.Read(b)
+		conn.SetReadDeadline(time.Time{})
+		if n > 0 {
+			rememberFallback(domain, chain[0], p, profile.FallbackTime)
+			return &prefixConn{conn, b[:n]}, p, nil
+		}
+		conn.Close()
+		logRedirect.Error("no answer, falling back", "client", source, "domain", domain, "port", port, "interface", p, "error", err)
+	}
+	return nil, pface, err
+}
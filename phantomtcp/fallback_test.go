@@ -0,0 +1,85 @@
+package phantomtcp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testChainProfile(t *testing.T, conf string) *PhantomProfile {
+	dns := "udp://127.0.0.1:53"
+	profile := NewProfile(map[string]PhantomInterface{
+		"a": {Name: "a", DNS: dns},
+		"b": {Name: "b", DNS: dns},
+		"c": {Name: "c", DNS: dns},
+	})
+	err := profile.Load(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func TestGetInterfaceChain(t *testing.T) {
+	profile := testChainProfile(t, "[a,b,c]\nexample.com\n")
+	tests := []struct {
+		interfaces []string
+		chain      string
+		ok         bool
+	}{
+		{nil, "a,b,c", true},
+		{[]string{"a", "b", "c"}, "a,b,c", true},
+		{[]string{"b", "c"}, "b,c", true},
+		{[]string{"a", "c"}, "a,c", true},
+		{[]string{"c"}, "c", true},
+		{[]string{"x"}, "", false},
+	}
+	for _, tt := range tests {
+		user := &ProxyUser{Name: "u", Profile: profile, Interfaces: tt.interfaces}
+		pface, ok := user.GetInterface("example.com")
+		var names []string
+		if pface != nil {
+			for _, p := range pface.Chain() {
+				names = append(names, p.Name)
+			}
+		}
+		if ok != tt.ok || strings.Join(names, ",") != tt.chain {
+			t.Errorf("%v: got %v %v, want %q %v", tt.interfaces, names, ok, tt.chain, tt.ok)
+		}
+	}
+
+	// the chain of the profile is left alone
+	if got := len(profile.GetInterface("example.com").Chain()); got != 3 {
+		t.Errorf("profile chain has %d interfaces", got)
+	}
+}
+
+func TestFallbackOptions(t *testing.T) {
+	profile := testChainProfile(t, "fallback-wait=500\nfallback-time=60\n")
+	if profile.FallbackWait != 500*time.Millisecond || profile.FallbackTime != time.Minute {
+		t.Errorf("got %v %v", profile.FallbackWait, profile.FallbackTime)
+	}
+	other := testChainProfile(t, "")
+	if other.FallbackWait != fallbackWait || other.FallbackTime != fallbackTime {
+		t.Errorf("other profile got %v %v", other.FallbackWait, other.FallbackTime)
+	}
+}
+
+// Rules added or removed at run time keep the fallback options.
+func TestUpdateProfileFallback(t *testing.T) {
+	SetProfile(testChainProfile(t, "fallback-wait=500\nfallback-time=60\n[a,b,c]\nexample.com\n"))
+	if err := AddRule("example.org", "b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveRule("example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := DefaultProfile()
+	if profile.FallbackWait != 500*time.Millisecond || profile.FallbackTime != time.Minute {
+		t.Errorf("got %v %v", profile.FallbackWait, profile.FallbackTime)
+	}
+	if got := len(profile.GetInterface("example.com").Chain()); got != 3 {
+		t.Errorf("chain has %d interfaces", got)
+	}
+}
@@ -0,0 +1,596 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxHTTPHeadSize = 65536
+
+var hopHeaders = map[string]bool{
+	"connection":          true,
+	"proxy-connection":    true,
+	"keep-alive":          true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"te":                  true,
+	"trailer":             true,
+	"upgrade":             true,
+}
+
+type phantomWriter struct {
+	pface       *PhantomInterface
+	conn        net.Conn
+	info        *ConnectionInfo
+	fakepayload []byte
+}
+
+func (w *phantomWriter) Write(b []byte) (int, error) {
+	if w.info != nil {
+		err := w.pface.SendPacket(w.info, w.fakepayload, w.pface.Hint, w.pface.FakeTTL(w.info), 2)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.conn.Write(b)
+	if w.info != nil {
+		w.info.TCP.Seq += uint32(n)
+	}
+	return n, err
+}
+
+type httpUpstream struct {
+	key    string
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func (upstream *httpUpstream) Close() {
+	if upstream != nil {
+		upstream.conn.Close()
+	}
+}
+
+// DialHTTP sends a plain HTTP request header through the interface.
+// The returned conn is nil if the request has been answered with a redirect.
+func (pface *PhantomInterface) DialHTTP(client net.Conn, domain string, port int, header []byte) (net.Conn, *ConnectionInfo, error) {
+	if pface.Hint&HINT_HTTP3 != 0 {
+		HttpMove(client, "h3", header)
+		return nil, nil, nil
+	} else if pface.Hint&HINT_HTTPS != 0 {
+		HttpMove(client, "https", header)
+		return nil, nil, nil
+	} else if pface.Hint&HINT_MOVE != 0 {
+		HttpMove(client, pface.Address, header)
+		return nil, nil, nil
+	} else if pface.Hint&HINT_STRIP != 0 {
+		var conn net.Conn
+		var err error
+		if pface.Hint&HINT_FRONTING != 0 {
+			conn, err = pface.DialStrip(domain, "")
+		} else {
+			conn, err = pface.DialStrip(domain, domain)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = conn.Write(header)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		return conn, nil, nil
+	}
+
+	return pface.Dial(domain, port, header)
+}
+
+func ReadHTTPHead(br *bufio.Reader) ([]string, error) {
+	var lines []string
+	size := 0
+	var partial []byte
+	for {
+		slice, err := br.ReadSlice('\n')
+		size += len(slice)
+		if size > maxHTTPHeadSize {
+			return nil, errors.New("http header too large")
+		}
+		if err == bufio.ErrBufferFull {
+			partial = append(partial, slice...)
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && (len(lines) > 0 || size > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		line := strings.TrimRight(string(append(partial, slice...)), "\r\n")
+		partial = nil
+		if line == "" {
+			if len(lines) == 0 {
+				continue // tolerate empty lines between requests
+			}
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func splitHeader(line string) (string, string) {
+	field := strings.SplitN(line, ":", 2)
+	if len(field) < 2 {
+		return strings.TrimSpace(field[0]), ""
+	}
+	return strings.TrimSpace(field[0]), strings.TrimSpace(field[1])
+}
+
+func headerTokens(headers []string, name string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, line := range headers {
+		key, value := splitHeader(line)
+		if strings.EqualFold(key, name) {
+			for _, token := range strings.Split(value, ",") {
+				token = strings.ToLower(strings.TrimSpace(token))
+				if token != "" {
+					tokens[token] = true
+				}
+			}
+		}
+	}
+	return tokens
+}
+
+func hasHeader(headers []string, name string) bool {
+	for _, line := range headers {
+		key, _ := splitHeader(line)
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyLength returns the length of the message body, -1 for a chunked body.
+// A Transfer-Encoding ending in chunked is chunked, RFC 7230 3.3.3. A
+// response with other codings runs until the connection closes, 0 is
+// returned for it as for a response without a length. Messages that two
+// ends could frame differently are refused: a request whose codings do not
+// end in chunked, chunked applied twice, a Transfer-Encoding with a
+// Content-Length as well, or Content-Lengths that disagree.
+func bodyLength(headers []string, response bool) (int64, error) {
+	var length int64 = -1
+	var codings []string
+	for _, line := range headers {
+		key, value := splitHeader(line)
+		if strings.EqualFold(key, "Transfer-Encoding") {
+			for _, coding := range strings.Split(value, ",") {
+				codings = append(codings, strings.ToLower(strings.TrimSpace(coding)))
+			}
+		} else if strings.EqualFold(key, "Content-Length") {
+			n, err := strconv.ParseUint(value, 10, 63)
+			if err != nil || (length >= 0 && int64(n) != length) {
+				return 0, errors.New("invalid content length")
+			}
+			length = int64(n)
+		}
+	}
+	if codings != nil {
+		if length >= 0 {
+			return 0, errors.New("transfer encoding with content length")
+		}
+		for _, coding := range codings[:len(codings)-1] {
+			if coding == "chunked" {
+				return 0, errors.New("chunked is not the final transfer encoding")
+			}
+		}
+		if codings[len(codings)-1] == "chunked" {
+			return -1, nil
+		}
+		if !response {
+			return 0, errors.New("unsupported transfer encoding")
+		}
+		return 0, nil
+	}
+	if length < 0 {
+		return 0, nil
+	}
+	return length, nil
+}
+
+// filterHeaders removes the hop-by-hop headers and the headers named in Connection.
+func filterHeaders(headers []string, keep ...string) []string {
+	connTokens := headerTokens(headers, "Connection")
+	var filtered []string
+	for _, line := range headers {
+		key, _ := splitHeader(line)
+		lkey := strings.ToLower(key)
+		kept := false
+		for _, k := range keep {
+			if lkey == k {
+				kept = true
+			}
+		}
+		if !kept && (hopHeaders[lkey] || connTokens[lkey]) {
+			continue
+		}
+		filtered = append(filtered, line)
+	}
+	return filtered
+}
+
+func copyChunked(w io.Writer, br *bufio.Reader) error {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, line)
+		if err != nil {
+			return err
+		}
+
+		size := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		length, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || length < 0 {
+			return errors.New("invalid chunk size")
+		}
+
+		if length == 0 {
+			for {
+				line, err = br.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(w, line)
+				if err != nil {
+					return err
+				}
+				if line == "\r\n" || line == "\n" {
+					return nil
+				}
+			}
+		}
+
+		_, err = io.CopyN(w, br, length+2)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func copyBody(w io.Writer, br *bufio.Reader, length int64) error {
+	if length < 0 {
+		return copyChunked(w, br)
+	}
+	if length > 0 {
+		_, err := io.CopyN(w, br, length)
+		return err
+	}
+	return nil
+}
+
+func parseRequestTarget(uri string, headers []string) (host string, port int, path string, ok bool) {
+	if len(uri) > 7 && strings.EqualFold(uri[:7], "http://") {
+		authority := uri[7:]
+		path = "/"
+		index := strings.IndexAny(authority, "/?")
+		if index != -1 {
+			path = authority[index:]
+			if path[0] == '?' {
+				path = "/" + path
+			}
+			authority = authority[:index]
+		}
+		if at := strings.LastIndexByte(authority, '@'); at != -1 {
+			authority = authority[at+1:]
+		}
+		host, port = splitHostPort(authority)
+	} else if strings.HasPrefix(uri, "/") {
+		path = uri
+		for _, line := range headers {
+			key, value := splitHeader(line)
+			if strings.EqualFold(key, "Host") {
+				host, port = splitHostPort(value)
+				break
+			}
+		}
+	}
+
+	if host == "" {
+		return "", 0, "", false
+	}
+	if port == 0 {
+		port = 80
+	}
+	return host, port, path, true
+}
+
+func httpError(client net.Conn, status string) {
+	client.Write([]byte("HTTP/1.1 " + status + "\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+}
+
+func (user *ProxyUser) dialHTTPUpstream(client net.Conn, host string, port int, header []byte) (net.Conn, *phantomWriter, error) {
+	source := user.Source(client.RemoteAddr())
+	domain := host
+	ip := net.ParseIP(host)
+	if ip != nil {
+		if name := GetNoseDomain(ip); name != "" {
+			domain = name
+		}
+	}
+
+	pface, allowed := user.GetInterface(domain)
+	if !allowed {
+		return nil, nil, errors.New("not allowed")
+	}
+
+	if pface != nil && (pface.Protocol != 0 || pface.Hint != 0) {
+		if pface.Hint&HINT_NOTCP != 0 {
+			return nil, nil, errors.New("tcp not allowed")
+		}
+		logHTTP.Info("forward", "client", source, "domain", domain, "port", port, "interface", pface)
+		conn, info, err := pface.DialHTTP(client, domain, port, header)
+		if err != nil || conn == nil {
+			return nil, nil, err
+		}
+		return conn, &phantomWriter{pface, conn, info, make([]byte, 1500)}, nil
+	}
+
+	logHTTP.Info("forward", "client", source, "domain", domain, "port", port)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(domain, strconv.Itoa(port)), time.Second*10)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = conn.Write(header)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, &phantomWriter{conn: conn}, nil
+}
+
+// HTTPForward serves plain HTTP proxy requests on a client connection,
+// starting with head, until either side closes the connection.
+func HTTPForward(client net.Conn, br *bufio.Reader, head []string, user *ProxyUser) {
+	var upstream *httpUpstream
+	defer func() {
+		upstream.Close()
+	}()
+
+	cw := bufio.NewWriter(client)
+	for {
+		var err error
+		if head == nil {
+			head, err = ReadHTTPHead(br)
+			if err != nil {
+				return
+			}
+		}
+
+		request := strings.SplitN(head[0], " ", 3)
+		if len(request) != 3 || !strings.HasPrefix(request[2], "HTTP/1.") {
+			httpError(client, "400 Bad Request")
+			return
+		}
+		method, uri, version := request[0], request[1], request[2]
+		headers := head[1:]
+		head = nil
+
+		if method == "CONNECT" {
+			httpError(client, "405 Method Not Allowed")
+			return
+		}
+
+		host, port, path, ok := parseRequestTarget(uri, headers)
+		if !ok {
+			httpError(client, "400 Bad Request")
+			return
+		}
+
+		length, err := bodyLength(headers, false)
+		if err != nil {
+			logHTTP.Debug("bad request", "client", client.RemoteAddr(), "domain", host, "error", err)
+			httpError(client, "400 Bad Request")
+			return
+		}
+
+		// the client gets 100 Continue from the proxy, the upstream never
+		// sees the expectation
+		expect := headerTokens(headers, "Expect")
+		if len(expect) > 1 || (len(expect) == 1 && !expect["100-continue"]) {
+			httpError(client, "417 Expectation Failed")
+			return
+		}
+		expectContinue := expect["100-continue"] && version != "HTTP/1.0" && length != 0
+
+		connTokens := headerTokens(headers, "Connection")
+		for token := range headerTokens(headers, "Proxy-Connection") {
+			connTokens[token] = true
+		}
+		keepAlive := version != "HTTP/1.0" || connTokens["keep-alive"]
+		if connTokens["close"] {
+			keepAlive = false
+		}
+		upgrade := connTokens["upgrade"] && len(headerTokens(headers, "Upgrade")) > 0
+
+		authority := host
+		if strings.IndexByte(host, ':') != -1 {
+			authority = "[" + host + "]"
+		}
+		if port != 80 {
+			authority += ":" + strconv.Itoa(port)
+		}
+
+		var out strings.Builder
+		out.WriteString(method + " " + path + " " + version + "\r\n")
+		out.WriteString("Host: " + authority + "\r\n")
+		var filtered []string
+		if upgrade {
+			filtered = filterHeaders(headers, "upgrade")
+			out.WriteString("Connection: Upgrade\r\n")
+		} else {
+			filtered = filterHeaders(headers)
+		}
+		for _, line := range filtered {
+			key, _ := splitHeader(line)
+			if strings.EqualFold(key, "Host") || strings.EqualFold(key, "Expect") {
+				continue
+			}
+			out.WriteString(line + "\r\n")
+		}
+		out.WriteString("\r\n")
+
+		key := net.JoinHostPort(host, strconv.Itoa(port))
+		if upstream != nil && upstream.key != key {
+			upstream.Close()
+			upstream = nil
+		}
+
+		if upstream == nil {
+			conn, w, err := user.dialHTTPUpstream(client, host, port, []byte(out.String()))
+			if err != nil {
+				logHTTP.Error("dial", "client", client.RemoteAddr(), "domain", host, "port", port, "error", err)
+				httpError(client, "502 Bad Gateway")
+				return
+			}
+			if conn == nil {
+				if expectContinue {
+					return // the client holds the body back
+				}
+				// answered locally, drop the request body
+				err = copyBody(io.Discard, br, length)
+				if err != nil || !keepAlive {
+					return
+				}
+				continue
+			}
+			upstream = &httpUpstream{key, conn, bufio.NewReader(conn), bufio.NewWriter(w)}
+		} else {
+			_, err = upstream.writer.WriteString(out.String())
+			if err != nil {
+				return
+			}
+		}
+
+		if expectContinue {
+			_, err = client.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+			if err != nil {
+				return
+			}
+		}
+		err = copyBody(upstream.writer, br, length)
+		if err == nil {
+			err = upstream.writer.Flush()
+		}
+		if err != nil {
+			logHTTP.Debug("send request", "client", client.RemoteAddr(), "domain", host, "error", err)
+			return
+		}
+
+		var status int
+		var response []string
+		for {
+			response, err = ReadHTTPHead(upstream.reader)
+			if err != nil {
+				logHTTP.Debug("read response", "client", client.RemoteAddr(), "domain", host, "error", err)
+				httpError(client, "502 Bad Gateway")
+				return
+			}
+			fields := strings.SplitN(response[0], " ", 3)
+			if len(fields) < 2 {
+				httpError(client, "502 Bad Gateway")
+				return
+			}
+			status, err = strconv.Atoi(fields[1])
+			if err != nil {
+				httpError(client, "502 Bad Gateway")
+				return
+			}
+			if status >= 200 || status == 101 {
+				break
+			}
+			// forward informational responses as they are
+			cw.WriteString(strings.Join(response, "\r\n") + "\r\n\r\n")
+			cw.Flush()
+		}
+
+		if status == 101 && upgrade {
+			cw.WriteString(strings.Join(response, "\r\n") + "\r\n\r\n")
+			if n := upstream.reader.Buffered(); n > 0 {
+				b, _ := upstream.reader.Peek(n)
+				cw.Write(b)
+			}
+			if cw.Flush() != nil {
+				return
+			}
+			if n := br.Buffered(); n > 0 {
+				b, _ := br.Peek(n)
+				upstream.conn.Write(b)
+			}
+			relay(client, upstream.conn)
+			return
+		}
+
+		respHeaders := response[1:]
+		respTokens := headerTokens(respHeaders, "Connection")
+		upstreamKeepAlive := !respTokens["close"] && (strings.HasPrefix(response[0], "HTTP/1.1") || respTokens["keep-alive"])
+
+		var respLength int64
+		closeDelimited := false
+		if method == "HEAD" || status == 204 || status == 304 {
+			respLength = 0
+		} else {
+			respLength, err = bodyLength(respHeaders, true)
+			if err != nil {
+				logHTTP.Debug("bad response", "client", client.RemoteAddr(), "domain", host, "error", err)
+				httpError(client, "502 Bad Gateway")
+				return
+			}
+			closeDelimited = respLength == 0 && !hasHeader(respHeaders, "Content-Length")
+		}
+		if closeDelimited {
+			keepAlive = false
+			upstreamKeepAlive = false
+		}
+
+		cw.WriteString(response[0] + "\r\n")
+		for _, line := range filterHeaders(respHeaders) {
+			cw.WriteString(line + "\r\n")
+		}
+		if !keepAlive {
+			cw.WriteString("Connection: close\r\n")
+		} else if version == "HTTP/1.0" {
+			cw.WriteString("Connection: keep-alive\r\n")
+		}
+		cw.WriteString("\r\n")
+
+		if closeDelimited {
+			_, err = io.Copy(cw, upstream.reader)
+		} else {
+			err = copyBody(cw, upstream.reader, respLength)
+		}
+		if flushErr := cw.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			logHTTP.Debug("relay response", "client", client.RemoteAddr(), "domain", host, "error", err)
+			return
+		}
+
+		if !upstreamKeepAlive {
+			upstream.Close()
+			upstream = nil
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBodyLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		response bool
+		length   int64
+		ok       bool
+	}{
+		{"none", nil, false, 0, true},
+		{"content length", []string{"Content-Length: 5"}, false, 5, true},
+		{"same content lengths", []string{"Content-Length: 5", "Content-Length: 5"}, false, 5, true},
+		{"conflicting content lengths", []string{"Content-Length: 5", "Content-Length: 6"}, false, 0, false},
+		{"signed content length", []string{"Content-Length: +5"}, false, 0, false},
+		{"chunked", []string{"Transfer-Encoding: chunked"}, false, -1, true},
+		{"chunked with content length", []string{"Content-Length: 5", "Transfer-Encoding: chunked"}, false, 0, false},
+		{"gzip, chunked", []string{"Transfer-Encoding: gzip, chunked"}, true, -1, true},
+		{"gzip then chunked", []string{"Transfer-Encoding: gzip", "transfer-encoding: Chunked"}, false, -1, true},
+		{"chunked twice", []string{"Transfer-Encoding: chunked, chunked"}, false, 0, false},
+		{"request chunked, gzip", []string{"Transfer-Encoding: chunked, gzip"}, false, 0, false},
+		{"request gzip", []string{"Transfer-Encoding: gzip"}, false, 0, false},
+		{"response gzip", []string{"Transfer-Encoding: gzip"}, true, 0, true},
+	}
+	for _, tt := range tests {
+		length, err := bodyLength(tt.headers, tt.response)
+		if (err == nil) != tt.ok || (tt.ok && length != tt.length) {
+			t.Errorf("%s: got %d %v", tt.name, length, err)
+		}
+	}
+}
+
+func TestCopyChunked(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{"plain", "4\r\nWiki\r\n5\r\npedia\r\n0\r\n\r\n", true},
+		{"extension", "4;name=value\r\nWiki\r\n0\r\n\r\n", true},
+		{"trailers", "4\r\nWiki\r\n0\r\nExpires: never\r\nX-Sum: 1\r\n\r\n", true},
+		{"bad size", "z\r\nWiki\r\n0\r\n\r\n", false},
+		{"truncated", "4\r\nWi", false},
+		{"no trailer end", "0\r\nExpires: never\r\n", false},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReader(strings.NewReader(tt.body + "GET / HTTP/1.1\r\n"))
+		var out bytes.Buffer
+		err := copyChunked(&out, br)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if out.String() != tt.body {
+			t.Errorf("%s: copied %q", tt.name, out.String())
+		}
+		// the next request is left in the reader
+		rest, _ := io.ReadAll(br)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: left %q", tt.name, rest)
+		}
+	}
+}
+
+// testHTTPUpstream answers every request on a connection with body, it
+// counts the connections.
+func testHTTPUpstream(t *testing.T, response string) (int, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					head, err := ReadHTTPHead(br)
+					if err != nil {
+						return
+					}
+					length, err := bodyLength(head[1:], false)
+					if err != nil || copyBody(io.Discard, br, length) != nil {
+						return
+					}
+					conn.Write([]byte(response))
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, &conns
+}
+
+// testHTTPForward runs HTTPForward on a connection and returns the client
+// end.
+func testHTTPForward(t *testing.T) net.Conn {
+	SetProfile(NewProfile(map[string]PhantomInterface{}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer server.Close()
+		HTTPForward(server, bufio.NewReader(server), nil, nil)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func readResponse(t *testing.T, br *bufio.Reader) ([]string, string) {
+	head, err := ReadHTTPHead(br)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	length, err := bodyLength(head[1:], true)
+	if err != nil {
+		t.Fatalf("response framing: %v", err)
+	}
+	var body bytes.Buffer
+	err = copyBody(&body, br, length)
+	if err != nil {
+		t.Fatalf("response body: %v", err)
+	}
+	return head, body.String()
+}
+
+func TestHTTPForwardKeepAlive(t *testing.T) {
+	port, conns := testHTTPUpstream(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked\r\n\r\n2\r\nok\r\n0\r\nX-Trailer: 1\r\n\r\n")
+	client := testHTTPForward(t)
+	target := "http://127.0.0.1:" + strconv.Itoa(port) + "/"
+	br := bufio.NewReader(client)
+
+	requests := "GET " + target + " HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"POST " + target + " HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"POST " + target + " HTTP/1.1\r\nContent-Length: 2\r\n\r\nhi"
+	client.Write([]byte(requests))
+	for i := 0; i < 3; i++ {
+		head, body := readResponse(t, br)
+		if head[0] != "HTTP/1.1 200 OK" || body != "2\r\nok\r\n0\r\nX-Trailer: 1\r\n\r\n" {
+			t.Fatalf("response %d: %q %q", i, head, body)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("%d upstream connections for 3 requests", n)
+	}
+}
+
+func TestHTTPForwardFraming(t *testing.T) {
+	port, _ := testHTTPUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	target := "http://127.0.0.1:" + strconv.Itoa(port) + "/"
+	for name, request := range map[string]string{
+		"chunked with content length": "POST " + target + " HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"content lengths":             "POST " + target + " HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd",
+		"gzip request":                "POST " + target + " HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+	} {
+		client := testHTTPForward(t)
+		client.Write([]byte(request))
+		head, _ := readResponse(t, bufio.NewReader(client))
+		if head[0] != "HTTP/1.1 400 Bad Request" {
+			t.Errorf("%s: got %q", name, head[0])
+		}
+	}
+}
+
+func TestHTTPForwardBadResponse(t *testing.T) {
+	port, _ := testHTTPUpstream(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked, gzip, chunked\r\n\r\n")
+	client := testHTTPForward(t)
+	client.Write([]byte("GET http://127.0.0.1:" + strconv.Itoa(port) + "/ HTTP/1.1\r\n\r\n"))
+	head, _ := readResponse(t, bufio.NewReader(client))
+	if head[0] != "HTTP/1.1 502 Bad Gateway" {
+		t.Errorf("got %q", head[0])
+	}
+}
@@ -0,0 +1,370 @@
+package phantomtcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LevelOff     = 0
+	LevelInfo    = 1
+	LevelDebug   = 2
+	LevelTrace   = 3
+	LevelVerbose = 4
+	LevelDump    = 5
+)
+
+var levelNames = []string{"off", "info", "debug", "trace", "verbose", "dump"}
+
+type LogConfig struct {
+	Level      string            `json:"level,omitempty"`
+	Format     string            `json:"format,omitempty"`
+	File       string            `json:"file,omitempty"`
+	MaxSize    int               `json:"maxsize,omitempty"`
+	MaxBackups int               `json:"maxbackups,omitempty"`
+	Levels     map[string]string `json:"levels,omitempty"`
+}
+
+type logSettings struct {
+	level  int
+	levels map[string]int
+	format string
+}
+
+type LogScope struct {
+	name string
+}
+
+var (
+	logCore     = NewLogScope("core")
+	logDNS      = NewLogScope("dns")
+	logSocks    = NewLogScope("socks")
+	logHTTP     = NewLogScope("http")
+	logRedirect = NewLogScope("redirect")
+	logPacket   = NewLogScope("packet")
+	logUDP      = NewLogScope("udp")
+)
+
+var logLock sync.Mutex
+var logOutput io.Writer = os.Stdout
+var logCurrent atomic.Value
+
+func NewLogScope(name string) *LogScope {
+	return &LogScope{name}
+}
+
+func ParseLogLevel(level string) (int, error) {
+	n, err := strconv.Atoi(level)
+	if err == nil {
+		return n, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", level)
+}
+
+// ConfigureLog applies config on top of LogLevel, it may be called again on reload.
+func ConfigureLog(config *LogConfig) error {
+	settings := &logSettings{level: -1, levels: make(map[string]int), format: "text"}
+	var output io.Writer = os.Stdout
+	if config != nil {
+		if config.Level != "" {
+			level, err := ParseLogLevel(config.Level)
+			if err != nil {
+				return err
+			}
+			settings.level = level
+		}
+		for name, l := range config.Levels {
+			level, err := ParseLogLevel(l)
+			if err != nil {
+				return err
+			}
+			settings.levels[name] = level
+		}
+		switch config.Format {
+		case "", "text":
+		case "json", "logfmt":
+			settings.format = config.Format
+		default:
+			return fmt.Errorf("unknown log format %q", config.Format)
+		}
+		if config.File != "" {
+			file, err := openLogFile(config.File, int64(config.MaxSize)<<20, config.MaxBackups)
+			if err != nil {
+				return err
+			}
+			output = file
+		}
+	}
+
+	logLock.Lock()
+	if file, ok := logOutput.(*logFile); ok {
+		file.Close()
+	}
+	logOutput = output
+	logLock.Unlock()
+	logCurrent.Store(settings)
+	return nil
+}
+
+func (scope *LogScope) Level() int {
+	settings, _ := logCurrent.Load().(*logSettings)
+	if settings != nil {
+		if level, ok := settings.levels[scope.name]; ok {
+			return level
+		}
+		if settings.level >= 0 {
+			return settings.level
+		}
+	}
+	return LogLevel
+}
+
+func (scope *LogScope) Enabled(level int) bool {
+	return level <= scope.Level()
+}
+
+// Notice is written at every level, for startup messages that used to be
+// printed unconditionally.
+func (scope *LogScope) Notice(msg string, kv ...interface{}) {
+	scope.write("notice", msg, kv)
+}
+
+func (scope *LogScope) Error(msg string, kv ...interface{}) {
+	if scope.Enabled(LevelInfo) {
+		scope.write("error", msg, kv)
+	}
+}
+
+func (scope *LogScope) Info(msg string, kv ...interface{}) {
+	scope.Log(LevelInfo, msg, kv...)
+}
+
+func (scope *LogScope) Debug(msg string, kv ...interface{}) {
+	scope.Log(LevelDebug, msg, kv...)
+}
+
+func (scope *LogScope) Trace(msg string, kv ...interface{}) {
+	scope.Log(LevelTrace, msg, kv...)
+}
+
+func (scope *LogScope) Verbose(msg string, kv ...interface{}) {
+	scope.Log(LevelVerbose, msg, kv...)
+}
+
+func (scope *LogScope) Log(level int, msg string, kv ...interface{}) {
+	if level > 0 && scope.Enabled(level) {
+		name := levelNames[len(levelNames)-1]
+		if level < len(levelNames) {
+			name = levelNames[level]
+		}
+		scope.write(name, msg, kv)
+	}
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logFields turns key/value pairs into fields. A *PhantomInterface value
+// becomes the interface name and its hint set.
+func logFields(kv []interface{}) []logField {
+	fields := make([]logField, 0, len(kv)/2+1)
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok || i+1 == len(kv) {
+			fields = append(fields, logField{"extra", kv[i]})
+			i--
+			continue
+		}
+		switch v := kv[i+1].(type) {
+		case *PhantomInterface:
+			fields = append(fields, logField{key, interfaceName(v)})
+			if v != nil && v.Hint != 0 {
+				fields = append(fields, logField{"hint", HintString(v.Hint)})
+			}
+		case error:
+			if v != nil {
+				fields = append(fields, logField{key, v.Error()})
+			}
+		case net.Addr:
+			if v != nil {
+				fields = append(fields, logField{key, v.String()})
+			}
+		case nil:
+		default:
+			fields = append(fields, logField{key, v})
+		}
+	}
+	return fields
+}
+
+func (scope *LogScope) write(level string, msg string, kv []interface{}) {
+	settings, _ := logCurrent.Load().(*logSettings)
+	format := "text"
+	if settings != nil {
+		format = settings.format
+	}
+	fields := logFields(kv)
+	now := time.Now()
+
+	var b strings.Builder
+	switch format {
+	case "json":
+		b.WriteString(`{"time":`)
+		b.WriteString(strconv.Quote(now.Format(time.RFC3339Nano)))
+		writeJSONField(&b, "level", level)
+		writeJSONField(&b, "subsystem", scope.name)
+		writeJSONField(&b, "msg", msg)
+		for _, f := range fields {
+			writeJSONField(&b, f.key, f.value)
+		}
+		b.WriteString("}\n")
+	case "logfmt":
+		b.WriteString("time=" + now.Format(time.RFC3339Nano))
+		b.WriteString(" level=" + level)
+		b.WriteString(" subsystem=" + scope.name)
+		b.WriteString(" msg=" + logfmtValue(msg))
+		for _, f := range fields {
+			b.WriteString(" " + f.key + "=" + logfmtValue(fmt.Sprint(f.value)))
+		}
+		b.WriteString("\n")
+	default:
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(level) + " " + scope.name + ": " + msg)
+		for _, f := range fields {
+			b.WriteString(" " + f.key + "=" + logfmtValue(fmt.Sprint(f.value)))
+		}
+		b.WriteString("\n")
+	}
+
+	logLock.Lock()
+	io.WriteString(logOutput, b.String())
+	logLock.Unlock()
+}
+
+func writeJSONField(b *strings.Builder, key string, value interface{}) {
+	b.WriteString(",")
+	b.WriteString(strconv.Quote(key))
+	b.WriteString(":")
+	switch value.(type) {
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		data, _ := json.Marshal(value)
+		b.Write(data)
+	default:
+		data, _ := json.Marshal(fmt.Sprint(value))
+		b.Write(data)
+	}
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+var hintNames map[uint32]string
+var hintNamesOnce sync.Once
+
+func hintName(bit uint32) string {
+	hintNamesOnce.Do(func() {
+		hintNames = make(map[uint32]string)
+		for name, h := range HintMap {
+			if bits.OnesCount32(h) == 1 {
+				hintNames[h] = name
+			}
+		}
+	})
+	name, ok := hintNames[bit]
+	if !ok {
+		name = "0x" + strconv.FormatUint(uint64(bit), 16)
+	}
+	return name
+}
+
+func HintString(hint uint32) string {
+	var names []string
+	for hint != 0 {
+		bit := hint & -hint
+		hint &^= bit
+		names = append(names, hintName(bit))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+type logFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openLogFile(path string, maxSize int64, maxBackups int) (*logFile, error) {
+	if maxSize > 0 && maxBackups <= 0 {
+		maxBackups = 3
+	}
+	f := &logFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return f, f.open()
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *logFile) rotate() error {
+	f.file.Close()
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	err := os.Rename(f.path, f.path+".1")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return f.open()
+}
+
+func (f *logFile) Write(b []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *logFile) Close() error {
+	return f.file.Close()
+}
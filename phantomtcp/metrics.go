@@ -0,0 +1,278 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type metricValue struct {
+	labels []string
+	value  int64
+}
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]*metricValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogramValue
+}
+
+var (
+	redirectTotal = newMetric("phantomsocks_redirect_total", "counter",
+		"Connections handled by tcp_redirect.", "interface", "domain")
+	relayBytes = newMetric("phantomsocks_relay_bytes_total", "counter",
+		"Bytes relayed between clients and servers.", "interface", "direction")
+	dialFailures = newMetric("phantomsocks_dial_failures_total", "counter",
+		"Failed PhantomInterface.Dial calls.", "interface", "class")
+	dnsCacheTotal = newMetric("phantomsocks_dns_cache_total", "counter",
+		"DNS cache lookups.", "result")
+	dnsLookupErrors = newMetric("phantomsocks_dns_lookup_errors_total", "counter",
+		"Failed upstream DNS lookups.", "scheme")
+	modifyPackets = newMetric("phantomsocks_modify_packets_total", "counter",
+		"ModifyAndSendPacket calls per hint.", "hint")
+	udpSessions = newMetric("phantomsocks_udp_sessions", "gauge",
+		"Active UDP sessions.", "type")
+	udpSessionsTotal = newMetric("phantomsocks_udp_sessions_total", "counter",
+		"UDP sessions opened.", "type")
+	dnsUpstreamTotal = newMetric("phantomsocks_dns_upstream_total", "counter",
+		"Queries per upstream DNS server.", "upstream", "result")
+	dnsUpstreamRTT = newMetric("phantomsocks_dns_upstream_rtt_milliseconds", "gauge",
+		"Smoothed round trip time per upstream DNS server.", "upstream")
+	dnsUpstreamSidelined = newMetric("phantomsocks_dns_upstream_sidelined", "gauge",
+		"Upstream DNS servers tried last after failing.", "upstream")
+
+	dnsLookupSeconds = &histogramVec{
+		name:    "phantomsocks_dns_lookup_seconds",
+		help:    "Upstream DNS lookup latency.",
+		labels:  []string{"scheme"},
+		buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		values:  make(map[string]*histogramValue),
+	}
+)
+
+var metrics = []*metricVec{
+	redirectTotal, relayBytes, dialFailures, dnsCacheTotal,
+	dnsLookupErrors, modifyPackets, udpSessions, udpSessionsTotal,
+	dnsUpstreamTotal, dnsUpstreamRTT, dnsUpstreamSidelined,
+}
+
+func newMetric(name string, kind string, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*metricValue),
+	}
+}
+
+func (m *metricVec) get(labels ...string) *metricValue {
+	key := strings.Join(labels, "\xff")
+	m.lock.Lock()
+	value, ok := m.values[key]
+	if !ok {
+		value = &metricValue{labels: labels}
+		m.values[key] = value
+	}
+	m.lock.Unlock()
+	return value
+}
+
+func (m *metricVec) Add(n int64, labels ...string) {
+	atomic.AddInt64(&m.get(labels...).value, n)
+}
+
+func (m *metricVec) Set(n int64, labels ...string) {
+	atomic.StoreInt64(&m.get(labels...).value, n)
+}
+
+func (h *histogramVec) Observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	h.lock.Lock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.sum += v
+	h.lock.Unlock()
+}
+
+// labelEscaper escapes label values as the text exposition format wants,
+// only backslash, double quote and line feed.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value, which may be a domain name or SNI sent
+// by a client. Invalid UTF-8 would break the whole scrape too.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"="+quoteLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *metricVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var keys []string
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	for _, key := range sortedKeys(keys) {
+		value := m.values[key]
+		fmt.Fprintf(w, "%s%s %d\n", m.name, formatLabels(m.labels, value.labels), atomic.LoadInt64(&value.value))
+	}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var keys []string
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	for _, key := range sortedKeys(keys) {
+		value := h.values[key]
+		for i, bound := range h.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, value.labels, "le", le), value.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, value.labels, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, value.labels), value.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, value.labels), value.count)
+	}
+}
+
+func WriteMetrics(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	dnsLookupSeconds.write(bw)
+	bw.Flush()
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(w)
+}
+
+func interfaceName(pface *PhantomInterface) string {
+	if pface == nil {
+		return "default"
+	}
+	return pface.Name
+}
+
+func dialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	return "other"
+}
+
+func countModifyPacket(hint uint32) {
+	hint &^= HINT_DNS
+	for hint != 0 {
+		bit := hint & -hint
+		hint &^= bit
+		modifyPackets.Add(1, hintName(bit))
+	}
+}
+
+// redirectDomain is the domain label of a redirect, the profile rule the
+// domain falls under. Clients pick the domains, so the rest share "other".
+func redirectDomain(user *ProxyUser, domain string) string {
+	if domain == "" {
+		return "ip"
+	}
+	rule, ok := user.profile().Rule(domain)
+	if !ok {
+		return "other"
+	}
+	return rule
+}
+
+func observeLookup(scheme string, start time.Time, err error) {
+	dnsLookupSeconds.Observe(time.Since(start).Seconds(), scheme)
+	if err != nil {
+		dnsLookupErrors.Add(1, scheme)
+	}
+}
+
+// udpSession counts a UDP session of kind, the returned func ends it.
+func udpSession(kind string) func() {
+	udpSessionsTotal.Add(1, kind)
+	udpSessions.Add(1, kind)
+	return func() {
+		udpSessions.Add(-1, kind)
+	}
+}
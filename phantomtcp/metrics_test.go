@@ -0,0 +1,67 @@
+package phantomtcp
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"example.com", `{domain="example.com"}`},
+		{`a\b"c` + "\nd", `{domain="a\\b\"c\nd"}`},
+		{"café\x01", "{domain=\"café\x01\"}"},
+		{"bad\xffname", "{domain=\"bad�name\"}"},
+	}
+	for _, tt := range tests {
+		got := formatLabels([]string{"domain"}, []string{tt.value})
+		if got != tt.want {
+			t.Errorf("formatLabels(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectDomain(t *testing.T) {
+	profile := testChainProfile(t, "[a]\nexample.com\n.example.org\n")
+	user := &ProxyUser{Name: "u", Profile: profile}
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "example.com"},
+		{"www.example.org", ".example.org"},
+		{"a.b.example.org", ".example.org"},
+		{"www.example.com", "other"},
+		{"random.example.net", "other"},
+		{"", "ip"},
+	}
+	for _, tt := range tests {
+		if got := redirectDomain(user, tt.domain); got != tt.want {
+			t.Errorf("redirectDomain(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+// A lookup raced over several upstreams is one cache miss.
+func TestCacheMissRace(t *testing.T) {
+	SetProfile(NewProfile(map[string]PhantomInterface{}))
+	server := fakeUpstream(t) + "," + fakeUpstream(t)
+	miss := dnsCacheTotal.get("miss")
+	hit := dnsCacheTotal.get("hit")
+	misses, hits := atomic.LoadInt64(&miss.value), atomic.LoadInt64(&hit.value)
+
+	for i := 0; i < 2; i++ {
+		_, ips := NSLookup("miss.example.com", HINT_IPV4, server, DNS_RACE)
+		if len(ips) != 1 {
+			t.Fatalf("lookup %d: %v", i, ips)
+		}
+	}
+	if got := atomic.LoadInt64(&miss.value) - misses; got != 1 {
+		t.Errorf("%d misses, want 1", got)
+	}
+	if got := atomic.LoadInt64(&hit.value) - hits; got != 1 {
+		t.Errorf("%d hits, want 1", got)
+	}
+}
@@ -29,7 +29,12 @@ func ConnectionMonitor(devices []string) bool {
 	return false
 }
 
-func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+func monitorDevice(device string) {
+}
+
+type devicePacketWriter struct{}
+
+func (devicePacketWriter) WritePacket(connInfo *ConnectionInfo, packet []byte, count int) error {
 	return nil
 }
 
@@ -0,0 +1,359 @@
+package phantomtcp
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type VirtualAddrConfig struct {
+	IPv4  string `json:"ipv4,omitempty"`
+	IPv6  string `json:"ipv6,omitempty"`
+	Grace int    `json:"grace,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+type noseEntry struct {
+	name  string
+	index uint32
+	used  time.Time
+	elem  *list.Element
+}
+
+// static entries come from the profiles and are never recycled.
+func (entry *noseEntry) static() bool {
+	return entry.elem == nil
+}
+
+// nosePool hands out the virtual addresses. An index is encoded into the
+// IPv4 and the IPv6 range alike. Once the ranges are full, the least
+// recently used index is recycled if it has been idle for the grace period.
+type nosePool struct {
+	lock    sync.Mutex
+	names   map[string]*noseEntry
+	indexes map[uint32]*noseEntry
+	lru     *list.List
+	next    uint32
+	size    uint32
+	grace   time.Duration
+	ipv4    *net.IPNet
+	ipv6    *net.IPNet
+}
+
+const DefaultNoseGrace = time.Hour
+
+// VirtualAddrPrefix is the /8 used when no IPv4 range is configured.
+var VirtualAddrPrefix byte = 255
+
+var Nose = &nosePool{
+	names:   make(map[string]*noseEntry),
+	indexes: make(map[uint32]*noseEntry),
+	lru:     list.New(),
+	next:    1,
+	grace:   DefaultNoseGrace,
+}
+
+func prefixRange() *net.IPNet {
+	return &net.IPNet{IP: net.IPv4(VirtualAddrPrefix, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
+}
+
+func parseVirtualRange(key string, cidr string, size int) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != size || len(ipnet.IP) != size/8 {
+		return nil, fmt.Errorf("vaddr %s %s is not an %s range", key, cidr, key)
+	}
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("vaddr %s is too small", cidr)
+	}
+	return ipnet, nil
+}
+
+// ConfigureNose sets the ranges of the pool, ranges only change on restart.
+// Without an IPv4 range, VirtualAddrPrefix.0.0.0/8 is used.
+func ConfigureNose(config *VirtualAddrConfig) error {
+	ipv4 := prefixRange()
+	var ipv6 *net.IPNet
+	grace := DefaultNoseGrace
+	if config != nil {
+		var err error
+		if config.IPv4 != "" {
+			ipv4, err = parseVirtualRange("ipv4", config.IPv4, 32)
+			if err != nil {
+				return err
+			}
+		}
+		if config.IPv6 != "" {
+			ipv6, err = parseVirtualRange("ipv6", config.IPv6, 128)
+			if err != nil {
+				return err
+			}
+		}
+		if config.Grace > 0 {
+			grace = time.Duration(config.Grace) * time.Second
+		}
+	}
+
+	Nose.lock.Lock()
+	defer Nose.lock.Unlock()
+	Nose.grace = grace
+	if Nose.size == 0 {
+		Nose.ipv4 = ipv4
+		Nose.ipv6 = ipv6
+		Nose.size = 1 << 24
+		for _, ipnet := range []*net.IPNet{ipv4, ipv6} {
+			if ipnet == nil {
+				continue
+			}
+			ones, bits := ipnet.Mask.Size()
+			if bits-ones < 24 && uint32(1)<<(bits-ones) < Nose.size {
+				Nose.size = 1 << (bits - ones)
+			}
+		}
+	}
+	return nil
+}
+
+// ranges returns the IPv4 and the IPv6 range, the IPv4 range falls back
+// to VirtualAddrPrefix before ConfigureNose.
+func (pool *nosePool) ranges() (*net.IPNet, *net.IPNet) {
+	pool.lock.Lock()
+	ipv4, ipv6 := pool.ipv4, pool.ipv6
+	pool.lock.Unlock()
+	if ipv4 == nil {
+		ipv4 = prefixRange()
+	}
+	return ipv4, ipv6
+}
+
+// capacity bounds the indexes, the first and the last address of the
+// ranges are never handed out.
+func (pool *nosePool) capacity() uint32 {
+	size := pool.size
+	if size == 0 {
+		size = 1 << 24
+	}
+	return size - 1
+}
+
+func (pool *nosePool) touch(entry *noseEntry) {
+	entry.used = time.Now()
+	if !entry.static() {
+		pool.lru.MoveToFront(entry.elem)
+	}
+}
+
+// Lookup returns the index of name, 0 if it has none.
+func (pool *nosePool) Lookup(name string) uint32 {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	entry, ok := pool.names[name]
+	if !ok {
+		return 0
+	}
+	pool.touch(entry)
+	return entry.index
+}
+
+// Domain returns the name an index was handed out to.
+func (pool *nosePool) Domain(index uint32) string {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	entry, ok := pool.indexes[index]
+	if !ok {
+		return ""
+	}
+	pool.touch(entry)
+	return entry.name
+}
+
+// Alloc returns the index of name, handing out a new one if needed.
+// It returns 0 when every index is in use within the grace period.
+func (pool *nosePool) Alloc(name string, static bool) uint32 {
+	pool.lock.Lock()
+	entry, ok := pool.names[name]
+	if ok {
+		pool.touch(entry)
+		if static && !entry.static() {
+			pool.lru.Remove(entry.elem)
+			entry.elem = nil
+		}
+		pool.lock.Unlock()
+		return entry.index
+	}
+
+	var index uint32
+	var recycled string
+	if pool.next < pool.capacity() {
+		index = pool.next
+		pool.next++
+	} else {
+		back := pool.lru.Back()
+		if back == nil {
+			pool.lock.Unlock()
+			return 0
+		}
+		old := back.Value.(*noseEntry)
+		if time.Since(old.used) < pool.grace {
+			pool.lock.Unlock()
+			logDNS.Error("virtual address pool exhausted", "domain", name)
+			return 0
+		}
+		pool.lru.Remove(back)
+		delete(pool.names, old.name)
+		delete(pool.indexes, old.index)
+		index = old.index
+		recycled = old.name
+	}
+
+	pool.add(name, index, time.Now(), static)
+	pool.lock.Unlock()
+
+	if recycled != "" {
+		logDNS.Debug("virtual address recycled", "domain", name, "old", recycled, "addr", NoseIP(index, false))
+		// the cached answer of the old name still carries the index, Alloc
+		// may be called with the lock of other records held
+		go func() {
+			if records, ok := DNSCache.Load(recycled); ok {
+				records.lock.Lock()
+				stale := records.Index == index
+				records.lock.Unlock()
+				if stale {
+					DNSCache.Delete(recycled)
+				}
+			}
+		}()
+	}
+	return index
+}
+
+func (pool *nosePool) add(name string, index uint32, used time.Time, static bool) {
+	entry := &noseEntry{name: name, index: index, used: used}
+	if !static {
+		entry.elem = pool.lru.PushFront(entry)
+	}
+	pool.names[name] = entry
+	pool.indexes[index] = entry
+}
+
+type NoseEntry struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
+	Used  int64  `json:"used"`
+}
+
+func (pool *nosePool) Entries() []NoseEntry {
+	pool.lock.Lock()
+	entries := make([]NoseEntry, 0, len(pool.indexes))
+	for _, entry := range pool.indexes {
+		entries = append(entries, NoseEntry{entry.index, entry.name, entry.used.Unix()})
+	}
+	pool.lock.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+	return entries
+}
+
+// SaveNose writes the pool to filename, so clients that cached an answer
+// reach the same domain after a restart.
+func SaveNose(filename string) error {
+	data, err := json.Marshal(Nose.Entries())
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// LoadNose fills the pool from a file written by SaveNose, it has to run
+// before the profiles are loaded.
+func LoadNose(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var entries []NoseEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Used < entries[j].Used })
+
+	Nose.lock.Lock()
+	defer Nose.lock.Unlock()
+	for _, e := range entries {
+		if e.Index == 0 || e.Index >= Nose.capacity() || e.Name == "" {
+			continue
+		}
+		if _, ok := Nose.names[e.Name]; ok {
+			continue
+		}
+		if _, ok := Nose.indexes[e.Index]; ok {
+			continue
+		}
+		Nose.add(e.Name, e.Index, time.Unix(e.Used, 0), false)
+		if e.Index >= Nose.next {
+			Nose.next = e.Index + 1
+		}
+	}
+	logDNS.Info("virtual addresses loaded", "file", filename, "count", len(Nose.indexes))
+	return nil
+}
+
+// NoseIP encodes index into the IPv4 or the IPv6 range, it returns nil
+// if there is no IPv6 range.
+func NoseIP(index uint32, ipv6 bool) net.IP {
+	ipnet, ipnet6 := Nose.ranges()
+	if ipv6 {
+		ipnet = ipnet6
+	}
+	if ipnet == nil {
+		return nil
+	}
+	ip := make(net.IP, len(ipnet.IP))
+	copy(ip, ipnet.IP)
+	n := len(ip) - 4
+	binary.BigEndian.PutUint32(ip[n:], binary.BigEndian.Uint32(ip[n:])+index)
+	return ip
+}
+
+// noseIndexOf decodes a virtual address, ok is false if ip is not in the
+// ranges.
+func noseIndexOf(ip net.IP) (uint32, bool) {
+	ipnet, ipnet6 := Nose.ranges()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ipnet = ipnet6
+	}
+	if ipnet == nil || !ipnet.Contains(ip) {
+		return 0, false
+	}
+	n := len(ipnet.IP) - 4
+	return binary.BigEndian.Uint32(ip[n:]) - binary.BigEndian.Uint32(ipnet.IP[n:]), true
+}
+
+func IsVirtualAddr(ip net.IP) bool {
+	_, ok := noseIndexOf(ip)
+	return ok
+}
+
+func GetNoseDomain(ip net.IP) string {
+	index, ok := noseIndexOf(ip)
+	if !ok || index == 0 {
+		return ""
+	}
+	return Nose.Domain(index)
+}
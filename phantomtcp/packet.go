@@ -0,0 +1,171 @@
+package phantomtcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketWriter sends the IP packets crafted by ModifyAndSendPacket, count
+// times each.
+type PacketWriter interface {
+	WritePacket(connInfo *ConnectionInfo, packet []byte, count int) error
+}
+
+// DefaultPacketWriter sends through the capture device of the build. It is
+// used by the capture loops and by interfaces without a PacketWriter of
+// their own, tests set PhantomInterface.PacketWriter instead of swapping it.
+var DefaultPacketWriter PacketWriter = devicePacketWriter{}
+
+// ConnInfoDialer dials in place of DialConnInfo. Dial uses it when the
+// PacketWriter of the interface implements it, as the connections it sends
+// packets for are then not seen by a capture device.
+type ConnInfoDialer interface {
+	DialConnInfo(laddr, raddr *net.TCPAddr, pface *PhantomInterface, payload []byte) (net.Conn, *ConnectionInfo, error)
+}
+
+// MemoryPacketWriter keeps the packets instead of sending them.
+type MemoryPacketWriter struct {
+	sync.Mutex
+	Packets [][]byte
+}
+
+func (w *MemoryPacketWriter) WritePacket(connInfo *ConnectionInfo, packet []byte, count int) error {
+	w.Lock()
+	defer w.Unlock()
+	for i := 0; i < count; i++ {
+		w.Packets = append(w.Packets, append([]byte(nil), packet...))
+	}
+	return nil
+}
+
+// CraftPacket builds the IP packet for hint on connInfo. TFO packets carry
+// the cookie of the server and move connInfo back by the payload.
+func CraftPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8) ([]byte, error) {
+	var tcpLayer *layers.TCP
+	if hint&HINT_TFO != 0 {
+		tcpLayer = &connInfo.TCP
+
+		tcpLayer.Seq -= uint32(len(payload))
+		var cookie []byte = nil
+		switch ip := connInfo.IP.(type) {
+		case *layers.IPv4:
+			result, ok := TFOCookies.Load(ip.DstIP.String())
+			if ok {
+				cookie = result.([]byte)
+			} else {
+				payload = nil
+			}
+		case *layers.IPv6:
+			result, ok := TFOCookies.Load(ip.DstIP.String())
+			if ok {
+				cookie = result.([]byte)
+			} else {
+				payload = nil
+			}
+		}
+
+		tcpLayer.Options = append(connInfo.TCP.Options,
+			layers.TCPOption{OptionType: 34, OptionLength: uint8(len(cookie)), OptionData: cookie},
+		)
+	} else {
+		tcpLayer = &layers.TCP{
+			SrcPort:    connInfo.TCP.SrcPort,
+			DstPort:    connInfo.TCP.DstPort,
+			Seq:        connInfo.TCP.Seq,
+			Ack:        connInfo.TCP.Ack,
+			DataOffset: 5,
+			ACK:        true,
+			PSH:        true,
+			Window:     connInfo.TCP.Window,
+		}
+
+		if hint&HINT_WMD5 != 0 {
+			tcpLayer.Options = []layers.TCPOption{
+				{OptionType: 19, OptionLength: 16, OptionData: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+			}
+		} else if hint&HINT_WTIME != 0 {
+			tcpLayer.Options = []layers.TCPOption{
+				{OptionType: 8, OptionLength: 8, OptionData: []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+			}
+		}
+	}
+
+	if hint&HINT_NACK != 0 {
+		tcpLayer.ACK = false
+		tcpLayer.Ack = 0
+	} else if hint&HINT_WACK != 0 {
+		tcpLayer.Ack += uint32(tcpLayer.Window)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	var options gopacket.SerializeOptions
+	options.FixLengths = true
+
+	if hint&HINT_WCSUM == 0 {
+		options.ComputeChecksums = true
+	}
+
+	if hint&HINT_WSEQ != 0 {
+		tcpLayer.Seq--
+		fakepayload := make([]byte, len(payload)+1)
+		fakepayload[0] = 0xFF
+		copy(fakepayload[1:], payload)
+		payload = fakepayload
+	}
+
+	// the TTL is set on a copy, connInfo keeps its own
+	var ipLayer gopacket.SerializableLayer
+	switch ip := connInfo.IP.(type) {
+	case *layers.IPv4:
+		ip4 := *ip
+		if hint&HINT_TTL != 0 {
+			ip4.TTL = ttl
+		}
+		tcpLayer.SetNetworkLayerForChecksum(&ip4)
+		ipLayer = &ip4
+	case *layers.IPv6:
+		ip6 := *ip
+		if hint&HINT_TTL != 0 {
+			ip6.HopLimit = ttl
+		}
+		tcpLayer.SetNetworkLayerForChecksum(&ip6)
+		ipLayer = &ip6
+	default:
+		return nil, errors.New("invalid network layer")
+	}
+
+	err := gopacket.SerializeLayers(buffer, options,
+		ipLayer, tcpLayer, gopacket.Payload(payload),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+	return sendPacket(DefaultPacketWriter, connInfo, payload, hint, ttl, count)
+}
+
+// SendPacket crafts the packet for hint on connInfo and sends it through
+// the PacketWriter of pface.
+func (pface *PhantomInterface) SendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+	w := pface.PacketWriter
+	if w == nil {
+		w = DefaultPacketWriter
+	}
+	return sendPacket(w, connInfo, payload, hint, ttl, count)
+}
+
+func sendPacket(w PacketWriter, connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+	countModifyPacket(hint)
+	packet, err := CraftPacket(connInfo, payload, hint, ttl)
+	if err != nil {
+		return err
+	}
+	return w.WritePacket(connInfo, packet, count)
+}
@@ -0,0 +1,67 @@
+//go:build pcap || rawsocket
+// +build pcap rawsocket
+
+package phantomtcp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket/layers"
+)
+
+// sendRawTCP sends the TCP segment of packet through a raw socket, the
+// kernel adds an IP header with the TTL of packet.
+func sendRawTCP(connInfo *ConnectionInfo, packet []byte, count int) error {
+	var network string
+	var laddr net.IPAddr
+	var raddr net.IPAddr
+	var level, name, ttl int
+	var segment []byte
+	switch ip := connInfo.IP.(type) {
+	case *layers.IPv4:
+		laddr = net.IPAddr{IP: ip.SrcIP}
+		raddr = net.IPAddr{IP: ip.DstIP}
+		network = "ip4:tcp"
+		level, name, ttl = syscall.IPPROTO_IP, syscall.IP_TTL, int(packet[8])
+		segment = packet[int(packet[0]&0x0f)<<2:]
+	case *layers.IPv6:
+		laddr = net.IPAddr{IP: ip.SrcIP}
+		raddr = net.IPAddr{IP: ip.DstIP}
+		network = "ip6:tcp"
+		level, name, ttl = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, int(packet[7])
+		segment = packet[40:]
+	default:
+		return errors.New("invalid network layer")
+	}
+
+	conn, err := net.DialIP(network, &laddr, &raddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, name, ttl)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		_, err = conn.Write(segment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func testConnInfo(v6 bool) *ConnectionInfo {
+	connInfo := &ConnectionInfo{
+		TCP: layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 0x01020304, Ack: 0x05060708, Window: 0x1000},
+	}
+	if v6 {
+		connInfo.IP = &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, HopLimit: 64,
+			SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	} else {
+		connInfo.IP = &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	}
+	return connInfo
+}
+
+// The packets are the IP header, the TCP header and the payload "abc".
+var craftTests = []struct {
+	name   string
+	hint   uint32
+	v6     bool
+	packet []string
+}{
+	{"ttl", HINT_TTL, false, []string{
+		"4500002b000000000306a3cb0a0000010a000002",
+		"9c4001bb01020304050607085018100019550000",
+		"616263"}},
+	{"w-md5", HINT_WMD5, false, []string{
+		"4500003f00000000400666b70a0000010a000002",
+		"9c4001bb0102030405060708a0181000b62e0000" + "1312" + strings.Repeat("00", 16) + "0000",
+		"616263"}},
+	{"w-seq", HINT_WSEQ, false, []string{
+		"4500002c00000000400666ca0a0000010a000002",
+		"9c4001bb0102030305060708501810007bf20000",
+		"ff616263"}},
+	{"n-ack", HINT_NACK, false, []string{
+		"4500002b00000000400666cb0a0000010a000002",
+		"9c4001bb01020304000000005008100025730000",
+		"616263"}},
+	{"w-ack", HINT_WACK, false, []string{
+		"4500002b00000000400666cb0a0000010a000002",
+		"9c4001bb01020304050617085018100009550000",
+		"616263"}},
+	{"w-csum", HINT_WCSUM, false, []string{
+		"4500002b00000000400600000a0000010a000002",
+		"9c4001bb01020304050607085018100000000000",
+		"616263"}},
+	{"w-time", HINT_WTIME, false, []string{
+		"4500003700000000400666bf0a0000010a000002",
+		"9c4001bb010203040506070880181000e13e0000" + "080a" + strings.Repeat("00", 8) + "0000",
+		"616263"}},
+
+	{"ttl", HINT_TTL, true, []string{
+		"600000000017060320010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb010203040506070850181000d1e20000",
+		"616263"}},
+	{"w-md5", HINT_WMD5, true, []string{
+		"60000000002b064020010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb0102030405060708a01810006ebc0000" + "1312" + strings.Repeat("00", 16) + "0000",
+		"616263"}},
+	{"w-seq", HINT_WSEQ, true, []string{
+		"600000000018064020010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb01020303050607085018100034800000",
+		"ff616263"}},
+	{"n-ack", HINT_NACK, true, []string{
+		"600000000017064020010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb010203040000000050081000de000000",
+		"616263"}},
+	{"w-ack", HINT_WACK, true, []string{
+		"600000000017064020010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb010203040506170850181000c1e20000",
+		"616263"}},
+	{"w-csum", HINT_WCSUM, true, []string{
+		"600000000017064020010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb01020304050607085018100000000000",
+		"616263"}},
+	{"w-time", HINT_WTIME, true, []string{
+		"600000000023064020010db800000000000000000000000120010db8000000000000000000000002",
+		"9c4001bb01020304050607088018100099cc0000" + "080a" + strings.Repeat("00", 8) + "0000",
+		"616263"}},
+}
+
+func TestCraftPacket(t *testing.T) {
+	for _, tt := range craftTests {
+		want, err := hex.DecodeString(strings.Join(tt.packet, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		connInfo := testConnInfo(tt.v6)
+		packet, err := CraftPacket(connInfo, []byte("abc"), tt.hint, 3)
+		if err != nil {
+			t.Errorf("%s v6=%v: %v", tt.name, tt.v6, err)
+			continue
+		}
+		if !bytes.Equal(packet, want) {
+			t.Errorf("%s v6=%v:\n got %x\nwant %x", tt.name, tt.v6, packet, want)
+		}
+
+		// the connection keeps its own TTL and sequence numbers
+		orig := testConnInfo(tt.v6)
+		if connInfo.TCP.Seq != orig.TCP.Seq || connInfo.TCP.Ack != orig.TCP.Ack {
+			t.Errorf("%s v6=%v: connInfo modified", tt.name, tt.v6)
+		}
+		switch ip := connInfo.IP.(type) {
+		case *layers.IPv4:
+			if ip.TTL != 64 {
+				t.Errorf("%s: connInfo TTL %d", tt.name, ip.TTL)
+			}
+		case *layers.IPv6:
+			if ip.HopLimit != 64 {
+				t.Errorf("%s: connInfo hop limit %d", tt.name, ip.HopLimit)
+			}
+		}
+	}
+}
+
+func TestSendPacket(t *testing.T) {
+	w := &MemoryPacketWriter{}
+	pface := &PhantomInterface{PacketWriter: w}
+	err := pface.SendPacket(testConnInfo(false), []byte("abc"), HINT_TTL, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString(strings.Join(craftTests[0].packet, ""))
+	if len(w.Packets) != 2 || !bytes.Equal(w.Packets[0], want) || !bytes.Equal(w.Packets[1], want) {
+		t.Fatalf("got %x", w.Packets)
+	}
+}
@@ -4,6 +4,7 @@
 package phantomtcp
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -28,13 +29,14 @@ var HintMap = map[string]uint32{
 	"strip":    HINT_STRIP,
 	"fronting": HINT_FRONTING,
 
-	"ttl":    HINT_TTL,
-	"mss":    HINT_MSS,
-	"w-md5":  HINT_WMD5,
-	"n-ack":  HINT_NACK,
-	"w-csum": HINT_WCSUM,
-	"w-seq":  HINT_WSEQ,
-	"w-time": HINT_WTIME,
+	"ttl":     HINT_TTL,
+	"rel-ttl": HINT_RTTL,
+	"mss":     HINT_MSS,
+	"w-md5":   HINT_WMD5,
+	"n-ack":   HINT_NACK,
+	"w-csum":  HINT_WCSUM,
+	"w-seq":   HINT_WSEQ,
+	"w-time":  HINT_WTIME,
 
 	"tfo":    HINT_TFO,
 	"udp":    HINT_UDP,
@@ -76,7 +78,7 @@ func DevicePrint() {
 }
 
 func connectionMonitor(device string) {
-	fmt.Printf("Device: %v\n", device)
+	logPacket.Notice("device", "device", device)
 
 	snapLen := int32(65535)
 
@@ -85,12 +87,12 @@ func connectionMonitor(device string) {
 	var err error
 	pcapHandle, err = pcap.OpenLive(device, snapLen, true, pcap.BlockForever)
 	if err != nil {
-		fmt.Printf("pcap open live failed: %v", err)
+		logPacket.Notice("pcap open failed", "device", device, "error", err)
 		return
 	}
 
 	if err = pcapHandle.SetBPFFilter(filter); err != nil {
-		fmt.Printf("set bpf filter failed: %v", err)
+		logPacket.Notice("set bpf filter failed", "device", device, "error", err)
 		return
 	}
 	defer pcapHandle.Close()
@@ -100,7 +102,7 @@ func connectionMonitor(device string) {
 	for {
 		packet, err := packetSource.NextPacket()
 		if err != nil {
-			logPrintln(1, err)
+			logPacket.Error("read", "device", device, "error", err)
 			continue
 		}
 
@@ -114,14 +116,19 @@ func connectionMonitor(device string) {
 			var srcPort layers.TCPPort
 			var synAddr string
 			var hint uint32 = 0
+			var ttl byte
 			if synack {
+				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
+				synAddr = addr.String()
+				ttl = ip.TTL
+				if _, ok := ConnSyn.Load(synAddr); ok {
+					storeHops(ip.SrcIP, ttl)
+				}
 				hint = ConnWait4[tcp.DstPort]
 				if hint == 0 {
 					continue
 				}
 				srcPort = tcp.DstPort
-				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
-				synAddr = addr.String()
 			} else {
 				srcPort = tcp.SrcPort
 				addr := net.TCPAddr{IP: ip.DstIP, Port: int(tcp.DstPort)}
@@ -156,9 +163,18 @@ func connectionMonitor(device string) {
 						link.DstMAC = link.SrcMAC
 						link.SrcMAC = srcMAC
 					}
-					connInfo = &ConnectionInfo{link, ip, *tcp}
+					connInfo = &ConnectionInfo{link, ip, *tcp, ttl}
 				default:
-					connInfo = &ConnectionInfo{nil, ip, *tcp}
+					connInfo = &ConnectionInfo{nil, ip, *tcp, ttl}
+				}
+
+				if hint&(HINT_RTTL|HINT_TFO|HINT_HTFO|HINT_SYNX2) == HINT_RTTL {
+					// report the connection with its SYN-ACK, which has the TTL
+					if !synack {
+						ConnWait4[srcPort] = hint
+						continue
+					}
+					ConnWait4[srcPort] = 0
 				}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
@@ -210,14 +226,19 @@ func connectionMonitor(device string) {
 			var srcPort layers.TCPPort
 			var synAddr string
 			var hint uint32 = 0
+			var ttl byte
 			if synack {
+				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
+				synAddr = addr.String()
+				ttl = ip.HopLimit
+				if _, ok := ConnSyn.Load(synAddr); ok {
+					storeHops(ip.SrcIP, ttl)
+				}
 				hint = ConnWait6[tcp.DstPort]
 				if hint == 0 {
 					continue
 				}
 				srcPort = tcp.DstPort
-				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
-				synAddr = addr.String()
 			} else {
 				srcPort = tcp.SrcPort
 				addr := net.TCPAddr{IP: ip.DstIP, Port: int(tcp.DstPort)}
@@ -251,9 +272,18 @@ func connectionMonitor(device string) {
 						link.DstMAC = link.SrcMAC
 						link.SrcMAC = srcMAC
 					}
-					connInfo = &ConnectionInfo{link, ip, *tcp}
+					connInfo = &ConnectionInfo{link, ip, *tcp, ttl}
 				default:
-					connInfo = &ConnectionInfo{nil, ip, *tcp}
+					connInfo = &ConnectionInfo{nil, ip, *tcp, ttl}
+				}
+
+				if hint&(HINT_RTTL|HINT_TFO|HINT_HTFO|HINT_SYNX2) == HINT_RTTL {
+					// report the connection with its SYN-ACK, which has the TTL
+					if !synack {
+						ConnWait6[srcPort] = hint
+						continue
+					}
+					ConnWait6[srcPort] = 0
 				}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
@@ -322,3 +352,31 @@ func ConnectionMonitor(devices []string) bool {
 
 	return true
 }
+
+func monitorDevice(device string) {
+	go connectionMonitor(device)
+}
+
+// writeLinkPacket puts packet in the Ethernet frame of connInfo.
+func writeLinkPacket(connInfo *ConnectionInfo, packet []byte, count int) error {
+	link, ok := connInfo.Link.(*layers.Ethernet)
+	if !ok {
+		return errors.New("Invalid LinkLayer")
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buffer, options, link, gopacket.Payload(packet))
+	if err != nil {
+		return err
+	}
+	outgoingPacket := buffer.Bytes()
+
+	for i := 0; i < count; i++ {
+		err := pcapHandle.WritePacketData(outgoingPacket)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -7,11 +7,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ServiceConfig struct {
@@ -23,18 +25,28 @@ type ServiceConfig struct {
 	PrivateKey string `json:"privatekey,omitempty"`
 	Profile    string `json:"profile,omitempty"`
 
-	Peers []Peer `json:"peers,omitempty"`
+	Peers []Peer       `json:"peers,omitempty"`
+	Users []UserConfig `json:"users,omitempty"`
+}
+
+type UserConfig struct {
+	Name       string   `json:"name,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	Profile    string   `json:"profile,omitempty"`
+	Interfaces []string `json:"interfaces,omitempty"`
 }
 
 type InterfaceConfig struct {
-	Name    string `json:"name,omitempty"`
-	Device  string `json:"device,omitempty"`
-	DNS     string `json:"dns,omitempty"`
-	Hint    string `json:"hint,omitempty"`
-	MTU     int    `json:"mtu,omitempty"`
-	TTL     int    `json:"ttl,omitempty"`
-	MAXTTL  int    `json:"maxttl,omitempty"`
-	Timeout int    `json:"timeout,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Device    string `json:"device,omitempty"`
+	DNS       string `json:"dns,omitempty"`
+	DNSPolicy string `json:"dnspolicy,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+	MTU       int    `json:"mtu,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+	MAXTTL    int    `json:"maxttl,omitempty"`
+	AutoTTL   int    `json:"autottl,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
 
 	Protocol   string `json:"protocol,omitempty"`
 	Address    string `json:"address,omitempty"`
@@ -62,24 +74,47 @@ const (
 )
 
 type PhantomInterface struct {
-	Device  string
-	DNS     string
-	Hint    uint32
-	MTU     uint16
-	TTL     byte
-	MAXTTL  byte
-	Timeout uint16
+	Name      string
+	Device    string
+	DNS       string
+	DNSPolicy byte
+	Hint      uint32
+	MTU       uint16
+	TTL       byte
+	MAXTTL    byte
+	AutoTTL   byte
+	Timeout   uint16
 
 	Protocol byte
 	Address  string
+
+	Fallback *PhantomInterface // next interface of a [a,b,c] section
+
+	PacketWriter PacketWriter // fake packets, nil sends through DefaultPacketWriter
+
+	records map[string]*DNSRecords // static records of a user profile
 }
 
 type PhantomProfile struct {
-	DomainMap map[string]*PhantomInterface
+	DomainMap    map[string]*PhantomInterface
+	InterfaceMap map[string]PhantomInterface
+	Default      *PhantomInterface
+
+	FallbackWait time.Duration // fallback-wait
+	FallbackTime time.Duration // fallback-time
+
+	records map[string]*DNSRecords
 }
 
-var DefaultProfile *PhantomProfile = nil
-var DefaultInterface *PhantomInterface = nil
+type ProxyUser struct {
+	Name       string
+	Password   string
+	Profile    *PhantomProfile // nil follows DefaultProfile()
+	Interfaces []string
+}
+
+var currentProfile atomic.Value
+var profileLock sync.Mutex
 
 var SubdomainDepth = 2
 var LogLevel = 0
@@ -88,6 +123,7 @@ var PassiveMode = false
 
 const (
 	HINT_NONE = 0x0
+	HINT_RTTL = 0x1
 
 	HINT_ALPN  = 0x1 << 1
 	HINT_HTTP  = 0x1 << 2
@@ -131,18 +167,21 @@ const HINT_DNS = HINT_ALPN | HINT_HTTP | HINT_HTTPS | HINT_HTTP3 | HINT_IPV4 | H
 const HINT_FAKE = HINT_TTL | HINT_WMD5 | HINT_NACK | HINT_WACK | HINT_WCSUM | HINT_WSEQ | HINT_WTIME
 const HINT_MODIFY = HINT_FAKE | HINT_SSEG | HINT_TFO | HINT_HTFO | HINT_MODE2 | HINT_MOVE | HINT_STRIP | HINT_FRONTING
 
-var Logger *log.Logger
-
-func logPrintln(level int, v ...interface{}) {
-	if LogLevel >= level {
-		fmt.Println(v...)
+func (profile *PhantomProfile) GetInterface(name string) *PhantomInterface {
+	rule, ok := profile.Rule(name)
+	if ok {
+		return profile.DomainMap[rule]
 	}
+
+	return profile.Default
 }
 
-func (profile *PhantomProfile) GetInterface(name string) *PhantomInterface {
-	config, ok := profile.DomainMap[name]
+// Rule returns the DomainMap key that name falls under, the name itself or
+// one of its parents with a leading dot.
+func (profile *PhantomProfile) Rule(name string) (string, bool) {
+	_, ok := profile.DomainMap[name]
 	if ok {
-		return config
+		return name, true
 	}
 
 	offset := 0
@@ -152,14 +191,14 @@ func (profile *PhantomProfile) GetInterface(name string) *PhantomInterface {
 			break
 		}
 		offset += off
-		config, ok = profile.DomainMap[name[offset:]]
+		_, ok = profile.DomainMap[name[offset:]]
 		if ok {
-			return config
+			return name[offset:], true
 		}
 		offset++
 	}
 
-	return DefaultInterface
+	return "", false
 }
 
 /*
@@ -169,7 +208,7 @@ func (profile *PhantomProfile) GetInterface(name string) *PhantomInterface {
 		return config
 	}
 
-	return DefaultInterface
+	return profile.Default
 }
 */
 
@@ -324,7 +363,7 @@ func HttpMove(conn net.Conn, host string, b []byte) bool {
 	data := make([]byte, 1460)
 	n := 0
 	if host == "" {
-		logPrintln(5, string(b))
+		logHTTP.Log(LevelDump, "move", "request", string(b))
 		copy(data[:], []byte("HTTP/1.1 200 OK"))
 		n += 15
 	} else if host == "https" || host == "h3" {
@@ -430,19 +469,139 @@ func getMyIPv6() net.IP {
 	return nil
 }
 
-func LoadProfile(filename string) error {
-	conf, err := os.Open(filename)
+func DefaultProfile() *PhantomProfile {
+	profile, _ := currentProfile.Load().(*PhantomProfile)
+	return profile
+}
+
+func NewProfile(interfaces map[string]PhantomInterface) *PhantomProfile {
+	profile := &PhantomProfile{
+		DomainMap:    make(map[string]*PhantomInterface),
+		InterfaceMap: interfaces,
+		FallbackWait: fallbackWait,
+		FallbackTime: fallbackTime,
+		records:      make(map[string]*DNSRecords),
+	}
+	default_interface, ok := interfaces["default"]
+	if ok {
+		profile.Default = &default_interface
+	}
+	return profile
+}
+
+// SetProfile swaps in a profile built by NewProfile and LoadProfile.
+// Static records are pinned in DNSCache, those the old profile had and the new
+// one lacks are dropped.
+func SetProfile(profile *PhantomProfile) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	setProfile(profile)
+}
+
+func setProfile(profile *PhantomProfile) {
+	old := DefaultProfile()
+	profile.applyRecords(old)
+	currentProfile.Store(profile)
+}
+
+// UpdateProfile applies update to a copy of the current profile and swaps
+// the copy in. Changes last until the next reload.
+func UpdateProfile(update func(profile *PhantomProfile) error) error {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+
+	old := DefaultProfile()
+	profile := &PhantomProfile{
+		DomainMap:    make(map[string]*PhantomInterface, len(old.DomainMap)),
+		InterfaceMap: old.InterfaceMap,
+		Default:      old.Default,
+		FallbackWait: old.FallbackWait,
+		FallbackTime: old.FallbackTime,
+		records:      make(map[string]*DNSRecords, len(old.records)),
+	}
+	for name, pface := range old.DomainMap {
+		profile.DomainMap[name] = pface
+	}
+	for name, records := range old.records {
+		profile.records[name] = records
+	}
+
+	err := update(profile)
 	if err != nil {
 		return err
 	}
-	defer conf.Close()
+	setProfile(profile)
+	return nil
+}
+
+func (profile *PhantomProfile) applyRecords(old *PhantomProfile) {
+	for name, records := range profile.records {
+		records.lock.Lock()
+		if records.Index == 0 {
+			records.Index = Nose.Lookup(name)
+		}
+		records.lock.Unlock()
+		DNSCache.Pin(name, records)
+	}
+	if old != nil {
+		for name := range old.records {
+			if _, ok := profile.records[name]; !ok {
+				DNSCache.Delete(name)
+			}
+		}
+	}
+}
 
-	br := bufio.NewReader(conf)
+// bindRecords hands the static records of a user profile to its
+// interfaces. They stay out of DNSCache so that they apply to the user only.
+func (profile *PhantomProfile) bindRecords() {
+	bind := func(pface *PhantomInterface) {
+		for ; pface != nil; pface = pface.Fallback {
+			pface.records = profile.records
+		}
+	}
+	bind(profile.Default)
+	for _, pface := range profile.DomainMap {
+		bind(pface)
+	}
+}
 
-	default_interface, ok := InterfaceMap["default"]
+func (profile *PhantomProfile) loadRecords(name string) (*DNSRecords, bool) {
+	records, ok := profile.records[name]
 	if ok {
-		DefaultInterface = &default_interface
+		return records, true
+	}
+	return DNSCache.Load(name)
+}
+
+// noseIndex gives a domain of the profile a virtual address that is never
+// recycled, a domain keeps the address it already has across reloads.
+func noseIndex(name string) uint32 {
+	return Nose.Alloc(name, true)
+}
+
+var udpMappings sync.Map
+
+func (profile *PhantomProfile) LoadProfile(filename string) error {
+	conf, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer conf.Close()
+
+	err = profile.Load(conf)
+	if err != nil {
+		return err
 	}
+
+	logCore.Info("profile loaded", "file", filename)
+
+	return nil
+}
+
+func (profile *PhantomProfile) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+
 	var CurrentInterface *PhantomInterface = &PhantomInterface{}
 
 	for {
@@ -457,33 +616,48 @@ func LoadProfile(filename string) error {
 				keys := strings.SplitN(l, "=", 2)
 				if len(keys) > 1 {
 					if keys[0] == "dns-min-ttl" {
-						logPrintln(2, string(line))
+						logCore.Debug("profile option", "line", string(line))
 						ttl, err := strconv.Atoi(keys[1])
 						if err != nil {
-							log.Println(string(line), err)
+							logCore.Error("bad profile option", "line", string(line), "error", err)
 							return err
 						}
 						DNSMinTTL = uint32(ttl)
+					} else if keys[0] == "fallback-wait" {
+						wait, err := strconv.Atoi(keys[1])
+						if err != nil {
+							logCore.Error("bad profile option", "line", string(line), "error", err)
+							return err
+						}
+						profile.FallbackWait = time.Duration(wait) * time.Millisecond
+					} else if keys[0] == "fallback-time" {
+						seconds, err := strconv.Atoi(keys[1])
+						if err != nil {
+							logCore.Error("bad profile option", "line", string(line), "error", err)
+							return err
+						}
+						profile.FallbackTime = time.Duration(seconds) * time.Second
 					} else if keys[0] == "subdomain" {
 						SubdomainDepth, err = strconv.Atoi(keys[1])
 						if err != nil {
-							log.Println(string(line), err)
+							logCore.Error("bad profile option", "line", string(line), "error", err)
 							return err
 						}
 					} else if keys[0] == "udpmapping" {
 						mapping := strings.SplitN(keys[1], ">", 2)
-						go UDPMapping(mapping[0], mapping[1])
+						if _, loaded := udpMappings.LoadOrStore(keys[1], true); !loaded {
+							go UDPMapping(mapping[0], mapping[1])
+						}
 					} else {
 						if strings.HasPrefix(keys[1], "[") {
 							quote := keys[1][1 : len(keys[1])-1]
-							result, hasCache := DNSCache.Load(quote)
+							records, hasCache := profile.loadRecords(quote)
 							if hasCache {
-								records := result.(*DNSRecords)
-								DNSCache.Store(keys[0], records)
+								profile.records[keys[0]] = records
 							}
-							s, ok := DefaultProfile.DomainMap[quote]
+							s, ok := profile.DomainMap[quote]
 							if ok {
-								DefaultProfile.DomainMap[keys[0]] = s
+								profile.DomainMap[keys[0]] = s
 							}
 							continue
 						} else {
@@ -491,18 +665,16 @@ func LoadProfile(filename string) error {
 							var records *DNSRecords
 							records = new(DNSRecords)
 							if CurrentInterface.Hint&HINT_MODIFY != 0 || CurrentInterface.Protocol != 0 {
-								records.Index = uint32(len(Nose))
+								records.Index = noseIndex(keys[0])
 								records.ALPN = CurrentInterface.Hint & HINT_DNS
-								Nose = append(Nose, keys[0])
 							}
 
 							addrs := strings.Split(keys[1], ",")
 							for i := 0; i < len(addrs); i++ {
 								ip := net.ParseIP(addrs[i])
 								if ip == nil {
-									result, hasCache := DNSCache.Load(addrs[i])
+									r, hasCache := profile.loadRecords(addrs[i])
 									if hasCache {
-										r := result.(*DNSRecords)
 										if r.IPv4Hint != nil {
 											if records.IPv4Hint == nil {
 												records.IPv4Hint = new(RecordAddresses)
@@ -516,7 +688,7 @@ func LoadProfile(filename string) error {
 											records.IPv6Hint.Addresses = append(records.IPv6Hint.Addresses, r.IPv6Hint.Addresses...)
 										}
 									} else {
-										log.Println(keys[0], addrs[i], "bad address")
+										logCore.Error("bad address", "domain", keys[0], "addr", addrs[i])
 									}
 								} else {
 									ip4 := ip.To4()
@@ -535,42 +707,49 @@ func LoadProfile(filename string) error {
 							}
 
 							if ip == nil {
-								DefaultProfile.DomainMap[keys[0]] = CurrentInterface
-								DNSCache.Store(keys[0], records)
+								profile.DomainMap[keys[0]] = CurrentInterface
+								profile.records[keys[0]] = records
 							} else {
-								DefaultProfile.DomainMap[ip.String()] = CurrentInterface
-								DNSCache.Store(ip.String(), records)
+								profile.DomainMap[ip.String()] = CurrentInterface
+								profile.records[ip.String()] = records
 							}
 						}
 					}
 				} else {
 					if keys[0][0] == '[' {
-						face, ok := InterfaceMap[keys[0][1:len(keys[0])-1]]
-						if ok {
-							CurrentInterface = &face
-							logPrintln(1, keys[0], CurrentInterface)
-						} else {
-							logPrintln(1, keys[0], "invalid interface")
+						names := strings.Split(keys[0][1:len(keys[0])-1], ",")
+						var chain *PhantomInterface
+						for i := len(names) - 1; i >= 0; i-- {
+							face, ok := profile.InterfaceMap[strings.TrimSpace(names[i])]
+							if ok {
+								face.Fallback = chain
+								chain = &face
+							} else {
+								logCore.Error("invalid interface", "section", keys[0], "interface", names[i])
+							}
+						}
+						if chain != nil {
+							CurrentInterface = chain
+							logCore.Info("profile section", "interface", CurrentInterface)
 						}
 					} else {
 						addr, err := net.ResolveTCPAddr("tcp", keys[0])
 						if err == nil {
-							DefaultProfile.DomainMap[addr.String()] = CurrentInterface
+							profile.DomainMap[addr.String()] = CurrentInterface
 						} else {
 							_, ipnet, err := net.ParseCIDR(keys[0])
 							if err == nil {
-								DefaultProfile.DomainMap[ipnet.String()] = CurrentInterface
+								profile.DomainMap[ipnet.String()] = CurrentInterface
 							} else {
 								ip := net.ParseIP(keys[0])
 								if ip != nil {
-									DefaultProfile.DomainMap[ip.String()] = CurrentInterface
+									profile.DomainMap[ip.String()] = CurrentInterface
 								} else {
 									if CurrentInterface.DNS != "" || CurrentInterface.Protocol != 0 {
-										DefaultProfile.DomainMap[keys[0]] = CurrentInterface
-										records := new(DNSRecords)
-										DNSCache.Store(keys[0], records)
+										profile.DomainMap[keys[0]] = CurrentInterface
+										profile.records[keys[0]] = new(DNSRecords)
 									} else {
-										DefaultProfile.DomainMap[keys[0]] = nil
+										profile.DomainMap[keys[0]] = nil
 									}
 								}
 							}
@@ -581,12 +760,10 @@ func LoadProfile(filename string) error {
 		}
 	}
 
-	logPrintln(1, filename)
-
 	return nil
 }
 
-func LoadHosts(filename string) error {
+func (profile *PhantomProfile) LoadHosts(filename string) error {
 	hosts, err := os.Open(filename)
 	if err != nil {
 		return err
@@ -601,7 +778,7 @@ func LoadHosts(filename string) error {
 			break
 		}
 		if err != nil {
-			logPrintln(1, err)
+			logCore.Error("read hosts", "error", err)
 		}
 
 		if len(line) == 0 || line[0] == '#' {
@@ -613,7 +790,7 @@ func LoadHosts(filename string) error {
 			var records *DNSRecords
 
 			name := k[1]
-			_, ok := DNSCache.Load(name)
+			_, ok := profile.records[name]
 			if ok {
 				continue
 			}
@@ -624,25 +801,26 @@ func LoadHosts(filename string) error {
 					break
 				}
 				offset += off
-				result, ok := DNSCache.Load(name[offset:])
+				result, ok := profile.records[name[offset:]]
 				if ok {
 					records = new(DNSRecords)
-					*records = *result.(*DNSRecords)
-					DNSCache.Store(name, records)
-					continue
+					records.copyFrom(result)
+					break
 				}
 				offset++
 			}
+			if records == nil {
+				records = new(DNSRecords)
+			}
 
-			server := DefaultProfile.GetInterface(name)
-			if ok && server.Hint != 0 {
-				records.Index = uint32(len(Nose))
+			server := profile.GetInterface(name)
+			if records.Index == 0 && server != nil && server.Hint != 0 {
+				records.Index = noseIndex(name)
 				records.ALPN = server.Hint & HINT_DNS
-				Nose = append(Nose, name)
 			}
 			ip := net.ParseIP(k[0])
 			if ip == nil {
-				fmt.Println(ip, "bad ip address")
+				logCore.Error("bad address", "addr", k[0])
 				continue
 			}
 			ip4 := ip.To4()
@@ -651,6 +829,7 @@ func LoadHosts(filename string) error {
 			} else {
 				records.IPv6Hint = &RecordAddresses{0x7FFFFFFFFFFFFFFF, []net.IP{ip}}
 			}
+			profile.records[name] = records
 		}
 	}
 
@@ -666,7 +845,7 @@ func GetPAC(address string, profile string) string {
 	}
 
 	rule := ""
-	for host := range DefaultProfile.DomainMap {
+	for host := range DefaultProfile().DomainMap {
 		rule += fmt.Sprintf("\"%s\":1,\n", host)
 	}
 	Context := `var proxy = 'SOCKS %s';
@@ -689,11 +868,8 @@ function FindProxyForURL(url, host) {
 	return fmt.Sprintf(Context, address, rule, SubdomainDepth)
 }
 
-var InterfaceMap map[string]PhantomInterface
-
-func CreateInterfaces(Interfaces []InterfaceConfig) []string {
-	DefaultProfile = &PhantomProfile{make(map[string]*PhantomInterface)}
-	InterfaceMap = make(map[string]PhantomInterface)
+func CreateInterfaces(Interfaces []InterfaceConfig) (map[string]PhantomInterface, []string) {
+	InterfaceMap := make(map[string]PhantomInterface)
 
 	contains := func(a []string, x string) bool {
 		for _, n := range a {
@@ -713,7 +889,7 @@ func CreateInterfaces(Interfaces []InterfaceConfig) []string {
 				if ok {
 					Hint |= hint
 				} else {
-					logPrintln(1, "unsupported hint: "+h)
+					logCore.Error("unsupported hint", "hint", h)
 				}
 			}
 		}
@@ -749,21 +925,148 @@ func CreateInterfaces(Interfaces []InterfaceConfig) []string {
 			pface.Timeout = 65535
 		}
 
+		policy, ok := DNSPolicyMap[pface.DNSPolicy]
+		if !ok && pface.DNSPolicy != "" {
+			logCore.Error("unsupported dns policy", "interface", pface.Name, "policy", pface.DNSPolicy)
+		}
+
 		InterfaceMap[pface.Name] = PhantomInterface{
-			Device:  pface.Device,
-			DNS:     pface.DNS,
-			Hint:    Hint,
-			MTU:     uint16(pface.MTU),
-			TTL:     byte(pface.TTL),
-			MAXTTL:  byte(pface.MAXTTL),
-			Timeout: uint16(pface.Timeout),
+			Name:      pface.Name,
+			Device:    pface.Device,
+			DNS:       pface.DNS,
+			DNSPolicy: policy,
+			Hint:      Hint,
+			MTU:       uint16(pface.MTU),
+			TTL:       byte(pface.TTL),
+			MAXTTL:    byte(pface.MAXTTL),
+			AutoTTL:   byte(pface.AutoTTL),
+			Timeout:   uint16(pface.Timeout),
 
 			Protocol: protocol,
 			Address:  pface.Address,
 		}
 	}
-	logPrintln(1, InterfaceMap)
+	for name := range InterfaceMap {
+		pface := InterfaceMap[name]
+		logCore.Info("interface", "interface", &pface, "device", pface.Device, "dns", pface.DNS)
+	}
+
+	return InterfaceMap, devices
+}
+
+var monitoredDevices map[string]bool
+
+// MonitorDevices starts the connection monitor once, devices added by a
+// reload get their own monitor later. Removed devices keep being monitored.
+func MonitorDevices(devices []string) {
+	if monitoredDevices == nil {
+		if !ConnectionMonitor(devices) {
+			return
+		}
+		monitoredDevices = make(map[string]bool)
+		for _, device := range devices {
+			monitoredDevices[device] = true
+		}
+		return
+	}
+
+	for _, device := range devices {
+		if !monitoredDevices[device] {
+			monitoredDevices[device] = true
+			monitorDevice(device)
+		}
+	}
+}
+
+func CreateUsers(Users []UserConfig) (map[string]*ProxyUser, error) {
+	if len(Users) == 0 {
+		return nil, nil
+	}
+
+	users := make(map[string]*ProxyUser)
+	for _, u := range Users {
+		user := &ProxyUser{
+			Name:       u.Name,
+			Password:   u.Password,
+			Interfaces: u.Interfaces,
+		}
+
+		if u.Profile != "" {
+			user.Profile = NewProfile(DefaultProfile().InterfaceMap)
+			err := user.Profile.LoadProfile(u.Profile)
+			if err != nil {
+				return nil, err
+			}
+			user.Profile.bindRecords()
+		}
+
+		users[u.Name] = user
+	}
+
+	return users, nil
+}
+
+func (user *ProxyUser) GetInterface(name string) (*PhantomInterface, bool) {
+	if user == nil {
+		return DefaultProfile().GetInterface(name), true
+	}
+
+	pface := user.profile().GetInterface(name)
+	if pface == nil {
+		if user.allowed("default") {
+			return nil, true
+		}
+		logCore.Debug("interface not allowed", "user", user.Name, "interface", "default", "domain", name)
+		return nil, false
+	}
 
-	go ConnectionMonitor(devices)
-	return devices
+	// a fallback chain keeps the interfaces the user may use
+	chain := pface.Chain()
+	allowed := chain[:0:0]
+	for _, p := range chain {
+		if user.allowed(p.Name) {
+			allowed = append(allowed, p)
+		}
+	}
+	if len(allowed) == len(chain) {
+		return pface, true
+	}
+	if len(allowed) == 0 {
+		logCore.Debug("interface not allowed", "user", user.Name, "interface", pface.Name, "domain", name)
+		return nil, false
+	}
+	var head *PhantomInterface
+	for i := len(allowed) - 1; i >= 0; i-- {
+		face := *allowed[i]
+		face.Fallback = head
+		head = &face
+	}
+	return head, true
+}
+
+// profile returns the profile user follows.
+func (user *ProxyUser) profile() *PhantomProfile {
+	if user == nil || user.Profile == nil {
+		return DefaultProfile()
+	}
+	return user.Profile
+}
+
+func (user *ProxyUser) allowed(name string) bool {
+	if user == nil || len(user.Interfaces) == 0 {
+		return true
+	}
+	for _, n := range user.Interfaces {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *ProxyUser) Source(addr net.Addr) string {
+	if user == nil {
+		return addr.String()
+	}
+	return user.Name + "@" + addr.String()
 }
@@ -1,8 +1,8 @@
 package phantomtcp
 
 import (
+	"errors"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"strconv"
@@ -123,27 +123,48 @@ func UDPMapping(Address string, Target string) error {
 		return nil
 	}
 
-	logPrintln(1, "UDPMapping:", Address, Target)
+	localConn, err := ListenUDPMapping(Address)
+	if err != nil {
+		logUDP.Error("udp mapping", "addr", Address, "error", err)
+		return err
+	}
+	return ServeUDPMapping(localConn, Address, Target)
+}
 
+func ListenUDPMapping(Address string) (*net.UDPConn, error) {
 	localPort, err := strconv.Atoi(Address)
 	if err == nil {
-		localConn, err := net.ListenUDP("udp", &net.UDPAddr{net.IP{127, 0, 0, 1}, localPort, ""})
-		if err != nil {
-			return err
-		}
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: localPort})
+	}
+	return ListenUDP(Address)
+}
+
+func ServeUDPMapping(localConn *net.UDPConn, Address string, Target string) error {
+	defer localConn.Close()
+	if len(Target) == 0 {
+		return nil
+	}
 
+	logUDP.Info("udp mapping", "addr", Address, "server", Target)
+
+	_, err := strconv.Atoi(Address)
+	if err == nil {
 		var SrcAddr *net.UDPAddr = nil
 		conn, err := DialUDP(Target)
 		if err != nil {
 			return err
 		}
+		defer conn.Close()
 
 		go func(raddr **net.UDPAddr, conn net.Conn) {
 			data := make([]byte, 1500)
 			for {
 				n, err := conn.Read(data)
 				if err != nil {
-					log.Println(err)
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					logUDP.Error("udp mapping", "server", Target, "error", err)
 					continue
 				}
 				if *raddr != nil {
@@ -158,19 +179,15 @@ func UDPMapping(Address string, Target string) error {
 			n, SrcAddr, err = localConn.ReadFromUDP(data)
 			if err != nil {
 				SrcAddr = nil
-				log.Println(err)
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				logUDP.Error("udp mapping", "addr", Address, "error", err)
 				continue
 			}
 			conn.Write(data[:n])
 		}
 	} else {
-		localConn, err := ListenUDP(Address)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		defer localConn.Close()
-
 		var UDPLock sync.Mutex
 		var UDPMap map[string]net.Conn = make(map[string]net.Conn)
 		data := make([]byte, 1500)
@@ -178,7 +195,10 @@ func UDPMapping(Address string, Target string) error {
 		for {
 			n, clientAddr, err := localConn.ReadFromUDP(data)
 			if err != nil {
-				log.Println(err)
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				logUDP.Error("udp mapping", "addr", Address, "error", err)
 				continue
 			}
 
@@ -189,11 +209,11 @@ func UDPMapping(Address string, Target string) error {
 				udpConn.Write(data[:n])
 				UDPLock.Unlock()
 			} else {
-				logPrintln(1, "[UDP]", clientAddr.String(), Target)
+				logUDP.Info("udp mapping", "client", clientAddr, "server", Target)
 				UDPLock.Unlock()
 				remoteConn, err := DialUDP(Target)
 				if err != nil {
-					log.Println(err)
+					logUDP.Error("udp mapping", "client", clientAddr, "server", Target, "error", err)
 					continue
 				}
 				UDPLock.Lock()
@@ -201,7 +221,7 @@ func UDPMapping(Address string, Target string) error {
 				_, err = remoteConn.Write(data[:n])
 				UDPLock.Unlock()
 				if err != nil {
-					log.Println(err)
+					logUDP.Error("udp mapping", "client", clientAddr, "server", Target, "error", err)
 					continue
 				}
 
@@ -224,8 +244,6 @@ func UDPMapping(Address string, Target string) error {
 			}
 		}
 	}
-
-	return nil
 }
 
 func TCPMapping(Listener net.Listener, Hosts string) error {
@@ -235,18 +253,20 @@ func TCPMapping(Listener net.Listener, Hosts string) error {
 	for {
 		client, err := Listener.Accept()
 		if err != nil {
-			log.Println(err)
+			if !errors.Is(err, net.ErrClosed) {
+				logCore.Error("tcp mapping", "addr", Listener.Addr(), "error", err)
+			}
 			return err
 		}
 
 		Host := HostList[rand.Intn(len(HostList))]
 
-		logPrintln(3, "[TCP]", client.RemoteAddr().String(), Host)
+		logCore.Trace("tcp mapping", "client", client.RemoteAddr(), "server", Host)
 
 		go func() {
 			remote, err := net.Dial("tcp", Host)
 			if err != nil {
-				logPrintln(1, err)
+				logCore.Error("tcp mapping", "client", client.RemoteAddr(), "server", Host, "error", err)
 				return
 			}
 
@@ -0,0 +1,290 @@
+package phantomtcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeCandidate is an interface a domain is probed with. Candidates built
+// from a hint set are not in the config, Config describes them.
+type ProbeCandidate struct {
+	Name      string
+	Interface PhantomInterface
+	Config    *InterfaceConfig
+}
+
+type ProbeResult struct {
+	Domain    string `json:"domain"`
+	Candidate string `json:"candidate"`
+	Hint      string `json:"hint,omitempty"`
+	Result    string `json:"result"`
+	Latency   int64  `json:"latency"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ProbeRootCAs verifies the probed servers, nil uses the system roots.
+var ProbeRootCAs *x509.CertPool
+
+// ProbeCandidates parses a list of candidates separated by ";". A candidate
+// is the name of an interface or a set of hints such as "ttl=3,w-md5",
+// which is applied to the default interface. An empty spec probes every
+// interface.
+func ProbeCandidates(spec string, interfaces map[string]PhantomInterface) ([]ProbeCandidate, error) {
+	var candidates []ProbeCandidate
+	if strings.TrimSpace(spec) == "" {
+		for name, pface := range interfaces {
+			candidates = append(candidates, ProbeCandidate{Name: name, Interface: pface})
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+		return candidates, nil
+	}
+
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if pface, ok := interfaces[item]; ok {
+			candidates = append(candidates, ProbeCandidate{Name: item, Interface: pface})
+			continue
+		}
+
+		pface := PhantomInterface{Timeout: 65535}
+		if base, ok := interfaces["default"]; ok {
+			pface = base
+		}
+		pface.Hint &= HINT_DNS
+		var names []string
+		for _, h := range strings.Split(item, ",") {
+			h = strings.TrimSpace(h)
+			name := h
+			if strings.HasPrefix(h, "ttl=") {
+				ttl, err := strconv.Atoi(h[4:])
+				if err != nil || ttl <= 0 || ttl > 255 {
+					return nil, fmt.Errorf("invalid ttl in %q", item)
+				}
+				pface.TTL = byte(ttl)
+				h, name = "ttl", "ttl"+h[4:]
+			}
+			hint, ok := HintMap[h]
+			if !ok {
+				return nil, fmt.Errorf("unknown interface or hint %q", h)
+			}
+			pface.Hint |= hint
+			names = append(names, name)
+		}
+		pface.Name = "probe-" + strings.Join(names, "-")
+		config := interfaceConfig(&pface)
+		candidates = append(candidates, ProbeCandidate{Name: pface.Name, Interface: pface, Config: &config})
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no candidates")
+	}
+	return candidates, nil
+}
+
+func interfaceConfig(pface *PhantomInterface) InterfaceConfig {
+	var protocol string
+	switch pface.Protocol {
+	case REDIRECT:
+		protocol = "redirect"
+	case NAT64:
+		protocol = "nat64"
+	case HTTP:
+		protocol = "http"
+	case HTTPS:
+		protocol = "https"
+	case SOCKS4:
+		protocol = "socks4"
+	case SOCKS5:
+		protocol = "socks5"
+	}
+	return InterfaceConfig{
+		Name:      pface.Name,
+		Device:    pface.Device,
+		DNS:       pface.DNS,
+		DNSPolicy: dnsPolicyName(pface.DNSPolicy),
+		Hint:      HintString(pface.Hint),
+		MTU:       int(pface.MTU),
+		TTL:       int(pface.TTL),
+		MAXTTL:    int(pface.MAXTTL),
+		AutoTTL:   int(pface.AutoTTL),
+		Protocol:  protocol,
+		Address:   pface.Address,
+	}
+}
+
+// probeConn dials on the first write, so Dial gets the ClientHello.
+type probeConn struct {
+	net.Conn
+	dial func(b []byte) (net.Conn, error)
+}
+
+func (conn *probeConn) Write(b []byte) (int, error) {
+	if conn.Conn != nil {
+		return conn.Conn.Write(b)
+	}
+	c, err := conn.dial(b)
+	if err != nil {
+		return 0, err
+	}
+	conn.Conn = c
+	return len(b), nil
+}
+
+func (conn *probeConn) Close() error {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.Close()
+}
+
+func (conn *probeConn) SetDeadline(t time.Time) error {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.SetDeadline(t)
+}
+
+// Probe completes a TLS handshake with host through pface.
+func Probe(host string, port int, pface *PhantomInterface, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	p := *pface
+	if ms := timeout.Milliseconds(); ms < int64(p.Timeout) {
+		p.Timeout = uint16(ms)
+	}
+	conn := &probeConn{dial: func(b []byte) (net.Conn, error) {
+		conn, _, err := p.Dial(host, port, b)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(start.Add(timeout))
+		return conn, nil
+	}}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: host,
+		NextProtos: []string{"h2", "http/1.1"},
+		RootCAs:    ProbeRootCAs,
+	})
+	err := tlsConn.Handshake()
+	return time.Since(start), err
+}
+
+// ProbeClass names the outcome of a probe.
+func ProbeClass(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &hostErr), errors.As(err, &authErr), errors.As(err, &invalidErr):
+		return "cert"
+	case strings.Contains(err.Error(), "tls: "):
+		// alerts and malformed records, often a middlebox answering
+		return "tls"
+	}
+	return dialErrorClass(err)
+}
+
+// ProbeDomain probes host, which may carry a port, with each candidate in
+// turn. Candidates are not raced so they do not disturb each other.
+func ProbeDomain(host string, candidates []ProbeCandidate, timeout time.Duration) []ProbeResult {
+	port := 443
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+
+	results := make([]ProbeResult, 0, len(candidates))
+	for _, candidate := range candidates {
+		latency, err := Probe(host, port, &candidate.Interface, timeout)
+		result := ProbeResult{
+			Domain:    host,
+			Candidate: candidate.Name,
+			Hint:      HintString(candidate.Interface.Hint),
+			Result:    ProbeClass(err),
+			Latency:   latency.Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		logCore.Info("probe", "domain", host, "port", port, "interface", &candidate.Interface, "result", result.Result, "latency", latency, "error", err)
+		results = append(results, result)
+	}
+	return results
+}
+
+// ProbeWinner returns the fastest candidate that succeeded.
+func ProbeWinner(results []ProbeResult) (ProbeResult, bool) {
+	var winner ProbeResult
+	found := false
+	for _, result := range results {
+		if result.Result == "ok" && (!found || result.Latency < winner.Latency) {
+			winner = result
+			found = true
+		}
+	}
+	return winner, found
+}
+
+// WriteProbeProfile writes the winners as a profile, domains without one
+// are listed as comments. Candidates built from hints come with the
+// interface to add to config.json.
+func WriteProbeProfile(w io.Writer, domains []string, winners map[string]ProbeCandidate) error {
+	var names []string
+	sections := make(map[string][]string)
+	var failed []string
+	for _, domain := range domains {
+		candidate, ok := winners[domain]
+		if !ok {
+			failed = append(failed, domain)
+			continue
+		}
+		if _, ok := sections[candidate.Name]; !ok {
+			names = append(names, candidate.Name)
+		}
+		sections[candidate.Name] = append(sections[candidate.Name], domain)
+	}
+
+	var b strings.Builder
+	b.WriteString("# generated by phantomsocks -probe\n")
+	for _, domain := range failed {
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+		b.WriteString("# " + domain + ": no working interface\n")
+	}
+	for _, name := range names {
+		domains := sections[name]
+		b.WriteString("\n")
+		if config := winners[domains[0]].Config; config != nil {
+			data, err := json.Marshal(config)
+			if err != nil {
+				return err
+			}
+			b.WriteString("# interface: " + string(data) + "\n")
+		}
+		b.WriteString("[" + name + "]\n")
+		for _, domain := range domains {
+			if host, _, err := net.SplitHostPort(domain); err == nil {
+				domain = host
+			}
+			b.WriteString(domain + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
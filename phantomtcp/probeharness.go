@@ -0,0 +1,446 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ProbeHarness serves the probed domains on localhost behind a simulated
+// middlebox, so strategies can be checked offline. Interfaces attached to
+// the harness dial the middlebox and hand it their fake packets instead of
+// a capture device.
+//
+// The middlebox reassembles the stream like a DPI box, the first data seen
+// for an offset wins, fake packets included. When the first TLS record or
+// HTTP header is complete and holds a whole domain name, it acts: "reset"
+// the connection, "drop" it or answer an "alert"; "none" lets everything
+// through. The server behind it drops fake packets that a real one would:
+// a low TTL, a bad checksum, an MD5 or timestamp option, no or a wrong ack
+// or a sequence before the window. Any other fake packet corrupts the
+// stream and the connection is reset. TFO is not simulated.
+type ProbeHarness struct {
+	Port   int
+	Action string
+
+	domains   []string
+	records   map[string]*DNSRecords
+	server    net.Listener
+	middlebox net.Listener
+
+	lock  sync.Mutex
+	flows map[int]*harnessFlow // by client port
+}
+
+const (
+	harnessISN = 0x10000000
+	harnessAck = 0x20000001
+	harnessTTL = 64
+
+	harnessMaxRecord = 16384
+)
+
+// StartProbeHarness serves domains and makes Probe trust its certificate.
+// Interfaces are pointed at it with Attach.
+func StartProbeHarness(domains []string, action string) (*ProbeHarness, error) {
+	switch action {
+	case "":
+		action = "reset"
+	case "reset", "drop", "alert", "none":
+	default:
+		return nil, fmt.Errorf("unknown middlebox action %q", action)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "phantomsocks probe"},
+		DNSNames:              domains,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	middlebox, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	// both families point at the middlebox
+	loopback := &RecordAddresses{0, []net.IP{net.IPv4(127, 0, 0, 1).To4()}}
+	records := make(map[string]*DNSRecords)
+	for _, domain := range domains {
+		records[domain] = &DNSRecords{IPv4Hint: loopback, IPv6Hint: loopback}
+	}
+
+	h := &ProbeHarness{
+		Port:      middlebox.Addr().(*net.TCPAddr).Port,
+		Action:    action,
+		domains:   domains,
+		records:   records,
+		server:    server,
+		middlebox: middlebox,
+		flows:     make(map[int]*harnessFlow),
+	}
+	go h.serve()
+	go h.inspect()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	ProbeRootCAs = pool
+	logCore.Notice("probe harness", "addr", middlebox.Addr(), "server", server.Addr(), "action", action)
+	return h, nil
+}
+
+// Attach resolves the domains to the middlebox for pface only and sends
+// its fake packets to the harness.
+func (h *ProbeHarness) Attach(pface *PhantomInterface) {
+	pface.PacketWriter = h
+	pface.records = h.records
+}
+
+func (h *ProbeHarness) Close() {
+	h.middlebox.Close()
+	h.server.Close()
+	ProbeRootCAs = nil
+}
+
+// DialConnInfo connects without a capture device, the ConnectionInfo is
+// made up and only meaningful to the harness.
+func (h *ProbeHarness) DialConnInfo(laddr, raddr *net.TCPAddr, pface *PhantomInterface, payload []byte) (net.Conn, *ConnectionInfo, error) {
+	if payload != nil {
+		return nil, nil, errors.New("tfo is not simulated by the probe harness")
+	}
+	d := net.Dialer{Timeout: time.Millisecond * time.Duration(pface.Timeout)}
+	if laddr != nil {
+		d.LocalAddr = laddr
+	}
+	conn, err := d.Dial("tcp", raddr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr = conn.LocalAddr().(*net.TCPAddr)
+
+	connInfo := &ConnectionInfo{
+		TCP: layers.TCP{
+			SrcPort: layers.TCPPort(laddr.Port),
+			DstPort: layers.TCPPort(raddr.Port),
+			Seq:     harnessISN,
+			Ack:     harnessAck,
+			Window:  65535,
+		},
+	}
+	if ip4 := raddr.IP.To4(); ip4 != nil {
+		connInfo.IP = &layers.IPv4{Version: 4, IHL: 5, TTL: harnessTTL, Protocol: layers.IPProtocolTCP,
+			SrcIP: laddr.IP.To4(), DstIP: ip4}
+	} else {
+		connInfo.IP = &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, HopLimit: harnessTTL,
+			SrcIP: laddr.IP, DstIP: raddr.IP}
+	}
+	return &harnessConn{conn, h.flow(laddr.Port)}, connInfo, nil
+}
+
+// WritePacket hands a fake packet to the middlebox once it has read what
+// was written before it.
+func (h *ProbeHarness) WritePacket(connInfo *ConnectionInfo, packet []byte, count int) error {
+	var first gopacket.LayerType = layers.LayerTypeIPv4
+	if packet[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	p := gopacket.NewPacket(packet, first, gopacket.Default)
+	tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return errors.New("probe harness: not a tcp packet")
+	}
+
+	h.lock.Lock()
+	flow, ok := h.flows[int(tcp.SrcPort)]
+	h.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	for flow.read < flow.written && !flow.done {
+		flow.cond.Wait()
+	}
+	if flow.done {
+		return nil
+	}
+	flow.stream.add(int(int32(tcp.Seq-(harnessISN+1))), tcp.Payload)
+	if !serverDrops(p, tcp) {
+		flow.corrupt = true
+	}
+	return nil
+}
+
+// serverDrops tells whether the server would discard a fake packet.
+func serverDrops(p gopacket.Packet, tcp *layers.TCP) bool {
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.TTL < harnessTTL {
+			return true
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+	case *layers.IPv6:
+		if ip.HopLimit < harnessTTL {
+			return true
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+	}
+	if sum, err := tcp.ComputeChecksum(); err != nil || sum != 0 {
+		return true
+	}
+	if !tcp.ACK || tcp.Ack != harnessAck {
+		return true
+	}
+	if int32(tcp.Seq-(harnessISN+1)) < 0 {
+		return true
+	}
+	for _, option := range tcp.Options {
+		// no MD5 key, and PAWS for a zero timestamp
+		if option.OptionType == 19 || option.OptionType == layers.TCPOptionKindTimestamps {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ProbeHarness) flow(port int) *harnessFlow {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	flow, ok := h.flows[port]
+	if !ok {
+		flow = &harnessFlow{}
+		flow.cond = sync.NewCond(&flow.lock)
+		h.flows[port] = flow
+	}
+	return flow
+}
+
+// harnessFlow is a connection as the middlebox sees it.
+type harnessFlow struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	written int // by the client
+	read    int // by the middlebox
+	stream  harnessStream
+	corrupt bool
+	done    bool // the middlebox has decided
+}
+
+// finish stops the inspection of flow.
+func (flow *harnessFlow) finish() {
+	flow.lock.Lock()
+	flow.done = true
+	flow.cond.Broadcast()
+	flow.lock.Unlock()
+}
+
+// harnessConn counts the bytes written, so fake packets stay in order.
+type harnessConn struct {
+	net.Conn
+	flow *harnessFlow
+}
+
+func (conn *harnessConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.flow.lock.Lock()
+	conn.flow.written += n
+	conn.flow.lock.Unlock()
+	return n, err
+}
+
+// harnessStream reassembles a stream, the first data for an offset wins.
+type harnessStream struct {
+	data   []byte
+	filled []bool
+}
+
+func (s *harnessStream) add(offset int, b []byte) {
+	if offset < 0 {
+		if -offset >= len(b) {
+			return
+		}
+		b = b[-offset:]
+		offset = 0
+	}
+	if offset >= harnessMaxRecord {
+		return
+	}
+	if end := offset + len(b); end > harnessMaxRecord {
+		b = b[:harnessMaxRecord-offset]
+	}
+	if end := offset + len(b); end > len(s.data) {
+		s.data = append(s.data, make([]byte, end-len(s.data))...)
+		s.filled = append(s.filled, make([]bool, end-len(s.filled))...)
+	}
+	for i, c := range b {
+		if !s.filled[offset+i] {
+			s.data[offset+i] = c
+			s.filled[offset+i] = true
+		}
+	}
+}
+
+// prefix returns the data up to the first hole.
+func (s *harnessStream) prefix() []byte {
+	n := 0
+	for n < len(s.filled) && s.filled[n] {
+		n++
+	}
+	return s.data[:n]
+}
+
+// recordComplete tells whether b holds the first TLS record or HTTP header.
+func recordComplete(b []byte) bool {
+	if len(b) >= harnessMaxRecord {
+		return true
+	}
+	if len(b) > 0 && b[0] == 0x16 {
+		return len(b) >= 5 && len(b) >= 5+int(binary.BigEndian.Uint16(b[3:5]))
+	}
+	return bytes.Contains(b, []byte("\r\n\r\n"))
+}
+
+func (h *ProbeHarness) serve() {
+	for {
+		conn, err := h.server.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}()
+	}
+}
+
+func (h *ProbeHarness) inspect() {
+	for {
+		client, err := h.middlebox.Accept()
+		if err != nil {
+			return
+		}
+		go h.relay(client)
+	}
+}
+
+func (h *ProbeHarness) blocked(b []byte) bool {
+	for _, domain := range h.domains {
+		if bytes.Contains(b, []byte(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ProbeHarness) relay(client net.Conn) {
+	defer client.Close()
+
+	port := client.RemoteAddr().(*net.TCPAddr).Port
+	flow := h.flow(port)
+	defer func() {
+		flow.finish()
+		h.lock.Lock()
+		delete(h.flows, port)
+		h.lock.Unlock()
+	}()
+
+	var received []byte
+	var seen []byte
+	b := make([]byte, 16384)
+	for {
+		n, err := client.Read(b)
+		if err != nil {
+			return
+		}
+		received = append(received, b[:n]...)
+
+		flow.lock.Lock()
+		flow.stream.add(flow.read, b[:n])
+		flow.read += n
+		flow.cond.Broadcast()
+		seen = flow.stream.prefix()
+		corrupt := flow.corrupt
+		flow.lock.Unlock()
+
+		if corrupt || recordComplete(seen) {
+			break
+		}
+	}
+
+	flow.lock.Lock()
+	corrupt := flow.corrupt
+	flow.lock.Unlock()
+	flow.finish()
+
+	if corrupt {
+		logCore.Debug("probe harness corrupted", "client", client.RemoteAddr())
+		client.(*net.TCPConn).SetLinger(0)
+		return
+	}
+	if h.Action != "none" && h.blocked(seen) {
+		logCore.Debug("probe harness blocked", "client", client.RemoteAddr(), "action", h.Action)
+		switch h.Action {
+		case "drop":
+			io.Copy(io.Discard, client)
+		case "alert":
+			// fatal handshake_failure
+			client.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28})
+		default:
+			client.(*net.TCPConn).SetLinger(0)
+		}
+		return
+	}
+
+	server, err := net.Dial("tcp", h.server.Addr().String())
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	_, err = server.Write(received)
+	if err != nil {
+		return
+	}
+	relay(client, server)
+}
@@ -0,0 +1,94 @@
+package phantomtcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeHarness(t *testing.T) {
+	h, err := StartProbeHarness([]string{"blocked.example"}, "reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	tests := []struct {
+		name   string
+		hint   uint32
+		ttl    byte
+		result string
+	}{
+		{"plain", 0, 3, "reset"},
+		{"ttl", HINT_TTL, 3, "ok"},
+		{"w-md5", HINT_WMD5, 3, "ok"},
+		{"w-csum", HINT_WCSUM, 3, "ok"},
+		{"n-ack", HINT_NACK, 3, "ok"},
+		{"w-ack", HINT_WACK, 3, "ok"},
+		{"w-seq", HINT_WSEQ, 3, "ok"},
+		{"w-time", HINT_WTIME, 3, "ok"},
+		{"mode2 w-md5", HINT_MODE2 | HINT_WMD5, 3, "ok"},
+		{"s-seg w-md5", HINT_SSEG | HINT_WMD5, 3, "ok"},
+		// the fake packet reaches the server
+		{"s-seg", HINT_SSEG, 3, "reset"},
+		{"ttl too high", HINT_TTL, 64, "reset"},
+	}
+	for _, tt := range tests {
+		pface := PhantomInterface{Name: tt.name, Hint: tt.hint, TTL: tt.ttl, Timeout: 2000}
+		h.Attach(&pface)
+		_, err := Probe("blocked.example", h.Port, &pface, 2*time.Second)
+		if result := ProbeClass(err); result != tt.result {
+			t.Errorf("%s: got %s (%v), want %s", tt.name, result, err, tt.result)
+		}
+	}
+	if PassiveMode {
+		t.Error("harness turned on passive mode")
+	}
+}
+
+func TestProbeHarnessActions(t *testing.T) {
+	for action, result := range map[string]string{"none": "ok", "alert": "tls", "drop": "timeout"} {
+		h, err := StartProbeHarness([]string{"blocked.example"}, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pface := PhantomInterface{Timeout: 2000}
+		h.Attach(&pface)
+		_, err = Probe("blocked.example", h.Port, &pface, time.Second)
+		if got := ProbeClass(err); got != result {
+			t.Errorf("%s: got %s (%v), want %s", action, got, err, result)
+		}
+		h.Close()
+	}
+}
+
+func TestHarnessStream(t *testing.T) {
+	var s harnessStream
+	s.add(4, []byte("efgh"))
+	if len(s.prefix()) != 0 {
+		t.Fatalf("prefix %q before offset 0", s.prefix())
+	}
+	s.add(-1, []byte("\xffABCD"))
+	s.add(0, []byte("abcdefghij"))
+	if got := string(s.prefix()); got != "ABCDefghij" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestServerDropsPlainPacket(t *testing.T) {
+	connInfo := testConnInfo(false)
+	connInfo.TCP.Seq, connInfo.TCP.Ack = harnessISN+1, harnessAck
+	w := &MemoryPacketWriter{}
+	pface := &PhantomInterface{PacketWriter: w}
+	for hint, drop := range map[uint32]bool{0: false, HINT_TTL: true, HINT_WCSUM: true, HINT_WSEQ: true} {
+		w.Packets = nil
+		pface.SendPacket(connInfo, []byte("abc"), hint, 3, 1)
+		h := &ProbeHarness{flows: map[int]*harnessFlow{}}
+		flow := h.flow(int(connInfo.TCP.SrcPort))
+		if err := h.WritePacket(connInfo, w.Packets[0], 1); err != nil {
+			t.Fatal(err)
+		}
+		if flow.corrupt == drop {
+			t.Errorf("hint %x: dropped %v, want %v", hint, !flow.corrupt, drop)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package phantomtcp
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
 	"net"
 	"strconv"
@@ -18,106 +22,409 @@ func ReadAtLeast() {
 }
 
 func SocksProxy(client net.Conn) {
+	SocksProxyWithUsers(client, nil)
+}
+
+func SocksProxyWithUsers(client net.Conn, users map[string]*ProxyUser) {
 	defer client.Close()
 
+	br := bufio.NewReader(client)
+	conn := &bufferedConn{client, br}
+
+	version, err := br.Peek(1)
+	if err != nil {
+		logSocks.Error("read version", "client", client.RemoteAddr(), "error", err)
+		return
+	}
+
 	host := ""
 	var addr net.TCPAddr
-	{
-		var b [1500]byte
-		n, err := client.Read(b[:])
-		if err != nil || n < 3 {
-			logPrintln(1, client.RemoteAddr(), err)
+	var user *ProxyUser
+	var reply []byte
+	switch version[0] {
+	case 0x05:
+		methods, err := ReadSocks5Methods(br)
+		if err != nil {
+			logSocks.Error("read methods", "client", client.RemoteAddr(), "error", err)
 			return
 		}
-
-		var reply []byte
-		if b[0] == 0x05 {
-			client.Write([]byte{0x05, 0x00})
-			n, err = client.Read(b[:4])
-			if err != nil || n != 4 {
-				return
+		if users != nil {
+			method := byte(0xFF)
+			if bytes.IndexByte(methods, 0x02) != -1 {
+				method = 0x02
 			}
-			switch b[3] {
-			case 0x01: //IPv4
-				n, err = client.Read(b[:6])
-				if n < 6 {
-					return
-				}
-				addr.IP = net.IP(b[:4])
-				addr.Port = int(binary.BigEndian.Uint16(b[4:6]))
-				// 0x02: connection not allowed by ruleset
-				// client.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
-			case 0x03: //Domain
-				n, err = client.Read(b[:])
-				addrLen := b[0]
-				if n < int(addrLen+3) {
-					return
-				}
-				host = string(b[1 : addrLen+1])
-				addr.Port = int(binary.BigEndian.Uint16(b[n-2:]))
-				// 0x02: connection not allowed by ruleset
-				//client.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
-			case 0x04: //IPv6
-				n, err = client.Read(b[:])
-				if n < 18 {
-					return
-				}
-				addr.IP = net.IP(b[:16])
-				addr.Port = int(binary.BigEndian.Uint16(b[16:18]))
-				// 0x02: connection not allowed by ruleset
-				// logPrintln(3, "connection not allowed by ruleset from", client.RemoteAddr())
-			default:
-				// 0x08: address type not supported
-				logPrintln(3, "address type", b[0], "not supported from", client.RemoteAddr())
-				client.Write([]byte{5, 9, 0, 1, 0, 0, 0, 0, 0, 0})
+			client.Write([]byte{0x05, method})
+			if method == 0xFF {
+				logSocks.Trace("no acceptable auth method", "client", client.RemoteAddr())
 				return
 			}
-			reply = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-		} else if b[0] == 0x04 {
-			if n > 8 && b[1] == 1 {
-				userEnd := 8 + bytes.IndexByte(b[8:n], 0)
-				addr.Port = int(binary.BigEndian.Uint16(b[2:4]))
-				if b[4]|b[5]|b[6] == 0 {
-					hostEnd := bytes.IndexByte(b[userEnd+1:n], 0)
-					if hostEnd > 0 {
-						host = string(b[userEnd+1 : userEnd+1+hostEnd])
-					} else {
-						client.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
-						return
-					}
-				} else {
-					if b[4] == VirtualAddrPrefix {
-						index := int(binary.BigEndian.Uint16(b[6:8]))
-						if index >= len(Nose) {
-							return
-						}
-						host = Nose[index]
-					} else {
-						addr.IP = net.IP(b[4:8])
-					}
-				}
-
-				reply = []byte{0, 90, b[2], b[3], b[4], b[5], b[6], b[7]}
-			} else {
-				client.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+			user = SocksAuth(conn, users)
+			if user == nil {
 				return
 			}
 		} else {
-			logPrintln(3, "unknow from", client.RemoteAddr())
+			client.Write([]byte{0x05, 0x00})
+		}
+
+		var cmd byte
+		cmd, host, addr, err = ReadSocks5Request(br)
+		if err == errSocksAddrType {
+			// 0x08: address type not supported
+			logSocks.Trace("bad request", "client", client.RemoteAddr(), "error", err)
+			client.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		} else if err != nil {
+			logSocks.Error("read request", "client", client.RemoteAddr(), "error", err)
+			return
+		}
+
+		switch cmd {
+		case 0x01: //CONNECT
+		case 0x02: //BIND
+			SocksBind(conn, host, &addr, user)
+			return
+		case 0x03: //UDP ASSOCIATE
+			SocksUDPAssociate(conn, user)
+			return
+		default:
+			// 0x07: command not supported
+			logSocks.Trace("command not supported", "client", client.RemoteAddr(), "command", cmd)
+			client.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		reply = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	case 0x04:
+		if users != nil {
+			// SOCKS4 has no password, so it can not be authenticated
+			logSocks.Trace("socks4 not allowed with auth", "client", client.RemoteAddr())
+			client.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
 			return
 		}
 
+		var cmd byte
+		cmd, host, addr, err = ReadSocks4Request(br)
+		if err != nil || cmd != 0x01 {
+			logSocks.Trace("socks4 request rejected", "client", client.RemoteAddr(), "command", cmd, "error", err)
+			client.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		reply = []byte{0, 90, byte(addr.Port >> 8), byte(addr.Port), 0, 0, 0, 0}
+	default:
+		logSocks.Trace("unknown version", "client", client.RemoteAddr(), "version", version[0])
+		return
+	}
+
+	_, err = client.Write(reply)
+	if err != nil {
+		logSocks.Error("write reply", "client", client.RemoteAddr(), "error", err)
+		return
+	}
+
+	tcp_redirect(conn, &addr, host, nil, user)
+}
+
+// bufferedConn keeps the bytes a client pipelined behind its request.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+var errSocksAddrType = errors.New("socks address type not supported")
+
+func ReadSocks5Methods(r io.Reader) ([]byte, error) {
+	var b [255]byte
+	_, err := io.ReadFull(r, b[:2])
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != 0x05 {
+		return nil, fmt.Errorf("invalid socks version %d", b[0])
+	}
+	methods := b[:b[1]]
+	_, err = io.ReadFull(r, methods)
+	if err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func ReadSocks5Request(r io.Reader) (cmd byte, host string, addr net.TCPAddr, err error) {
+	var b [256]byte
+	_, err = io.ReadFull(r, b[:4])
+	if err != nil {
+		return
+	}
+	if b[0] != 0x05 {
+		err = fmt.Errorf("invalid socks version %d", b[0])
+		return
+	}
+	cmd = b[1]
+
+	switch b[3] {
+	case 0x01: //IPv4
+		addr.IP = make(net.IP, 4)
+		_, err = io.ReadFull(r, addr.IP)
+	case 0x03: //Domain
+		_, err = io.ReadFull(r, b[:1])
+		if err != nil {
+			return
+		}
+		addrLen := int(b[0])
+		if addrLen == 0 {
+			err = errors.New("empty socks domain")
+			return
+		}
+		_, err = io.ReadFull(r, b[:addrLen])
 		if err == nil {
-			_, err = client.Write(reply)
+			host = string(b[:addrLen])
 		}
+	case 0x04: //IPv6
+		addr.IP = make(net.IP, 16)
+		_, err = io.ReadFull(r, addr.IP)
+	default:
+		err = errSocksAddrType
+	}
+	if err != nil {
+		return
+	}
 
+	_, err = io.ReadFull(r, b[:2])
+	addr.Port = int(binary.BigEndian.Uint16(b[:2]))
+	return
+}
+
+func ReadSocks4Request(br *bufio.Reader) (cmd byte, host string, addr net.TCPAddr, err error) {
+	var b [8]byte
+	_, err = io.ReadFull(br, b[:])
+	if err != nil {
+		return
+	}
+	if b[0] != 0x04 {
+		err = fmt.Errorf("invalid socks version %d", b[0])
+		return
+	}
+	cmd = b[1]
+	addr.Port = int(binary.BigEndian.Uint16(b[2:4]))
+
+	_, err = readSocksString(br) //USERID
+	if err != nil {
+		return
+	}
+
+	ip := net.IP(b[4:8])
+	if b[4]|b[5]|b[6] == 0 && b[7] != 0 {
+		//SOCKS4A
+		host, err = readSocksString(br)
+		if err == nil && host == "" {
+			err = errors.New("empty socks4a domain")
+		}
+	} else if IsVirtualAddr(ip) {
+		host = GetNoseDomain(ip)
+		if host == "" {
+			err = fmt.Errorf("unknown virtual address %s", ip)
+		}
+	} else {
+		addr.IP = append(net.IP(nil), ip...)
+	}
+	return
+}
+
+func readSocksString(br *bufio.Reader) (string, error) {
+	var s []byte
+	for len(s) < 256 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(s), nil
+		}
+		s = append(s, c)
+	}
+	return "", errors.New("socks4 string too long")
+}
+
+func SocksBind(client net.Conn, host string, addr *net.TCPAddr, user *ProxyUser) {
+	fail := []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	if host == "" && addr.IP != nil {
+		host = GetNoseDomain(addr.IP)
+	}
+
+	name := host
+	if name == "" {
+		name = addr.IP.String()
+	}
+	pface, allowed := user.GetInterface(name)
+	if !allowed {
+		// 0x02: connection not allowed by ruleset
+		client.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	var raddr *net.TCPAddr
+	if host != "" {
+		if pface != nil {
+			raddr, _ = pface.ResolveTCPAddr(host, addr.Port)
+		} else {
+			raddr, _ = net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+		}
+	} else if !addr.IP.IsUnspecified() {
+		raddr = &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+	}
+
+	var laddr *net.TCPAddr
+	var err error
+	if pface != nil && pface.Device != "" {
+		ipv6 := raddr != nil && raddr.IP.To4() == nil
+		laddr, err = GetLocalAddr(pface.Device, ipv6)
 		if err != nil {
-			logPrintln(1, err)
+			logSocks.Error("bind", "client", client.RemoteAddr(), "domain", name, "interface", pface, "error", err)
+			client.Write(fail)
 			return
 		}
 	}
+	if laddr == nil && raddr != nil {
+		// let the routing table choose the address the peer can reach
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: raddr.IP, Port: 1})
+		if err == nil {
+			laddr = &net.TCPAddr{IP: conn.LocalAddr().(*net.UDPAddr).IP}
+			conn.Close()
+		}
+	}
+	if laddr == nil {
+		laddr = &net.TCPAddr{IP: client.LocalAddr().(*net.TCPAddr).IP}
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: laddr.IP, Port: 0})
+	if err != nil {
+		logSocks.Error("bind", "client", client.RemoteAddr(), "domain", name, "interface", pface, "error", err)
+		client.Write(fail)
+		return
+	}
+	defer l.Close()
+
+	bindAddr := l.Addr().(*net.TCPAddr)
+	logSocks.Info("bind", "client", user.Source(client.RemoteAddr()), "addr", bindAddr, "domain", name, "interface", pface)
+	_, err = client.Write(PackSocksReply(0, bindAddr))
+	if err != nil {
+		return
+	}
 
-	tcp_redirect(client, &addr, host, nil)
+	l.SetDeadline(time.Now().Add(time.Minute * 2))
+	var conn *net.TCPConn
+	for {
+		conn, err = l.AcceptTCP()
+		if err != nil {
+			logSocks.Debug("bind accept", "addr", bindAddr, "error", err)
+			client.Write(fail)
+			return
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if raddr == nil || raddr.IP.IsUnspecified() || peer.IP.Equal(raddr.IP) {
+			break
+		}
+		logSocks.Debug("bind unexpected peer", "addr", bindAddr, "server", peer)
+		conn.Close()
+	}
+	defer conn.Close()
+	l.Close()
+
+	_, err = client.Write(PackSocksReply(0, conn.RemoteAddr().(*net.TCPAddr)))
+	if err != nil {
+		return
+	}
+
+	_, _, err = relay(client, conn)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		logSocks.Error("relay", "client", client.RemoteAddr(), "domain", name, "interface", pface, "error", err)
+	}
+}
+
+func PackSocksReply(rep byte, addr *net.TCPAddr) []byte {
+	var reply []byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		reply = []byte{5, rep, 0, 1, ip4[0], ip4[1], ip4[2], ip4[3], 0, 0}
+	} else {
+		reply = make([]byte, 22)
+		copy(reply, []byte{5, rep, 0, 4})
+		copy(reply[4:], addr.IP.To16())
+	}
+	binary.BigEndian.PutUint16(reply[len(reply)-2:], uint16(addr.Port))
+	return reply
+}
+
+func SocksAuth(client net.Conn, users map[string]*ProxyUser) *ProxyUser {
+	var b [256]byte
+	_, err := io.ReadFull(client, b[:2])
+	if err != nil || b[0] != 0x01 {
+		return nil
+	}
+	ulen := int(b[1])
+	_, err = io.ReadFull(client, b[:ulen+1])
+	if err != nil {
+		return nil
+	}
+	name := string(b[:ulen])
+	plen := int(b[ulen])
+	_, err = io.ReadFull(client, b[:plen])
+	if err != nil {
+		return nil
+	}
+	password := string(b[:plen])
+
+	user := CheckUser(users, name, password)
+	if user == nil {
+		logSocks.Debug("auth failed", "client", client.RemoteAddr(), "user", name)
+		client.Write([]byte{0x01, 0x01})
+		return nil
+	}
+
+	_, err = client.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+func CheckUser(users map[string]*ProxyUser, name string, password string) *ProxyUser {
+	user, ok := users[name]
+	if !ok {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+func HTTPAuth(headers []string, users map[string]*ProxyUser) *ProxyUser {
+	for _, line := range headers {
+		name, credentials := splitHeader(line)
+		if !strings.EqualFold(name, "Proxy-Authorization") {
+			continue
+		}
+		if len(credentials) < 6 || !strings.EqualFold(credentials[:6], "Basic ") {
+			return nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(credentials[6:])
+		if err != nil {
+			return nil
+		}
+		pair := strings.SplitN(string(decoded), ":", 2)
+		if len(pair) < 2 {
+			return nil
+		}
+		return CheckUser(users, pair[0], pair[1])
+	}
+	return nil
 }
 
 func validOptionalPort(port string) bool {
@@ -157,51 +464,48 @@ func splitHostPort(hostport string) (host string, port int) {
 }
 
 func HTTPProxy(client net.Conn) {
+	HTTPProxyWithUsers(client, nil)
+}
+
+func HTTPProxyWithUsers(client net.Conn, users map[string]*ProxyUser) {
 	defer client.Close()
 
-	var b [1500]byte
-	n, err := client.Read(b[:])
+	br := bufio.NewReader(client)
+	head, err := ReadHTTPHead(br)
 	if err != nil {
-		log.Println(err)
+		logHTTP.Error("read request", "client", client.RemoteAddr(), "error", err)
 		return
 	}
 
-	request := b[:n]
-	var method, host string
-	var port int
-
-	end := bytes.IndexByte(request, '\n')
-	if end < 0 {
+	request := strings.SplitN(head[0], " ", 3)
+	if len(request) != 3 {
+		httpError(client, "400 Bad Request")
 		return
 	}
 
-	fmt.Sscanf(string(request[:end]), "%s%s", &method, &host)
-	host, port = splitHostPort(host)
-	if port == 0 {
-		port = 80
+	var user *ProxyUser
+	if users != nil {
+		user = HTTPAuth(head[1:], users)
+		if user == nil {
+			logHTTP.Debug("auth failed", "client", client.RemoteAddr())
+			fmt.Fprint(client, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"phantomsocks\"\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
 	}
 
-	if method == "CONNECT" {
-		fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
-		n, err = client.Read(b[:])
-		if err != nil {
-			logPrintln(1, err)
+	if request[0] == "CONNECT" {
+		host, port := splitHostPort(request[1])
+		if host == "" {
+			httpError(client, "400 Bad Request")
 			return
 		}
-		tcp_redirect(client, &net.TCPAddr{Port: port}, host, b[:n])
-		return
-	} else {
-		if strings.HasPrefix(host, "http://") {
-			host = host[7:]
-			index := strings.IndexByte(host, '/')
-			if index != -1 {
-				host = host[:index]
-			}
-			request = bytes.Replace(b[:n], []byte("http://"+host), nil, 1)
-			HttpMove(client, "https", request)
-		} else {
-			return
+		if port == 0 {
+			port = 443
 		}
+		fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		tcp_redirect(&bufferedConn{client, br}, &net.TCPAddr{Port: port}, host, nil, user)
+	} else {
+		HTTPForward(client, br, head, user)
 	}
 }
 
@@ -211,7 +515,7 @@ func SNIProxy(client net.Conn) {
 	var b [1460]byte
 	n, err := client.Read(b[:])
 	if err != nil {
-		log.Println(err)
+		logRedirect.Error("sni read", "client", client.RemoteAddr(), "error", err)
 		return
 	}
 
@@ -245,14 +549,14 @@ func SNIProxy(client net.Conn) {
 		}
 	}
 
-	tcp_redirect(client, &net.TCPAddr{Port: port}, host, b[:n])
+	tcp_redirect(client, &net.TCPAddr{Port: port}, host, b[:n], nil)
 }
 
 func RedirectProxy(client net.Conn) {
 	addr, err := GetOriginalDST(client.(*net.TCPConn))
 	if err != nil {
 		client.Close()
-		logPrintln(1, err)
+		logRedirect.Error("original destination", "client", client.RemoteAddr(), "error", err)
 		return
 	}
 
@@ -260,36 +564,34 @@ func RedirectProxy(client net.Conn) {
 		client.Close()
 		return
 	}
-	tcp_redirect(client, addr, "", nil)
+	tcp_redirect(client, addr, "", nil, nil)
 }
 
-func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []byte) {
+func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []byte, user *ProxyUser) {
 	defer client.Close()
 
 	var conn net.Conn
 	var err error
+	var pface *PhantomInterface
+	var source string
 	{
 		var port int
-		if domain == "" {
-			switch addr.IP[0] {
-			case 0x00:
-				index := int(binary.BigEndian.Uint32(addr.IP[12:16]))
-				if index >= len(Nose) {
-					return
-				}
-				domain = Nose[index]
-			case VirtualAddrPrefix:
-				index := int(binary.BigEndian.Uint16(addr.IP[2:4]))
-				if index >= len(Nose) {
-					return
-				}
-				domain = Nose[index]
+		if domain == "" && IsVirtualAddr(addr.IP) {
+			domain = GetNoseDomain(addr.IP)
+			if domain == "" {
+				return
 			}
 		}
 		port = addr.Port
 
-		pface := DefaultProfile.GetInterface(domain)
-		if pface != nil && (pface.Protocol != 0 || pface.Hint != 0) {
+		var allowed bool
+		pface, allowed = user.GetInterface(domain)
+		if !allowed {
+			return
+		}
+		source = user.Source(client.RemoteAddr())
+		redirectTotal.Add(1, interfaceName(pface), redirectDomain(user, domain))
+		if pface != nil && (pface.Protocol != 0 || pface.Hint != 0 || pface.Fallback != nil) {
 			if pface.Hint&HINT_NOTCP != 0 {
 				time.Sleep(time.Second)
 				return
@@ -299,7 +601,7 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 				b := make([]byte, 1460)
 				n, err := client.Read(b)
 				if err != nil {
-					logPrintln(1, err)
+					logRedirect.Error("read header", "client", source, "domain", domain, "interface", pface, "error", err)
 					return
 				}
 				header = b[:n]
@@ -310,7 +612,7 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 				if length > 0 {
 					_domain := string(header[offset : offset+length])
 					if domain != _domain {
-						pface = DefaultProfile.GetInterface(_domain)
+						pface, _ = user.GetInterface(_domain)
 						if pface == nil {
 							return
 						}
@@ -318,70 +620,51 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 					}
 				}
 
-				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port, pface)
-
-				conn, _, err = pface.Dial(domain, port, header)
-				if err != nil {
-					logPrintln(1, domain, err)
-					return
-				}
-			} else {
-				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port, pface)
-				if pface.Hint&HINT_HTTP3 != 0 {
-					HttpMove(client, "h3", header)
-					return
-				} else if pface.Hint&HINT_HTTPS != 0 {
-					HttpMove(client, "https", header)
-					return
-				} else if pface.Hint&HINT_MOVE != 0 {
-					HttpMove(client, pface.Address, header)
-					return
-				} else if pface.Hint&HINT_STRIP != 0 {
-					if pface.Hint&HINT_FRONTING != 0 {
-						conn, err = pface.DialStrip(domain, "")
-						domain = ""
-					} else {
-						conn, err = pface.DialStrip(domain, domain)
-					}
-
-					if err != nil {
-						logPrintln(1, err)
-						return
-					}
-					_, err = conn.Write(header)
+				if pface.Fallback != nil {
+					conn, pface, err = dialFallback(pface, domain, port, header, user, source)
 					if err != nil {
-						logPrintln(1, err)
 						return
 					}
 				} else {
-					var info *ConnectionInfo
-					conn, info, err = pface.Dial(domain, port, header)
+					logRedirect.Info("redirect", "client", source, "domain", domain, "port", port, "interface", pface)
+
+					conn, _, err = pface.Dial(domain, port, header)
 					if err != nil {
-						logPrintln(1, domain, err)
+						logRedirect.Error("dial", "client", source, "domain", domain, "port", port, "interface", pface, "error", err)
 						return
 					}
+				}
+			} else {
+				logRedirect.Info("redirect", "client", source, "domain", domain, "port", port, "interface", pface)
+				var info *ConnectionInfo
+				conn, info, err = pface.DialHTTP(client, domain, port, header)
+				if err != nil {
+					logRedirect.Error("dial", "client", source, "domain", domain, "port", port, "interface", pface, "error", err)
+					return
+				}
 
-					if info != nil {
-						pface.Keep(client, conn, info)
-						return
-					}
+				if info != nil {
+					tracked := TrackConn(client, source, net.JoinHostPort(domain, strconv.Itoa(port)), pface)
+					pface.Keep(tracked, conn, info)
+					tracked.Untrack()
+					return
 				}
 			}
 		} else if addr.IP != nil {
-			logPrintln(1, "Redirect:", client.RemoteAddr(), "->", addr)
+			logRedirect.Info("redirect", "client", source, "addr", addr)
 			conn, err = net.DialTCP("tcp", nil, addr)
 			if err != nil {
-				logPrintln(1, domain, err)
+				logRedirect.Error("dial", "client", source, "addr", addr, "error", err)
 				return
 			}
 			if header != nil {
 				conn.Write(header)
 			}
 		} else {
-			logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port)
+			logRedirect.Info("redirect", "client", source, "domain", domain, "port", port)
 			conn, err = net.Dial("tcp", domain+":"+strconv.Itoa(port))
 			if err != nil {
-				logPrintln(1, domain, err)
+				logRedirect.Error("dial", "client", source, "domain", domain, "port", port, "error", err)
 				return
 			}
 			if header != nil {
@@ -396,21 +679,24 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 
 	defer conn.Close()
 
-	_, _, err = relay(client, conn)
+	target := addr.String()
+	if domain != "" {
+		target = net.JoinHostPort(domain, strconv.Itoa(addr.Port))
+	}
+	tracked := TrackConn(client, source, target, pface)
+	defer tracked.Untrack()
+
+	_, _, err = relay(tracked, conn)
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return // ignore i/o timeout
 		}
-		logPrintln(1, "relay error:", err)
+		logRedirect.Error("relay", "client", source, "domain", domain, "interface", pface, "error", err)
 	}
 }
 
-func QUICProxy(address string) {
-	client, err := ListenUDP(address)
-	if err != nil {
-		logPrintln(1, err)
-		return
-	}
+func QUICProxy(
+	client *net.UDPConn) {
 	defer client.Close()
 
 	var UDPLock sync.Mutex
@@ -420,7 +706,9 @@ func QUICProxy(address string) {
 	for {
 		n, clientAddr, err := client.ReadFromUDP(data)
 		if err != nil {
-			logPrintln(1, err)
+			if !errors.Is(err, net.ErrClosed) {
+				logUDP.Error("quic read", "error", err)
+			}
 			return
 		}
 
@@ -431,20 +719,20 @@ func QUICProxy(address string) {
 		} else {
 			SNI := GetQUICSNI(data[:n])
 			if SNI != "" {
-				server := DefaultProfile.GetInterface(SNI)
+				server := DefaultProfile().GetInterface(SNI)
 				if server.Hint&HINT_UDP == 0 {
 					continue
 				}
-				_, ips := NSLookup(SNI, server.Hint, server.DNS)
+				_, ips := NSLookup(SNI, server.Hint, server.DNS, server.DNSPolicy)
 				if ips == nil {
 					continue
 				}
 
-				logPrintln(1, "[QUIC]", clientAddr.String(), SNI, ips)
+				logUDP.Info("quic", "client", clientAddr, "domain", SNI, "ips", ips, "interface", server)
 
 				udpConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: ips[0], Port: 443})
 				if err != nil {
-					logPrintln(1, err)
+					logUDP.Error("quic", "client", clientAddr, "domain", SNI, "interface", server, "error", err)
 					continue
 				}
 
@@ -452,7 +740,7 @@ func QUICProxy(address string) {
 					zero_data := make([]byte, 8+rand.Intn(1024))
 					_, err = udpConn.Write(zero_data)
 					if err != nil {
-						logPrintln(1, err)
+						logUDP.Error("quic", "client", clientAddr, "domain", SNI, "interface", server, "error", err)
 						continue
 					}
 				}
@@ -460,11 +748,12 @@ func QUICProxy(address string) {
 				UDPMap[clientAddr.String()] = udpConn
 				_, err = udpConn.Write(data[:n])
 				if err != nil {
-					logPrintln(1, err)
+					logUDP.Error("quic", "client", clientAddr, "domain", SNI, "interface", server, "error", err)
 					continue
 				}
 
 				go func(clientAddr net.UDPAddr) {
+					defer udpSession("quic")()
 					data := make([]byte, 1500)
 					udpConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
 					for {
@@ -485,17 +774,7 @@ func QUICProxy(address string) {
 	}
 }
 
-func SocksUDPProxy(address string) {
-	laddr, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		logPrintln(1, err)
-		return
-	}
-	local, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		logPrintln(1, err)
-		return
-	}
+func SocksUDPProxy(local *net.UDPConn) {
 	defer local.Close()
 
 	var ConnLock sync.Mutex
@@ -504,7 +783,10 @@ func SocksUDPProxy(address string) {
 	for {
 		n, srcAddr, err := local.ReadFromUDP(data)
 		if err != nil {
-			logPrintln(1, err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logUDP.Error("socks4 udp read", "error", err)
 			continue
 		}
 
@@ -528,13 +810,12 @@ func SocksUDPProxy(address string) {
 			ConnLock.Unlock()
 
 			var remoteConn net.Conn = nil
-			if data[4] == VirtualAddrPrefix {
-				index := int(binary.BigEndian.Uint32(data[6:8]))
-				if index >= len(Nose) {
-					return
+			if IsVirtualAddr(dstAddr.IP) {
+				host = GetNoseDomain(dstAddr.IP)
+				if host == "" {
+					continue
 				}
-				host = Nose[index]
-				server := DefaultProfile.GetInterface(host)
+				server := DefaultProfile().GetInterface(host)
 				if server.Protocol != 0 {
 					continue
 				}
@@ -546,16 +827,16 @@ func SocksUDPProxy(address string) {
 						continue
 					}
 				}
-				_, ips := NSLookup(host, server.Hint, server.DNS)
+				_, ips := NSLookup(host, server.Hint, server.DNS, server.DNSPolicy)
 				if ips == nil {
 					continue
 				}
 
-				logPrintln(1, "Socks4U:", srcAddr, "->", host, port)
+				logUDP.Info("socks4 udp", "client", srcAddr, "domain", host, "port", port, "interface", server)
 				raddr := net.UDPAddr{IP: ips[0], Port: port}
 				remoteConn, err = net.DialUDP("udp", nil, &raddr)
 				if err != nil {
-					logPrintln(1, err)
+					logUDP.Error("socks4 udp", "client", srcAddr, "domain", host, "interface", server, "error", err)
 					continue
 				}
 
@@ -563,24 +844,25 @@ func SocksUDPProxy(address string) {
 					zero_data := make([]byte, 8+rand.Intn(1024))
 					_, err = remoteConn.Write(zero_data)
 					if err != nil {
-						logPrintln(1, err)
+						logUDP.Error("socks4 udp", "client", srcAddr, "domain", host, "interface", server, "error", err)
 						continue
 					}
 				}
 
 				_, err = remoteConn.Write(data[8:n])
 			} else {
-				logPrintln(1, "Socks4U:", srcAddr, "->", dstAddr)
+				logUDP.Info("socks4 udp", "client", srcAddr, "addr", &dstAddr)
 				remoteConn, err = net.DialUDP("udp", nil, &dstAddr)
 				_, err = remoteConn.Write(data[8:n])
 			}
 
 			if err != nil {
-				logPrintln(1, err)
+				logUDP.Error("socks4 udp", "client", srcAddr, "domain", host, "port", port, "error", err)
 				continue
 			}
 
 			go func(srcAddr net.UDPAddr, remoteConn net.Conn, key string) {
+				defer udpSession("socks4")()
 				data := make([]byte, 1472)
 				remoteConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
 				for {
@@ -601,3 +883,262 @@ func SocksUDPProxy(address string) {
 		}
 	}
 }
+
+func SocksUDPAssociate(client net.Conn, user *ProxyUser) {
+	clientAddr, ok := client.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		client.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	localAddr, ok := client.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		client.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Port: 0, Zone: localAddr.Zone})
+	if err != nil {
+		logSocks.Error("udp associate", "client", client.RemoteAddr(), "error", err)
+		client.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer local.Close()
+
+	bindAddr := local.LocalAddr().(*net.UDPAddr)
+	_, err = client.Write(PackSocksReply(0, &net.TCPAddr{IP: bindAddr.IP, Port: bindAddr.Port}))
+	if err != nil {
+		logSocks.Error("udp associate", "client", client.RemoteAddr(), "error", err)
+		return
+	}
+
+	logSocks.Info("udp associate", "client", user.Source(client.RemoteAddr()), "addr", bindAddr)
+
+	var ConnLock sync.Mutex
+	var ConnMap map[string]net.Conn = make(map[string]net.Conn)
+	closed := false
+
+	go func() {
+		data := make([]byte, 1500)
+		for {
+			n, srcAddr, err := local.ReadFromUDP(data)
+			if err != nil {
+				return
+			}
+			if !srcAddr.IP.Equal(clientAddr.IP) {
+				continue
+			}
+
+			host, dstIP, port, offset := ParseSocksUDPHeader(data[:n])
+			if offset == 0 {
+				continue
+			}
+
+			dst := host
+			if dst == "" {
+				dst = dstIP.String()
+			}
+			key := srcAddr.String() + "," + net.JoinHostPort(dst, strconv.Itoa(port))
+			ConnLock.Lock()
+			conn, ok := ConnMap[key]
+			ConnLock.Unlock()
+			if ok {
+				conn.Write(data[offset:n])
+				continue
+			}
+
+			remoteConn, proxyConn, err := socksDialUDP(srcAddr, host, dstIP, port, data[offset:n], user)
+			if err != nil {
+				logUDP.Error("socks5 udp", "client", srcAddr, "domain", dst, "port", port, "error", err)
+				continue
+			}
+			if remoteConn == nil {
+				continue
+			}
+
+			_, err = remoteConn.Write(data[offset:n])
+			if err != nil {
+				logUDP.Error("socks5 udp", "client", srcAddr, "domain", dst, "port", port, "error", err)
+				remoteConn.Close()
+				if proxyConn != nil {
+					proxyConn.Close()
+				}
+				continue
+			}
+
+			ConnLock.Lock()
+			if closed {
+				ConnLock.Unlock()
+				remoteConn.Close()
+				if proxyConn != nil {
+					proxyConn.Close()
+				}
+				return
+			}
+			ConnMap[key] = remoteConn
+			ConnLock.Unlock()
+
+			header := PackSocksUDPHeader(host, dstIP, port)
+			go func(srcAddr net.UDPAddr, remoteConn, proxyConn net.Conn, key string) {
+				defer udpSession("socks5")()
+				data := make([]byte, 1500)
+				copy(data, header)
+				for {
+					remoteConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
+					n, err := remoteConn.Read(data[len(header):])
+					if err != nil {
+						ConnLock.Lock()
+						delete(ConnMap, key)
+						ConnLock.Unlock()
+						remoteConn.Close()
+						if proxyConn != nil {
+							proxyConn.Close()
+						}
+						return
+					}
+					local.WriteToUDP(data[:len(header)+n], &srcAddr)
+				}
+			}(*srcAddr, remoteConn, proxyConn, key)
+		}
+	}()
+
+	// The association lives as long as the TCP control connection.
+	var b [64]byte
+	for {
+		_, err := client.Read(b[:])
+		if err != nil {
+			break
+		}
+	}
+
+	ConnLock.Lock()
+	closed = true
+	for _, conn := range ConnMap {
+		conn.Close()
+	}
+	ConnLock.Unlock()
+}
+
+func socksDialUDP(client net.Addr, host string, ip net.IP, port int, payload []byte, user *ProxyUser) (net.Conn, net.Conn, error) {
+	if host == "" {
+		host = GetNoseDomain(ip)
+		if host == "" {
+			_, allowed := user.GetInterface(ip.String())
+			if !allowed {
+				return nil, nil, nil
+			}
+			logUDP.Info("socks5 udp", "client", client, "addr", ip, "port", port)
+			conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+			return conn, nil, err
+		}
+	}
+
+	pface, allowed := user.GetInterface(host)
+	if !allowed {
+		return nil, nil, nil
+	}
+	if pface == nil {
+		logUDP.Info("socks5 udp", "client", client, "domain", host, "port", port)
+		conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		return conn, nil, err
+	}
+
+	if pface.Hint&HINT_MODIFY != 0 || pface.Protocol != 0 {
+		if pface.Hint&HINT_UDP == 0 {
+			if pface.Hint&(HINT_HTTP3) == 0 {
+				logUDP.Verbose("socks5 udp not allowed", "client", client, "domain", host, "interface", pface)
+				return nil, nil, nil
+			}
+			if GetQUICVersion(payload) == 0 {
+				logUDP.Verbose("socks5 udp not h3", "client", client, "domain", host, "interface", pface)
+				return nil, nil, nil
+			}
+		}
+	}
+
+	logUDP.Info("socks5 udp", "client", client, "domain", host, "port", port, "interface", pface)
+
+	remoteConn, proxyConn, err := pface.DialUDPProxy(host, port)
+	if err != nil {
+		if proxyConn != nil {
+			proxyConn.Close()
+		}
+		return nil, nil, err
+	}
+
+	if pface.Hint&HINT_ZERO != 0 {
+		zero_data := make([]byte, 8+rand.Intn(1024))
+		_, err = remoteConn.Write(zero_data)
+		if err != nil {
+			remoteConn.Close()
+			if proxyConn != nil {
+				proxyConn.Close()
+			}
+			return nil, nil, err
+		}
+	}
+
+	return remoteConn, proxyConn, nil
+}
+
+// ParseSocksUDPHeader parses the RFC 1928 UDP request header and returns
+// the destination and the offset of the payload, or offset 0 if invalid.
+func ParseSocksUDPHeader(b []byte) (host string, ip net.IP, port int, offset int) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return "", nil, 0, 0
+	}
+	if b[2] != 0 {
+		// fragmentation is not supported
+		return "", nil, 0, 0
+	}
+
+	switch b[3] {
+	case 0x01: //IPv4
+		if len(b) < 10 {
+			return "", nil, 0, 0
+		}
+		ip = net.IP(append([]byte{}, b[4:8]...))
+		offset = 8
+	case 0x03: //Domain
+		if len(b) < 5 {
+			return "", nil, 0, 0
+		}
+		addrLen := int(b[4])
+		if len(b) < 7+addrLen {
+			return "", nil, 0, 0
+		}
+		host = string(b[5 : 5+addrLen])
+		offset = 5 + addrLen
+	case 0x04: //IPv6
+		if len(b) < 22 {
+			return "", nil, 0, 0
+		}
+		ip = net.IP(append([]byte{}, b[4:20]...))
+		offset = 20
+	default:
+		return "", nil, 0, 0
+	}
+
+	port = int(binary.BigEndian.Uint16(b[offset : offset+2]))
+	offset += 2
+	return
+}
+
+func PackSocksUDPHeader(host string, ip net.IP, port int) []byte {
+	var header []byte
+	if host != "" {
+		header = make([]byte, 7+len(host))
+		header[3] = 0x03
+		header[4] = byte(len(host))
+		copy(header[5:], []byte(host))
+	} else if ip4 := ip.To4(); ip4 != nil {
+		header = make([]byte, 10)
+		header[3] = 0x01
+		copy(header[4:], ip4)
+	} else {
+		header = make([]byte, 22)
+		header[3] = 0x04
+		copy(header[4:], ip.To16())
+	}
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(port))
+	return header
+}
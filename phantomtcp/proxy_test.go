@@ -0,0 +1,234 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var socks5Requests = []struct {
+	name string
+	data []byte
+	host string
+	ip   net.IP
+	port int
+}{
+	{"ipv4", []byte{5, 1, 0, 1, 1, 2, 3, 4, 0x01, 0xbb}, "", net.IP{1, 2, 3, 4}, 443},
+	{"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0, 80), "example.com", nil, 80},
+	{"ipv6", []byte{5, 1, 0, 4, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}, "", net.ParseIP("2001:db8::1"), 8080},
+	{"long domain", append(append([]byte{5, 1, 0, 3, 255}, strings.Repeat("a", 255)...), 0, 80), strings.Repeat("a", 255), nil, 80},
+}
+
+func TestReadSocks5Request(t *testing.T) {
+	for _, tt := range socks5Requests {
+		readers := map[string]io.Reader{
+			"whole":    bytes.NewReader(tt.data),
+			"bytewise": iotest.OneByteReader(bytes.NewReader(tt.data)),
+		}
+		for mode, r := range readers {
+			cmd, host, addr, err := ReadSocks5Request(r)
+			if err != nil {
+				t.Errorf("%s/%s: %v", tt.name, mode, err)
+				continue
+			}
+			if cmd != 1 || host != tt.host || !addr.IP.Equal(tt.ip) || addr.Port != tt.port {
+				t.Errorf("%s/%s: got %d %q %v, want %q %v", tt.name, mode, cmd, host, addr, tt.host, tt.ip)
+			}
+		}
+
+		for n := 0; n < len(tt.data); n++ {
+			_, _, _, err := ReadSocks5Request(bytes.NewReader(tt.data[:n]))
+			if err == nil {
+				t.Errorf("%s: no error for %d of %d bytes", tt.name, n, len(tt.data))
+			}
+		}
+	}
+}
+
+func TestReadSocks5RequestMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"version":      {4, 1, 0, 1, 1, 2, 3, 4, 0, 80},
+		"address type": {5, 1, 0, 2, 1, 2, 3, 4, 0, 80},
+		"empty domain": {5, 1, 0, 3, 0, 0, 80},
+	} {
+		_, _, _, err := ReadSocks5Request(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestReadSocks5Methods(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		methods []byte
+		ok      bool
+	}{
+		{"two", []byte{5, 2, 0, 2}, []byte{0, 2}, true},
+		{"none", []byte{5, 0}, []byte{}, true},
+		{"all", append([]byte{5, 255}, make([]byte, 255)...), make([]byte, 255), true},
+		{"version", []byte{4, 1, 0}, nil, false},
+		{"truncated", []byte{5, 3, 0, 2}, nil, false},
+		{"empty", nil, nil, false},
+	}
+	for _, tt := range tests {
+		for _, r := range []io.Reader{bytes.NewReader(tt.data), iotest.OneByteReader(bytes.NewReader(tt.data))} {
+			methods, err := ReadSocks5Methods(r)
+			if (err == nil) != tt.ok {
+				t.Errorf("%s: error %v", tt.name, err)
+			} else if tt.ok && !bytes.Equal(methods, tt.methods) {
+				t.Errorf("%s: got %v, want %v", tt.name, methods, tt.methods)
+			}
+		}
+	}
+}
+
+func TestReadSocks4Request(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		host string
+		ip   net.IP
+		ok   bool
+	}{
+		{"socks4", []byte{4, 1, 0, 80, 1, 2, 3, 4, 'u', 0}, "", net.IP{1, 2, 3, 4}, true},
+		{"socks4a", append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com\x00"...), "example.com", nil, true},
+		{"version", []byte{5, 1, 0, 80, 1, 2, 3, 4, 0}, "", nil, false},
+		{"no userid end", []byte{4, 1, 0, 80, 1, 2, 3, 4, 'u'}, "", nil, false},
+		{"empty domain", []byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 0}, "", nil, false},
+		{"long userid", append(append([]byte{4, 1, 0, 80, 1, 2, 3, 4}, bytes.Repeat([]byte{'u'}, 300)...), 0), "", nil, false},
+		{"long domain", append(append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, bytes.Repeat([]byte{'a'}, 300)...), 0), "", nil, false},
+		{"truncated", []byte{4, 1, 0, 80, 1, 2}, "", nil, false},
+	}
+	for _, tt := range tests {
+		for _, r := range []io.Reader{bytes.NewReader(tt.data), iotest.OneByteReader(bytes.NewReader(tt.data))} {
+			cmd, host, addr, err := ReadSocks4Request(bufio.NewReaderSize(r, 16))
+			if (err == nil) != tt.ok {
+				t.Errorf("%s: error %v", tt.name, err)
+				continue
+			}
+			if tt.ok && (cmd != 1 || host != tt.host || !addr.IP.Equal(tt.ip) || addr.Port != 80) {
+				t.Errorf("%s: got %d %q %v", tt.name, cmd, host, addr)
+			}
+		}
+	}
+}
+
+// A client may send the greeting, the request and its first payload in one
+// segment, the payload must still reach the upstream.
+func TestSocks5Coalesced(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+	var data []byte
+	data = append(data, 5, 1, 0)
+	data = append(data, socks5Requests[1].data...)
+	data = append(data, payload...)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(data)
+
+	br := bufio.NewReader(server)
+	methods, err := ReadSocks5Methods(br)
+	if err != nil || !bytes.Equal(methods, []byte{0}) {
+		t.Fatalf("methods %v %v", methods, err)
+	}
+	_, host, _, err := ReadSocks5Request(br)
+	if err != nil || host != "example.com" {
+		t.Fatalf("request %q %v", host, err)
+	}
+
+	conn := &bufferedConn{server, br}
+	b := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, b)
+	if err != nil || !bytes.Equal(b, payload) {
+		t.Fatalf("payload %q %v", b, err)
+	}
+}
+
+var httpHeads = []struct {
+	name  string
+	data  string
+	lines []string
+}{
+	{"request", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		[]string{"GET http://example.com/ HTTP/1.1", "Host: example.com"}},
+	{"bare newlines", "GET / HTTP/1.1\nHost: example.com\n\n", []string{"GET / HTTP/1.1", "Host: example.com"}},
+	{"leading empty lines", "\r\n\r\nGET / HTTP/1.1\r\n\r\n", []string{"GET / HTTP/1.1"}},
+	{"line over the buffer", "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("c", 100) + "\r\n\r\n",
+		[]string{"GET / HTTP/1.1", "Cookie: " + strings.Repeat("c", 100)}},
+}
+
+func TestReadHTTPHead(t *testing.T) {
+	for _, tt := range httpHeads {
+		readers := map[string]io.Reader{
+			"whole":    strings.NewReader(tt.data),
+			"bytewise": iotest.OneByteReader(strings.NewReader(tt.data)),
+		}
+		for mode, r := range readers {
+			lines, err := ReadHTTPHead(bufio.NewReaderSize(r, 16))
+			if err != nil || strings.Join(lines, "|") != strings.Join(tt.lines, "|") {
+				t.Errorf("%s/%s: got %q %v", tt.name, mode, lines, err)
+			}
+		}
+
+		for n := 0; n < len(tt.data); n++ {
+			_, err := ReadHTTPHead(bufio.NewReaderSize(strings.NewReader(tt.data[:n]), 16))
+			if err == nil {
+				t.Errorf("%s: no error for %d of %d bytes", tt.name, n, len(tt.data))
+			}
+		}
+	}
+}
+
+func TestReadHTTPHeadMalformed(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		err  error
+	}{
+		"empty":          {"", io.EOF},
+		"only newlines":  {"\r\n\r\n", io.ErrUnexpectedEOF},
+		"no end":         {"GET / HTTP/1.1\r\nHost: a\r\n", io.ErrUnexpectedEOF},
+		"no newline":     {"GET / HTTP/1.1", io.ErrUnexpectedEOF},
+		"too large":      {"GET / HTTP/1.1\r\nX: " + strings.Repeat("a", maxHTTPHeadSize) + "\r\n\r\n", nil},
+		"too many lines": {"GET / HTTP/1.1\r\n" + strings.Repeat("X: a\r\n", maxHTTPHeadSize/6), nil},
+	}
+	for name, tt := range tests {
+		for _, r := range []io.Reader{strings.NewReader(tt.data), iotest.OneByteReader(strings.NewReader(tt.data))} {
+			lines, err := ReadHTTPHead(bufio.NewReader(r))
+			if err == nil || (tt.err != nil && err != tt.err) {
+				t.Errorf("%s: got %q %v, want %v", name, lines, err, tt.err)
+			}
+		}
+	}
+}
+
+// A client may send the head, the body and the next request in one
+// segment, they stay in the reader after the head.
+func TestReadHTTPHeadCoalesced(t *testing.T) {
+	data := "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nbody" + "GET / HTTP/1.1\r\n\r\n"
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte(data))
+
+	br := bufio.NewReader(server)
+	lines, err := ReadHTTPHead(br)
+	if err != nil || len(lines) != 2 || lines[1] != "Content-Length: 4" {
+		t.Fatalf("first head %q %v", lines, err)
+	}
+	body := make([]byte, 4)
+	_, err = io.ReadFull(br, body)
+	if err != nil || string(body) != "body" {
+		t.Fatalf("body %q %v", body, err)
+	}
+	lines, err = ReadHTTPHead(br)
+	if err != nil || len(lines) != 1 || lines[0] != "GET / HTTP/1.1" {
+		t.Fatalf("second head %q %v", lines, err)
+	}
+}
@@ -4,11 +4,11 @@
 package phantomtcp
 
 import (
-	"fmt"
 	"net"
 	"strconv"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -28,13 +28,14 @@ var HintMap = map[string]uint32{
 	"strip":    HINT_STRIP,
 	"fronting": HINT_FRONTING,
 
-	"ttl":    HINT_TTL,
-	"mss":    HINT_MSS,
-	"w-md5":  HINT_WMD5,
-	"n-ack":  HINT_NACK,
-	"w-ack":  HINT_WACK,
-	"w-csum": HINT_WCSUM,
-	"w-seq":  HINT_WSEQ,
+	"ttl":     HINT_TTL,
+	"rel-ttl": HINT_RTTL,
+	"mss":     HINT_MSS,
+	"w-md5":   HINT_WMD5,
+	"n-ack":   HINT_NACK,
+	"w-ack":   HINT_WACK,
+	"w-csum":  HINT_WCSUM,
+	"w-seq":   HINT_WSEQ,
 
 	"udp":    HINT_UDP,
 	"no-tcp": HINT_NOTCP,
@@ -59,7 +60,7 @@ func connectionMonitor(device string, ipv6 bool) {
 	start_monitor := func() error {
 		localaddr, err := GetLocalAddr(device, ipv6)
 		if err != nil {
-			logPrintln(1, device, err)
+			logPacket.Error("local address", "device", device, "error", err)
 			return err
 		}
 
@@ -76,22 +77,42 @@ func connectionMonitor(device string, ipv6 bool) {
 			handle, err = net.ListenIP("ip4:tcp", &net.IPAddr{IP: localaddr.IP, Zone: ""})
 		}
 
-		fmt.Printf("Device: %v (%s)\n", device, localaddr.IP.String())
+		logPacket.Notice("device", "device", device, "addr", localaddr.IP)
 
 		if err != nil {
-			fmt.Printf("sockraw open failed: %v", err)
+			logPacket.Notice("sockraw open failed", "device", device, "error", err)
 			return err
 		}
 		defer handle.Close()
 
+		// the hop limit of IPv6 packets comes in a control message
+		if rawConn, err := handle.SyscallConn(); ipv6 && err == nil {
+			rawConn.Control(func(fd uintptr) {
+				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+			})
+		}
+
 		buf := make([]byte, 1500)
+		oob := make([]byte, 64)
 		for {
-			n, addr, err := handle.ReadFrom(buf)
+			n, oobn, _, addr, err := handle.ReadMsgIP(buf, oob)
 			if err != nil {
-				logPrintln(1, err)
+				logPacket.Error("read", "device", device, "error", err)
 				continue
 			}
-			if buf[13] != 18 {
+			var ttl byte
+			if ipv6 {
+				ttl = hopLimit(oob[:oobn])
+			} else {
+				// unlike ReadFrom, ReadMsgIP keeps the IPv4 header
+				hl := int(buf[0]&0x0f) << 2
+				if hl < 20 || n < hl {
+					continue
+				}
+				ttl = buf[8]
+				n = copy(buf, buf[hl:n])
+			}
+			if n < 20 || buf[13] != 18 {
 				continue
 			}
 
@@ -101,6 +122,9 @@ func connectionMonitor(device string, ipv6 bool) {
 			synAddr := net.JoinHostPort(addr.String(), strconv.Itoa(int(tcp.SrcPort)))
 			_, ok := ConnSyn.Load(synAddr)
 			if ok {
+				if ttl != 0 {
+					storeHops(addr.IP, ttl)
+				}
 				if ipv6 {
 					var ip layers.IPv6
 					ip.Version = 6
@@ -120,7 +144,7 @@ func connectionMonitor(device string, ipv6 bool) {
 					tcp.Ack = ack
 
 					ch := ConnInfo6[srcPort]
-					connInfo := ConnectionInfo{nil, &ip, tcp}
+					connInfo := ConnectionInfo{nil, &ip, tcp, ttl}
 					go func(info *ConnectionInfo) {
 						select {
 						case ch <- info:
@@ -153,7 +177,7 @@ func connectionMonitor(device string, ipv6 bool) {
 					tcp.Ack = ack
 
 					ch := ConnInfo4[srcPort]
-					connInfo := ConnectionInfo{nil, &ip, tcp}
+					connInfo := ConnectionInfo{nil, &ip, tcp, ttl}
 					go func(info *ConnectionInfo) {
 						select {
 						case ch <- info:
@@ -170,7 +194,7 @@ func connectionMonitor(device string, ipv6 bool) {
 	for {
 		err := start_monitor()
 		if err != nil {
-			logPrintln(1, device, err)
+			logPacket.Error("monitor", "device", device, "error", err)
 			return
 		}
 
@@ -178,33 +202,47 @@ func connectionMonitor(device string, ipv6 bool) {
 	}
 }
 
+// hopLimit reads the IPV6_HOPLIMIT control message, 0 if there is none.
+func hopLimit(oob []byte) byte {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_HOPLIMIT && len(msg.Data) >= 4 {
+			return byte(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+	return 0
+}
+
 func ICMPMonitor(device string, ipv6 bool) {
-	fmt.Printf("Device: %v\n", device)
+	logPacket.Notice("device", "device", device)
 
 	var err error
 	localaddr, err := GetLocalAddr(device, ipv6)
 	if err != nil {
-		logPrintln(1, err)
+		logPacket.Error("local address", "device", device, "error", err)
 		return
 	}
 
 	var handle *net.IPConn
 	if ipv6 {
 		if localaddr == nil {
-			logPrintln(1, "no IPv6 on", device)
+			logPacket.Error("no IPv6 address", "device", device)
 			return
 		}
 		handle, err = net.ListenIP("ip6:icmp", &net.IPAddr{IP: localaddr.IP, Zone: ""})
 	} else {
 		if localaddr == nil {
-			logPrintln(1, "no IPv4 on", device)
+			logPacket.Error("no IPv4 address", "device", device)
 			return
 		}
 		handle, err = net.ListenIP("ip4:icmp", &net.IPAddr{IP: localaddr.IP, Zone: ""})
 	}
 
 	if err != nil {
-		fmt.Printf("sockraw open failed: %v", err)
+		logPacket.Notice("sockraw open failed", "device", device, "error", err)
 		return
 	}
 	defer handle.Close()
@@ -216,7 +254,7 @@ func ICMPMonitor(device string, ipv6 bool) {
 	for {
 		n, _, err := handle.ReadFrom(data)
 		if err != nil {
-			logPrintln(1, err)
+			logPacket.Error("read", "device", device, "error", err)
 			continue
 		}
 		if len(data) < 8 || !(data[0] == 11 && data[1] == 0) {
@@ -288,104 +326,17 @@ func ConnectionMonitor(devices []string) bool {
 	return true
 }
 
-func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
-	ipLayer := connInfo.IP
-
-	tcpLayer := &layers.TCP{
-		SrcPort:    connInfo.TCP.SrcPort,
-		DstPort:    connInfo.TCP.DstPort,
-		Seq:        connInfo.TCP.Seq,
-		Ack:        connInfo.TCP.Ack,
-		DataOffset: 5,
-		ACK:        true,
-		PSH:        true,
-		Window:     connInfo.TCP.Window,
-	}
-
-	if hint&HINT_WMD5 != 0 {
-		tcpLayer.Options = []layers.TCPOption{
-			layers.TCPOption{19, 16, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
-		}
-	} else if hint&HINT_WTIME != 0 {
-		tcpLayer.Options = []layers.TCPOption{
-			layers.TCPOption{8, 8, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
-		}
-	}
-
-	if hint&HINT_NACK != 0 {
-		tcpLayer.ACK = false
-		tcpLayer.Ack = 0
-	} else if hint&HINT_WACK != 0 {
-		tcpLayer.Ack += uint32(tcpLayer.Window)
-	}
-
-	// And create the packet with the layers
-	buffer := gopacket.NewSerializeBuffer()
-	var options gopacket.SerializeOptions
-	options.FixLengths = true
-
-	if hint&HINT_WCSUM == 0 {
-		options.ComputeChecksums = true
-	}
-
-	if hint&HINT_WSEQ != 0 {
-		tcpLayer.Seq--
-		fakepayload := make([]byte, len(payload)+1)
-		fakepayload[0] = 0xFF
-		copy(fakepayload[1:], payload)
-		payload = fakepayload
-	}
-
-	var network string
-	var laddr net.IPAddr
-	var raddr net.IPAddr
-	switch ip := ipLayer.(type) {
-	case *layers.IPv4:
-		laddr = net.IPAddr{ip.SrcIP, ""}
-		raddr = net.IPAddr{ip.DstIP, ""}
-		network = "ip4:tcp"
-	case *layers.IPv6:
-		laddr = net.IPAddr{ip.SrcIP, ""}
-		raddr = net.IPAddr{ip.DstIP, ""}
-		network = "ip6:tcp"
-	}
-
-	conn, err := net.DialIP(network, &laddr, &raddr)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	if hint&HINT_TTL != 0 {
-		f, err := conn.File()
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		fd := int(f.Fd())
-		level := syscall.IPPROTO_IP
-		name := syscall.IP_TTL
-		if network == "ip6:tcp" {
-			level = syscall.IPPROTO_IPV6
-			name = syscall.IPV6_UNICAST_HOPS
-		}
-		err = syscall.SetsockoptInt(fd, level, name, int(ttl))
-		if err != nil {
-			return err
-		}
+func monitorDevice(device string) {
+	if PassiveMode {
+		go ICMPMonitor(device, false)
+	} else {
+		go connectionMonitor(device, false)
+		go connectionMonitor(device, true)
 	}
+}
 
-	tcpLayer.SetNetworkLayerForChecksum(ipLayer)
-	gopacket.SerializeLayers(buffer, options,
-		tcpLayer, gopacket.Payload(payload),
-	)
-	outgoingPacket := buffer.Bytes()
-	for i := 0; i < count; i++ {
-		_, err = conn.Write(outgoingPacket)
-		if err != nil {
-			return err
-		}
-	}
+type devicePacketWriter struct{}
 
-	return nil
+func (devicePacketWriter) WritePacket(connInfo *ConnectionInfo, packet []byte, count int) error {
+	return sendRawTCP(connInfo, packet, count)
 }
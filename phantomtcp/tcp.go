@@ -23,6 +23,7 @@ type ConnectionInfo struct {
 	Link gopacket.LinkLayer
 	IP   gopacket.NetworkLayer
 	TCP  layers.TCP
+	TTL  byte // of the SYN-ACK, 0 if it was not seen
 }
 
 type SynInfo struct {
@@ -147,6 +148,14 @@ func GetLocalAddr(name string, ipv6 bool) (*net.TCPAddr, error) {
 }
 
 func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn, *ConnectionInfo, error) {
+	conn, info, err := pface.dial(host, port, b)
+	if err != nil {
+		dialFailures.Add(1, pface.Name, dialErrorClass(err))
+	}
+	return conn, info, err
+}
+
+func (pface *PhantomInterface) dial(host string, port int, b []byte) (net.Conn, *ConnectionInfo, error) {
 	raddrs, err := pface.GetRemoteAddresses(host, port)
 	if err != nil || raddrs == nil {
 		return nil, nil, err
@@ -172,23 +181,25 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 	}
 
 	if PassiveMode || length == 0 {
-		raddr := raddrs[rand.Intn(len(raddrs))]
-
-		var laddr *net.TCPAddr = nil
-		if device != "" {
-			laddr, err = GetLocalAddr(device, raddr.IP.To4() == nil)
+		timeout := time.Millisecond * time.Duration(pface.Timeout)
+		conn, _, err = dialRace(raddrs, true, func(raddr *net.TCPAddr) (net.Conn, *ConnectionInfo, error) {
+			laddr, err := GetLocalAddr(device, raddr.IP.To4() == nil)
 			if err != nil {
 				return nil, nil, err
 			}
-		}
-
-		conn, err = net.DialTCP("tcp", laddr, raddr)
+			d := net.Dialer{Timeout: timeout}
+			if laddr != nil {
+				d.LocalAddr = laddr
+			}
+			conn, err := d.Dial("tcp", raddr.String())
+			return conn, nil, err
+		})
 		if err != nil {
 			return nil, nil, err
 		}
 
 		if pface.Protocol != 0 {
-			pface.ProxyHandshake(conn, nil, host, port)
+			err = pface.ProxyHandshake(conn, nil, host, port)
 			if err != nil {
 				conn.Close()
 				return nil, nil, err
@@ -240,7 +251,7 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 		} else if pface.Hint&HINT_RAND != 0 {
 			_, err = rand.Read(fakepayload)
 			if err != nil {
-				logPrintln(1, err)
+				logPacket.Error("random payload", "error", err)
 			}
 		} else {
 			min_dot := offset + length
@@ -265,34 +276,32 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 		}
 
 		var synpacket *ConnectionInfo
-		for i := 0; i < len(raddrs); i++ {
-			//raddr := raddrs[rand.Intn(len(raddrs))]
-			raddr := raddrs[i]
-
+		conn, synpacket, err = dialRace(raddrs, tfo_payload == nil, func(raddr *net.TCPAddr) (net.Conn, *ConnectionInfo, error) {
 			laddr, err := GetLocalAddr(device, raddr.IP.To4() == nil)
 			if err != nil {
 				return nil, nil, errors.New("invalid device")
 			}
 
-			conn, synpacket, err = DialConnInfo(laddr, raddr, pface, tfo_payload)
-			if err != nil {
-				if IsNormalError(err) {
-					continue
-				}
-				return nil, nil, err
+			var conn net.Conn
+			var synpacket *ConnectionInfo
+			if dialer, ok := pface.PacketWriter.(ConnInfoDialer); ok {
+				conn, synpacket, err = dialer.DialConnInfo(laddr, raddr, pface, tfo_payload)
+			} else {
+				conn, synpacket, err = DialConnInfo(laddr, raddr, pface, tfo_payload)
 			}
-
-			break
-		}
-
-		if synpacket == nil {
-			if conn != nil {
-				conn.Close()
+			if err == nil && synpacket == nil {
+				if conn != nil {
+					conn.Close()
+				}
+				err = errors.New("connection does not exist")
 			}
-			return nil, nil, errors.New("connection does not exist")
+			return conn, synpacket, err
+		})
+		if err != nil {
+			return nil, nil, err
 		}
 
-		logPrintln(3, host, conn.RemoteAddr(), "connected")
+		logRedirect.Trace("connected", "domain", host, "server", conn.RemoteAddr(), "interface", pface)
 
 		if (pface.Hint & HINT_DELAY) != 0 {
 			time.Sleep(time.Second)
@@ -328,7 +337,7 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 				fakepayload = fakepayload[cut:]
 				count = 2
 			} else {
-				err = ModifyAndSendPacket(synpacket, fakepayload, pface.Hint, pface.TTL, count)
+				err = pface.SendPacket(synpacket, fakepayload, pface.Hint, pface.FakeTTL(synpacket), count)
 				if err != nil {
 					conn.Close()
 					return nil, nil, err
@@ -355,7 +364,7 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 				return nil, nil, err
 			}
 
-			err = ModifyAndSendPacket(synpacket, fakepayload, pface.Hint, pface.TTL, count)
+			err = pface.SendPacket(synpacket, fakepayload, pface.Hint, pface.FakeTTL(synpacket), count)
 			if err != nil {
 				conn.Close()
 				return nil, nil, err
@@ -374,7 +383,7 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 					conn.Close()
 					return nil, nil, err
 				}
-				err = ModifyAndSendPacket(synpacket, fakepayload, pface.Hint, pface.TTL, 2)
+				err = pface.SendPacket(synpacket, fakepayload, pface.Hint, pface.FakeTTL(synpacket), 2)
 			}
 		}
 
@@ -394,7 +403,7 @@ func (server *PhantomInterface) Keep(client, conn net.Conn, connInfo *Connection
 				return
 			}
 
-			err = ModifyAndSendPacket(connInfo, fakepayload, server.Hint, server.TTL, 2)
+			err = server.SendPacket(connInfo, fakepayload, server.Hint, server.FakeTTL(connInfo), 2)
 			if err != nil {
 				conn.Close()
 				return
@@ -464,7 +473,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 	case NAT64:
 	case HTTP:
 		{
-			request := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", net.JoinHostPort(host, string(port))))
+			request := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", net.JoinHostPort(host, strconv.Itoa(port))))
 			fakepayload := make([]byte, len(request))
 			var n int = 0
 			if synpacket != nil {
@@ -481,7 +490,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 				}
 
 				proxy_seq += uint32(n)
-				err = ModifyAndSendPacket(synpacket, fakepayload, hint, server.TTL, 2)
+				err = server.SendPacket(synpacket, fakepayload, hint, server.FakeTTL(synpacket), 2)
 				if err != nil {
 					return err
 				}
@@ -513,7 +522,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 		{
 			var b [264]byte
 			if synpacket != nil {
-				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
+				err := server.SendPacket(synpacket, b[:], hint, server.FakeTTL(synpacket), 2)
 				if err != nil {
 					return err
 				}
@@ -523,7 +532,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			}
 			conn = tls.Client(conn, conf)
 			request := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n",
-				net.JoinHostPort(host, string(port))))
+				net.JoinHostPort(host, strconv.Itoa(port))))
 			n, err := conn.Write(request)
 			if err != nil || n == 0 {
 				return err
@@ -538,7 +547,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 		{
 			var b [264]byte
 			if synpacket != nil {
-				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
+				err := server.SendPacket(synpacket, b[:], hint, server.FakeTTL(synpacket), 2)
 				if err != nil {
 					return err
 				}
@@ -577,7 +586,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 		{
 			var b [264]byte
 			if synpacket != nil {
-				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
+				err := server.SendPacket(synpacket, b[:], hint, server.FakeTTL(synpacket), 2)
 				if err != nil {
 					return err
 				}
@@ -598,8 +607,8 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			}
 
 			if server.DNS != "" {
-				_, ips := NSLookup(host, server.Hint, server.DNS)
-				logPrintln(1, host, ips)
+				ips := server.lookup(host, server.Hint)
+				logSocks.Info("resolved", "domain", host, "ips", ips, "interface", server)
 				if ips != nil {
 					ip := ips[rand.Intn(len(ips))]
 					ip4 := ip.To4()
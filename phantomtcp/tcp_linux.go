@@ -155,22 +155,34 @@ func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 	}
 }
 
+// SendWithOption writes payload with tos and ttl set. It goes through
+// SyscallConn, File would put the socket in blocking mode and break
+// deadlines.
 func SendWithOption(conn net.Conn, payload []byte, tos int, ttl int) error {
-	f, err := conn.(*net.TCPConn).File()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	fd := int(f.Fd())
+	setsockopt := func(level, opt, value int) error {
+		var err error
+		cerr := raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), level, opt, value)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+
 	if tos != 0 {
-		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		err = setsockopt(syscall.IPPROTO_IP, syscall.IP_TOS, tos)
 		if err != nil {
 			return err
 		}
 	}
 
 	if ttl != 0 {
-		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		err = setsockopt(syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
 		if err != nil {
 			return err
 		}
@@ -182,14 +194,14 @@ func SendWithOption(conn net.Conn, payload []byte, tos int, ttl int) error {
 	}
 
 	if tos != 0 {
-		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, 0)
+		err = setsockopt(syscall.IPPROTO_IP, syscall.IP_TOS, 0)
 		if err != nil {
 			return err
 		}
 	}
 
 	if ttl != 0 {
-		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, 64)
+		err = setsockopt(syscall.IPPROTO_IP, syscall.IP_TTL, 64)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,113 @@
+package phantomtcp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// HopsTime is how long the hop count of a network is kept.
+var HopsTime = time.Hour
+
+const hopsMax = 4096
+
+type hopsEntry struct {
+	hops  byte
+	until time.Time
+}
+
+var hopsLock sync.Mutex
+var hopsCache = make(map[string]hopsEntry)
+
+// hopsKey groups servers by /24 or /48, they are usually behind the same
+// routers.
+func hopsKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// hopCount estimates how many routers a packet passed, from its TTL and
+// the nearest initial TTL above it.
+func hopCount(ttl byte) byte {
+	switch {
+	case ttl <= 64:
+		return 64 - ttl
+	case ttl <= 128:
+		return 128 - ttl
+	}
+	return 255 - ttl
+}
+
+// storeHops records the TTL of a SYN-ACK from ip.
+func storeHops(ip net.IP, ttl byte) {
+	hops := hopCount(ttl)
+	now := time.Now()
+	hopsLock.Lock()
+	defer hopsLock.Unlock()
+	if len(hopsCache) >= hopsMax {
+		for key, entry := range hopsCache {
+			if now.After(entry.until) {
+				delete(hopsCache, key)
+			}
+		}
+	}
+	hopsCache[hopsKey(ip)] = hopsEntry{hops, now.Add(HopsTime)}
+	logPacket.Trace("hops", "server", ip, "ttl", ttl, "hops", hops)
+}
+
+// LoadHops returns the hop count of the network of ip, 0 if not known.
+func LoadHops(ip net.IP) byte {
+	hopsLock.Lock()
+	defer hopsLock.Unlock()
+	entry, ok := hopsCache[hopsKey(ip)]
+	if !ok || time.Now().After(entry.until) {
+		return 0
+	}
+	return entry.hops
+}
+
+// Hops estimates the hop count to the server from the TTL of its SYN-ACK,
+// false if the SYN-ACK was not seen.
+func (connInfo *ConnectionInfo) Hops() (byte, bool) {
+	if connInfo.TTL == 0 {
+		return 0, false
+	}
+	return hopCount(connInfo.TTL), true
+}
+
+// FakeTTL is the TTL of the fake packets sent on connInfo. With rel-ttl it
+// is TTL hops below the server, measured on this connection or else its
+// network, TTL while that is unknown or not above TTL. With AutoTTL it is the hop count of the network
+// minus AutoTTL, TTL until that is known.
+func (pface *PhantomInterface) FakeTTL(connInfo *ConnectionInfo) byte {
+	if connInfo == nil || (pface.AutoTTL == 0 && pface.Hint&HINT_RTTL == 0) {
+		return pface.TTL
+	}
+	var dst net.IP
+	switch ip := connInfo.IP.(type) {
+	case *layers.IPv4:
+		dst = ip.DstIP
+	case *layers.IPv6:
+		dst = ip.DstIP
+	}
+
+	if pface.Hint&HINT_RTTL != 0 {
+		hops, ok := connInfo.Hops()
+		if !ok {
+			hops = LoadHops(dst)
+		}
+		if hops > pface.TTL {
+			return hops - pface.TTL
+		}
+		return pface.TTL
+	}
+
+	if hops := LoadHops(dst); hops > pface.AutoTTL {
+		return hops - pface.AutoTTL
+	}
+	return pface.TTL
+}
@@ -0,0 +1,53 @@
+package phantomtcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestHopCount(t *testing.T) {
+	for ttl, want := range map[byte]byte{64: 0, 50: 14, 1: 63, 65: 63, 128: 0, 120: 8, 129: 126, 255: 0, 240: 15} {
+		if got := hopCount(ttl); got != want {
+			t.Errorf("hopCount(%d) = %d, want %d", ttl, got, want)
+		}
+	}
+}
+
+func TestFakeTTL(t *testing.T) {
+	// 10.0.1.0/24 is 20 hops away, 10.0.0.0/24 is not known
+	storeHops(net.IP{10, 0, 1, 1}, 44)
+
+	tests := []struct {
+		name    string
+		hint    uint32
+		ttl     byte
+		autottl byte
+		dst     net.IP
+		synack  byte
+		want    byte
+	}{
+		{"ttl", HINT_TTL, 8, 0, net.IP{10, 0, 1, 2}, 50, 8},
+		{"rel-ttl synack", HINT_TTL | HINT_RTTL, 2, 0, net.IP{10, 0, 0, 2}, 50, 12},
+		{"rel-ttl network", HINT_TTL | HINT_RTTL, 2, 0, net.IP{10, 0, 1, 2}, 0, 18},
+		{"rel-ttl unknown", HINT_TTL | HINT_RTTL, 8, 0, net.IP{10, 0, 0, 2}, 0, 8},
+		{"rel-ttl too close", HINT_TTL | HINT_RTTL, 8, 0, net.IP{10, 0, 0, 2}, 58, 8},
+		{"rel-ttl equal", HINT_TTL | HINT_RTTL, 6, 0, net.IP{10, 0, 0, 2}, 58, 6},
+		{"autottl", HINT_TTL, 8, 3, net.IP{10, 0, 1, 2}, 0, 17},
+		{"autottl unknown", HINT_TTL, 8, 3, net.IP{10, 0, 0, 2}, 0, 8},
+	}
+	for _, tt := range tests {
+		pface := &PhantomInterface{Hint: tt.hint, TTL: tt.ttl, AutoTTL: tt.autottl}
+		connInfo := testConnInfo(false)
+		connInfo.IP.(*layers.IPv4).DstIP = tt.dst
+		connInfo.TTL = tt.synack
+		if got := pface.FakeTTL(connInfo); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if got := (&PhantomInterface{Hint: HINT_RTTL, TTL: 8}).FakeTTL(nil); got != 8 {
+		t.Errorf("no connection info: got %d", got)
+	}
+}
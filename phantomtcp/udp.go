@@ -136,7 +136,7 @@ func (pface *PhantomInterface) DialUDPProxy(host string, port int) (net.Conn, ne
 
 		var b [264]byte
 		if hint != 0 {
-			err := ModifyAndSendPacket(synpacket, b[:], hint, pface.TTL, 2)
+			err := pface.SendPacket(synpacket, b[:], hint, pface.FakeTTL(synpacket), 2)
 			if err != nil {
 				tcpConn.Close()
 				return nil, nil, err
@@ -3,5 +3,14 @@
 
 package phantomtcp
 
-func TProxyUDP(address string) {
+import (
+	"errors"
+	"net"
+)
+
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
+	return nil, errors.New("tproxy is only supported on linux")
+}
+
+func TProxyUDP(client *net.UDPConn) {
 }
@@ -1,81 +1,67 @@
 package phantomtcp
 
 import (
-	"encoding/binary"
+	"errors"
 	"math/rand"
 	"net"
 
 	"github.com/macronut/go-tproxy"
 )
 
-func TProxyUDP(address string) {
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
 	laddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		logPrintln(1, err)
-		return
-	}
-	client, err := tproxy.ListenUDP("udp", laddr)
-	if err != nil {
-		logPrintln(1, err)
-		return
+		return nil, err
 	}
+	return tproxy.ListenUDP("udp", laddr)
+}
+
+func TProxyUDP(client *net.UDPConn) {
 	defer client.Close()
 
 	data := make([]byte, 1500)
 	for {
 		n, srcAddr, dstAddr, err := tproxy.ReadFromUDP(client, data)
 		if err != nil {
-			logPrintln(1, err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logUDP.Error("tproxy read", "error", err)
 			continue
 		}
 
-		var host string
-		dstIP4 := dstAddr.IP.To4()
-		if dstIP4 != nil {
-			if dstIP4[0] == VirtualAddrPrefix {
-				index := int(binary.BigEndian.Uint16(dstIP4[2:4]))
-				if index >= len(Nose) {
-					logPrintln(4, "TProxy(UDP):", srcAddr, "->", dstAddr, "out of range")
-					continue
-				}
-				host = Nose[index]
-			} else {
-				continue
-			}
-		} else if dstAddr.IP[0] == 0 {
-			index := int(binary.BigEndian.Uint32(dstAddr.IP[12:16]))
-			if index >= len(Nose) {
-				logPrintln(4, "TProxy(UDP):", srcAddr, "->", dstAddr, "out of range")
-				continue
-			}
-			host = Nose[index]
-		} else {
+		if !IsVirtualAddr(dstAddr.IP) {
+			continue
+		}
+		host := GetNoseDomain(dstAddr.IP)
+		if host == "" {
+			logUDP.Verbose("tproxy unknown virtual address", "client", srcAddr, "addr", dstAddr)
 			continue
 		}
 
-		pface := DefaultProfile.GetInterface(host)
+		pface := DefaultProfile().GetInterface(host)
 		if pface.Hint&HINT_UDP == 0 {
 			if pface.Hint&(HINT_HTTP3) == 0 {
-				logPrintln(4, "TProxy(UDP):", srcAddr, "->", host, "not allow")
+				logUDP.Verbose("tproxy udp not allowed", "client", srcAddr, "domain", host, "interface", pface)
 				continue
 			}
 			if GetQUICVersion(data[:n]) == 0 {
-				logPrintln(4, "TProxy(UDP):", srcAddr, "->", host, "not h3")
+				logUDP.Verbose("tproxy not h3", "client", srcAddr, "domain", host, "interface", pface)
 				continue
 			}
 		}
 
-		logPrintln(1, "TProxy(UDP):", srcAddr, "->", host, dstAddr.Port, pface)
+		logUDP.Info("tproxy", "client", srcAddr, "domain", host, "port", dstAddr.Port, "interface", pface)
 
 		localConn, err := tproxy.DialUDP("udp", dstAddr, srcAddr)
 		if err != nil {
-			logPrintln(1, err)
+			logUDP.Error("tproxy", "client", srcAddr, "addr", dstAddr, "error", err)
 			continue
 		}
 
 		remoteConn, proxyConn, err := pface.DialUDPProxy(host, dstAddr.Port)
 		if err != nil {
-			logPrintln(1, err)
+			logUDP.Error("tproxy", "client", srcAddr, "domain", host, "interface", pface, "error", err)
 			localConn.Close()
 			if proxyConn != nil {
 				proxyConn.Close()
@@ -87,7 +73,7 @@ func TProxyUDP(address string) {
 			zero_data := make([]byte, 8+rand.Intn(1024))
 			_, err = remoteConn.Write(zero_data)
 			if err != nil {
-				logPrintln(1, err)
+				logUDP.Error("tproxy", "client", srcAddr, "domain", host, "interface", pface, "error", err)
 				localConn.Close()
 				if proxyConn != nil {
 					proxyConn.Close()
@@ -98,7 +84,7 @@ func TProxyUDP(address string) {
 
 		_, err = remoteConn.Write(data[:n])
 		if err != nil {
-			logPrintln(1, err)
+			logUDP.Error("tproxy", "client", srcAddr, "domain", host, "interface", pface, "error", err)
 			localConn.Close()
 			if proxyConn != nil {
 				proxyConn.Close()
@@ -107,6 +93,7 @@ func TProxyUDP(address string) {
 		}
 
 		go func(localConn, remoteConn, proxyConn net.Conn) {
+			defer udpSession("tproxy")()
 			relayUDP(localConn, remoteConn)
 			remoteConn.Close()
 			localConn.Close()
@@ -0,0 +1,272 @@
+package phantomtcp
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the upstreams of an interface are chosen, "dns" lists them separated
+// by commas.
+const (
+	DNS_FAILOVER = 0x0 // in order, the next one when a query fails
+	DNS_RACE     = 0x1 // all at once, the first valid answer wins
+	DNS_FASTEST  = 0x2 // lowest round trip time first
+)
+
+var DNSPolicyMap = map[string]byte{
+	"failover": DNS_FAILOVER,
+	"race":     DNS_RACE,
+	"fastest":  DNS_FASTEST,
+}
+
+func dnsPolicyName(policy byte) string {
+	for name, p := range DNSPolicyMap {
+		if p == policy && p != DNS_FAILOVER {
+			return name
+		}
+	}
+	return ""
+}
+
+// An upstream that fails UpstreamFailures times in a row is tried last for
+// UpstreamSideline.
+var UpstreamFailures = 2
+var UpstreamSideline = time.Minute
+
+// Upstream is a DNS server with its health.
+type Upstream struct {
+	Server  string
+	URL     *url.URL
+	Options ServerOptions
+
+	lock     sync.Mutex
+	rtt      time.Duration
+	failures int
+	until    time.Time
+}
+
+var upstreamLock sync.Mutex
+var upstreams = make(map[string]*Upstream)
+
+func loadUpstream(server string) (*Upstream, error) {
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	upstream, ok := upstreams[server]
+	if ok {
+		return upstream, nil
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	upstream = &Upstream{Server: server, URL: u}
+	if u.RawQuery != "" {
+		upstream.Options = ParseOptions(u.RawQuery)
+	}
+	upstreams[server] = upstream
+	return upstream, nil
+}
+
+// Upstreams parses the comma separated servers of dns.
+func Upstreams(dns string) ([]*Upstream, error) {
+	var list []*Upstream
+	for _, server := range strings.Split(dns, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		upstream, err := loadUpstream(server)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, upstream)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no dns server")
+	}
+	return list, nil
+}
+
+func (upstream *Upstream) sidelined(now time.Time) bool {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	return now.Before(upstream.until)
+}
+
+func (upstream *Upstream) RTT() time.Duration {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	return upstream.rtt
+}
+
+// observe keeps a smoothed round trip time like TCP does (RFC 6298) and
+// sidelines the upstream after too many failures in a row.
+func (upstream *Upstream) observe(rtt time.Duration, err error) {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	if err != nil {
+		dnsUpstreamTotal.Add(1, upstream.Server, "error")
+		upstream.failures++
+		if upstream.failures >= UpstreamFailures {
+			if upstream.failures == UpstreamFailures {
+				dnsUpstreamSidelined.Set(1, upstream.Server)
+				logDNS.Error("sideline upstream", "server", upstream.Server, "error", err)
+			}
+			upstream.until = time.Now().Add(UpstreamSideline)
+		}
+		return
+	}
+
+	if upstream.failures >= UpstreamFailures {
+		dnsUpstreamSidelined.Set(0, upstream.Server)
+		logDNS.Info("upstream back", "server", upstream.Server, "rtt", rtt)
+	}
+	upstream.failures = 0
+	upstream.until = time.Time{}
+	if upstream.rtt == 0 {
+		upstream.rtt = rtt
+	} else {
+		upstream.rtt += (rtt - upstream.rtt) / 8
+	}
+	dnsUpstreamRTT.Set(upstream.rtt.Milliseconds(), upstream.Server)
+}
+
+var errUnknownScheme = errors.New("unknown protocol")
+var errServerFailure = errors.New("server failure")
+
+func (upstream *Upstream) lookup(request []byte) ([]byte, error) {
+	u := upstream.URL
+	var response []byte
+	var err error
+	start := time.Now()
+	switch u.Scheme {
+	case "udp":
+		response, err = UDPlookup(request, u.Host)
+	case "tcp":
+		response, err = TCPlookup(request, u.Host, nil)
+	case "tls":
+		response, err = TLSlookup(request, u.Host)
+	case "https":
+		response, err = HTTPSlookup(request, u, upstream.Options.Domain)
+	case "tfo":
+		response, err = TFOlookup(request, u.Host)
+	case "quic", "doq":
+		response, err = QUIClookup(request, u.Host, upstream.Options.Domain)
+	default:
+		return nil, errUnknownScheme
+	}
+	if err == nil && len(response) < 12 {
+		err = errors.New("short response")
+	}
+	observeLookup(u.Scheme, start, err)
+	upstream.observe(time.Since(start), err)
+	if err != nil {
+		logDNS.Debug("upstream", "server", upstream.Server, "error", err)
+		return nil, err
+	}
+	if !validResponse(response) {
+		dnsUpstreamTotal.Add(1, upstream.Server, "servfail")
+		return response, errServerFailure
+	}
+	dnsUpstreamTotal.Add(1, upstream.Server, "ok")
+	return response, nil
+}
+
+// validResponse is false for SERVFAIL and REFUSED, another upstream may
+// do better. They do not count against the health of the upstream.
+func validResponse(response []byte) bool {
+	rcode := response[3] & 0x0f
+	return rcode != 2 && rcode != 5
+}
+
+// order puts the sidelined upstreams last, by round trip time for
+// DNS_FASTEST. Those not measured yet go first so they get measured.
+func order(list []*Upstream, policy byte) []*Upstream {
+	now := time.Now()
+	var healthy, sidelined []*Upstream
+	for _, upstream := range list {
+		if upstream.sidelined(now) {
+			sidelined = append(sidelined, upstream)
+		} else {
+			healthy = append(healthy, upstream)
+		}
+	}
+	if policy == DNS_FASTEST {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].RTT() < healthy[j].RTT()
+		})
+	}
+	return append(healthy, sidelined...)
+}
+
+// exchange sends the request build makes for each upstream of dns by
+// policy, it returns the answer and the upstream that gave it.
+func exchange(dns string, policy byte, build func(upstream *Upstream) []byte) ([]byte, *Upstream, error) {
+	list, err := Upstreams(dns)
+	if err != nil {
+		return nil, nil, err
+	}
+	list = order(list, policy)
+
+	// a server failure is still an answer if no upstream does better
+	var failed []byte
+	var failedUpstream *Upstream
+
+	if policy != DNS_RACE || len(list) == 1 {
+		for _, upstream := range list {
+			var response []byte
+			response, err = upstream.lookup(build(upstream))
+			if err == nil {
+				return response, upstream, nil
+			}
+			if response != nil {
+				failed, failedUpstream = response, upstream
+			}
+		}
+		if failed != nil {
+			return failed, failedUpstream, nil
+		}
+		return nil, nil, err
+	}
+
+	// the sidelined ones only race when all are
+	racing := list
+	for i, upstream := range list {
+		if upstream.sidelined(time.Now()) {
+			if i > 0 {
+				racing = list[:i]
+			}
+			break
+		}
+	}
+	type result struct {
+		response []byte
+		upstream *Upstream
+		err      error
+	}
+	results := make(chan result, len(racing))
+	for _, upstream := range racing {
+		go func(upstream *Upstream) {
+			response, err := upstream.lookup(build(upstream))
+			results <- result{response, upstream, err}
+		}(upstream)
+	}
+	for range racing {
+		r := <-results
+		if r.err == nil {
+			return r.response, r.upstream, nil
+		}
+		if r.response != nil {
+			failed, failedUpstream = r.response, r.upstream
+		}
+		err = r.err
+	}
+	if failed != nil {
+		return failed, failedUpstream, nil
+	}
+	return nil, nil, err
+}
@@ -30,14 +30,15 @@ var HintMap = map[string]uint32{
 	"strip":    HINT_STRIP,
 	"fronting": HINT_FRONTING,
 
-	"ttl":    HINT_TTL,
-	"mss":    HINT_MSS,
-	"w-md5":  HINT_WMD5,
-	"n-ack":  HINT_NACK,
-	"w-ack":  HINT_WACK,
-	"w-csum": HINT_WCSUM,
-	"w-seq":  HINT_WSEQ,
-	"w-time": HINT_WTIME,
+	"ttl":     HINT_TTL,
+	"rel-ttl": HINT_RTTL,
+	"mss":     HINT_MSS,
+	"w-md5":   HINT_WMD5,
+	"n-ack":   HINT_NACK,
+	"w-ack":   HINT_WACK,
+	"w-csum":  HINT_WCSUM,
+	"w-seq":   HINT_WSEQ,
+	"w-time":  HINT_WTIME,
 
 	"tfo":    HINT_TFO,
 	"udp":    HINT_UDP,
@@ -72,7 +73,7 @@ func connectionMonitor(layer uint8) {
 	winDivert, err = godivert.WinDivertOpen(filter, layer, 1, 0)
 	winDivertLock.Unlock()
 	if err != nil {
-		fmt.Printf("winDivert open failed: %v", err)
+		logPacket.Notice("windivert open failed", "filter", filter, "error", err)
 		return
 	}
 	defer winDivert.Close()
@@ -80,7 +81,7 @@ func connectionMonitor(layer uint8) {
 	for {
 		divertpacket, err := winDivert.Recv()
 		if err != nil {
-			logPrintln(1, err)
+			logPacket.Error("windivert recv", "error", err)
 			continue
 		}
 
@@ -101,15 +102,20 @@ func connectionMonitor(layer uint8) {
 			var srcPort layers.TCPPort
 			var synAddr string
 			var hint uint32 = 0
+			var ttl byte
 			if synack {
+				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
+				synAddr = addr.String()
+				ttl = ip.TTL
+				if _, ok := ConnSyn.Load(synAddr); ok {
+					storeHops(ip.SrcIP, ttl)
+				}
 				hint = ConnWait4[tcp.DstPort]
 				if hint == 0 {
 					winDivert.Send(divertpacket)
 					continue
 				}
 				srcPort = tcp.DstPort
-				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
-				synAddr = addr.String()
 			} else {
 				srcPort = tcp.SrcPort
 				addr := net.TCPAddr{IP: ip.DstIP, Port: int(tcp.DstPort)}
@@ -136,7 +142,17 @@ func connectionMonitor(layer uint8) {
 				}
 
 				ch := ConnInfo4[srcPort]
-				connInfo := &ConnectionInfo{nil, ip, *tcp}
+				connInfo := &ConnectionInfo{nil, ip, *tcp, ttl}
+
+				if hint&(HINT_RTTL|HINT_TFO|HINT_HTFO|HINT_SYNX2) == HINT_RTTL {
+					// report the connection with its SYN-ACK, which has the TTL
+					if !synack {
+						ConnWait4[srcPort] = hint
+						winDivert.Send(divertpacket)
+						continue
+					}
+					ConnWait4[srcPort] = 0
+				}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
 					if synack {
@@ -193,15 +209,20 @@ func connectionMonitor(layer uint8) {
 			var srcPort layers.TCPPort
 			var synAddr string
 			var hint uint32 = 0
+			var ttl byte
 			if synack {
+				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
+				synAddr = addr.String()
+				ttl = ip.HopLimit
+				if _, ok := ConnSyn.Load(synAddr); ok {
+					storeHops(ip.SrcIP, ttl)
+				}
 				hint = ConnWait6[tcp.DstPort]
 				if hint == 0 {
 					winDivert.Send(divertpacket)
 					continue
 				}
 				srcPort = tcp.DstPort
-				addr := net.TCPAddr{IP: ip.SrcIP, Port: int(tcp.SrcPort)}
-				synAddr = addr.String()
 			} else {
 				srcPort = tcp.SrcPort
 				addr := net.TCPAddr{IP: ip.DstIP, Port: int(tcp.DstPort)}
@@ -227,7 +248,17 @@ func connectionMonitor(layer uint8) {
 				}
 
 				ch := ConnInfo6[srcPort]
-				connInfo := &ConnectionInfo{nil, ip, *tcp}
+				connInfo := &ConnectionInfo{nil, ip, *tcp, ttl}
+
+				if hint&(HINT_RTTL|HINT_TFO|HINT_HTFO|HINT_SYNX2) == HINT_RTTL {
+					// report the connection with its SYN-ACK, which has the TTL
+					if !synack {
+						ConnWait6[srcPort] = hint
+						winDivert.Send(divertpacket)
+						continue
+					}
+					ConnWait6[srcPort] = 0
+				}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
 					if synack {
@@ -297,6 +328,10 @@ func ConnectionMonitor(devices []string) bool {
 	return true
 }
 
+func monitorDevice(device string) {
+	// the WinDivert handle already covers every device
+}
+
 func SendPacket(packet gopacket.Packet) error {
 	payload := packet.LinkLayer().LayerPayload()
 
@@ -311,104 +346,12 @@ func SendPacket(packet gopacket.Packet) error {
 	return err
 }
 
-func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
-	ipLayer := connInfo.IP
-
-	var tcpLayer *layers.TCP
-	if hint&HINT_TFO != 0 {
-		tcpLayer = &connInfo.TCP
-
-		tcpLayer.Seq -= uint32(len(payload))
-		var cookie []byte = nil
-		switch ip := ipLayer.(type) {
-		case *layers.IPv4:
-			result, ok := TFOCookies.Load(ip.DstIP.String())
-			if ok {
-				cookie = result.([]byte)
-			} else {
-				payload = nil
-			}
-		case *layers.IPv6:
-			result, ok := TFOCookies.Load(ip.DstIP.String())
-			if ok {
-				cookie = result.([]byte)
-			} else {
-				payload = nil
-			}
-		}
-
-		tcpLayer.Options = append(connInfo.TCP.Options,
-			layers.TCPOption{34, uint8(len(cookie)), cookie},
-		)
-	} else {
-		tcpLayer = &layers.TCP{
-			SrcPort:    connInfo.TCP.SrcPort,
-			DstPort:    connInfo.TCP.DstPort,
-			Seq:        connInfo.TCP.Seq,
-			Ack:        connInfo.TCP.Ack,
-			DataOffset: 5,
-			ACK:        true,
-			PSH:        true,
-			Window:     connInfo.TCP.Window,
-		}
-
-		if hint&HINT_WMD5 != 0 {
-			tcpLayer.Options = []layers.TCPOption{
-				layers.TCPOption{19, 16, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
-			}
-		} else if hint&HINT_WTIME != 0 {
-			tcpLayer.Options = []layers.TCPOption{
-				layers.TCPOption{8, 8, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
-			}
-		}
-	}
-
-	if hint&HINT_NACK != 0 {
-		tcpLayer.ACK = false
-		tcpLayer.Ack = 0
-	} else if hint&HINT_WACK != 0 {
-		tcpLayer.Ack += uint32(tcpLayer.Window)
-	}
-
-	// And create the packet with the layers
-	buffer := gopacket.NewSerializeBuffer()
-	var options gopacket.SerializeOptions
-	options.FixLengths = true
-
-	if hint&HINT_WCSUM == 0 {
-		options.ComputeChecksums = true
-	}
-
-	if hint&HINT_WSEQ != 0 {
-		tcpLayer.Seq--
-		fakepayload := make([]byte, len(payload)+1)
-		fakepayload[0] = 0xFF
-		copy(fakepayload[1:], payload)
-		payload = fakepayload
-	}
-
-	tcpLayer.SetNetworkLayerForChecksum(ipLayer)
-
-	switch ip := ipLayer.(type) {
-	case *layers.IPv4:
-		if hint&HINT_TTL != 0 {
-			ip.TTL = ttl
-		}
-		gopacket.SerializeLayers(buffer, options,
-			ip, tcpLayer, gopacket.Payload(payload),
-		)
-	case *layers.IPv6:
-		if hint&HINT_TTL != 0 {
-			ip.HopLimit = ttl
-		}
-		gopacket.SerializeLayers(buffer, options,
-			ip, tcpLayer, gopacket.Payload(payload),
-		)
-	}
+type devicePacketWriter struct{}
 
+func (devicePacketWriter) WritePacket(connInfo *ConnectionInfo, packet []byte, count int) error {
 	var divertAddr godivert.WinDivertAddress
 	var divertpacket godivert.Packet
-	divertpacket.Raw = buffer.Bytes()
+	divertpacket.Raw = packet
 	divertpacket.PacketLen = uint(len(divertpacket.Raw))
 	divertpacket.Addr = &divertAddr
 	divertpacket.ParseHeaders()
@@ -441,7 +384,7 @@ func Redirect(dst string, to_port int, forward bool) {
 		dstfilter = fmt.Sprintf("ip.DstAddr=%s and tcp", dst)
 	}
 
-	logPrintln(1, dstfilter)
+	logPacket.Info("redirect filter", "filter", dstfilter)
 
 	filter := fmt.Sprintf("(outbound and %s) or (ip.SrcAddr>127.255.0.0 and ip.SrcAddr<127.255.255.255 and tcp.SrcPort=%s)", dstfilter, strconv.Itoa(to_port))
 
@@ -449,7 +392,7 @@ func Redirect(dst string, to_port int, forward bool) {
 	winDivertLocal, err := godivert.WinDivertOpen(filter, 0, 0, 0)
 	winDivertLock.Unlock()
 	if err != nil {
-		fmt.Printf("winDivert open failed: %v with %s", err, filter)
+		logPacket.Notice("windivert open failed", "filter", filter, "error", err)
 		return
 	}
 	defer winDivertLocal.Close()
@@ -461,7 +404,7 @@ func Redirect(dst string, to_port int, forward bool) {
 		winDivertForward, err = godivert.WinDivertOpen(forwardfilter, 1, 0, 0)
 		winDivertLock.Unlock()
 		if err != nil {
-			fmt.Printf("winDivert open failed: %v with %s", err, forwardfilter)
+			logPacket.Notice("windivert open failed", "filter", forwardfilter, "error", err)
 			return
 		}
 
@@ -471,7 +414,7 @@ func Redirect(dst string, to_port int, forward bool) {
 			for {
 				packet, err := winDivertForward.Recv()
 				if err != nil {
-					logPrintln(1, err)
+					logPacket.Error("windivert recv", "error", err)
 					continue
 				}
 
@@ -493,7 +436,7 @@ func Redirect(dst string, to_port int, forward bool) {
 	for {
 		packet, err := winDivertLocal.Recv()
 		if err != nil {
-			logPrintln(1, err)
+			logPacket.Error("windivert recv", "error", err)
 			continue
 		}
 
@@ -526,7 +469,7 @@ func RedirectDNS() {
 	winDivert, err := godivert.WinDivertOpen("outbound and udp.DstPort=53", 0, 0, 0)
 	winDivertLock.Unlock()
 	if err != nil {
-		fmt.Printf("winDivert open failed: %v", err)
+		logPacket.Notice("windivert open failed", "filter", "outbound and udp.DstPort=53", "error", err)
 		return
 	}
 	defer winDivert.Close()
@@ -535,7 +478,7 @@ func RedirectDNS() {
 	for {
 		packet, err := winDivert.Recv()
 		if err != nil {
-			logPrintln(1, err)
+			logDNS.Error("windivert recv", "error", err)
 			continue
 		}
 		ipv6 := packet.Raw[0]>>4 == 6
@@ -551,13 +494,13 @@ func RedirectDNS() {
 
 		qname, _, _ := GetQName(request)
 		if qname == "" {
-			logPrintln(2, "DNS Segmentation fault")
+			logDNS.Debug("bad request")
 			continue
 		}
 
-		server := DefaultProfile.GetInterface(qname)
+		server := DefaultProfile().GetInterface(qname)
 		if server != nil {
-			logPrintln(1, qname, server)
+			logDNS.Info("redirect dns", "domain", qname, "interface", server)
 			_, response := NSRequest(request, true)
 			udpsize := len(response) + 8
 
@@ -592,7 +535,7 @@ func RedirectDNS() {
 
 		_, err = winDivert.Send(packet)
 		if err != nil {
-			logPrintln(1, err)
+			logDNS.Error("windivert send", "error", err)
 			return
 		}
 	}